@@ -0,0 +1,252 @@
+// Copyright 2018 Red Hat
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+/*
+ * kokotap: follow target pods of selector/workload
+ */
+import (
+	"fmt"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"os"
+	"sort"
+	"time"
+)
+
+// podDeleteTimeout is the time to wait for the old receiver pod to be deleted
+// before it is recreated.
+const podDeleteTimeout = 60 * time.Second
+
+// tapFollower adds/removes senders as the target pods come and go.
+// Each sender uses a slot (VxLAN ID and receiver interface, by index), and
+// the slot of removed pod is reused by new pod, so that capture on the
+// receiver interface survives rolling update.
+type tapFollower struct {
+	clients  *tapClients
+	podargs  *kokotapPodArgs
+	kind     string
+	name     string
+	selector string
+	slots    []string // target pod (podKey) for each slot, "" if free
+}
+
+func newTapFollower(clients *tapClients, podargs *kokotapPodArgs, kind, name, selector string) *tapFollower {
+	follower := &tapFollower{
+		clients:  clients,
+		podargs:  podargs,
+		kind:     kind,
+		name:     name,
+		selector: selector,
+	}
+	for _, sender := range podargs.Senders {
+		follower.slots = append(follower.slots, sender.PodName)
+	}
+	return follower
+}
+
+// isTapReady returns true if the container of the pod can be tapped (it does
+// not need to be ready).
+func isTapReady(pod *v1.Pod, podargs *kokotapPodArgs) bool {
+	if pod.DeletionTimestamp != nil || pod.Status.Phase != v1.PodRunning {
+		return false
+	}
+	_, err := podargs.targetContainerID(pod, podargs.Container)
+	return err == nil
+}
+
+// addSender creates the sender for the pod, at free slot (or new slot).
+// The receiver for the slot is created only if it does not exist, or
+// recreated if the sender is on other node than the previous one.
+func (f *tapFollower) addSender(pod *v1.Pod) error {
+	idx := len(f.slots)
+	for i, podName := range f.slots {
+		if podName == "" {
+			idx = i
+			break
+		}
+	}
+
+	sender, err := f.podargs.NewSender(pod, idx)
+	if err != nil {
+		return err
+	}
+	podargs := *f.podargs
+	podargs.Senders = []kokotapSenderArgs{sender}
+	pods, err := podargs.GeneratePods()
+	if err != nil {
+		return err
+	}
+
+	for _, tapPod := range pods {
+		client := f.clients.podClient(tapPod)
+		created, err := client.CreatePod(tapPod)
+		if err != nil {
+			if tapPod.Labels[tapRoleLabel] != tapRoleReceiver || !apierrors.IsAlreadyExists(err) {
+				return fmt.Errorf("failed to create pod %q: %v", tapPod.Name, err)
+			}
+			existing, err := getSlotReceiver(client, tapPod)
+			if err != nil {
+				return err
+			}
+			if existing.Annotations[tapSenderIPAnnotation] == tapPod.Annotations[tapSenderIPAnnotation] {
+				continue
+			}
+			// the tunnel of the receiver is bound to the old sender node
+			if created, err = recreatePod(client, tapPod, podDeleteTimeout); err != nil {
+				return err
+			}
+		}
+		fmt.Printf("pod/%s created (target %q, slot %d)\n", created.Name, pod.Name, idx)
+		go followPodLogs(client, created.Namespace, created.Name)
+	}
+
+	if idx == len(f.slots) {
+		f.slots = append(f.slots, sender.PodName)
+	} else {
+		f.slots[idx] = sender.PodName
+	}
+	return nil
+}
+
+// getSlotReceiver returns the existing receiver pod of the name of tapPod,
+// if it is the receiver of the same slot (receiver interface) and node.
+func getSlotReceiver(client kubeClient, tapPod *v1.Pod) (*v1.Pod, error) {
+	pod, err := client.GetPod(tapPod.Namespace, tapPod.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pod %q: %v", tapPod.Name, err)
+	}
+	for _, key := range []string{tapIFNameAnnotation, tapDestNodeAnnotation} {
+		if pod.Annotations[key] != tapPod.Annotations[key] {
+			return nil, fmt.Errorf("pod %q already exists, but it is not the receiver of %s %q",
+				tapPod.Name, key, tapPod.Annotations[key])
+		}
+	}
+	return pod, nil
+}
+
+// recreatePod deletes the pod and creates it again, after the old pod is gone.
+func recreatePod(client kubeClient, pod *v1.Pod, timeout time.Duration) (*v1.Pod, error) {
+	err := client.DeletePod(pod.Namespace, pod.Name)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("failed to delete pod %q: %v", pod.Name, err)
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		_, err = client.GetPod(pod.Namespace, pod.Name)
+		if apierrors.IsNotFound(err) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get pod %q: %v", pod.Name, err)
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timeout waiting for pod %q to be deleted", pod.Name)
+		}
+		time.Sleep(time.Second)
+	}
+	created, err := client.CreatePod(pod)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pod %q: %v", pod.Name, err)
+	}
+	return created, nil
+}
+
+// removeSender deletes the sender of idx-th slot and frees the slot.
+func (f *tapFollower) removeSender(idx int) error {
+	sender := kokotapSenderArgs{PodName: f.slots[idx]}
+	name := f.podargs.GenerateSenderPodName(&sender)
+	err := f.clients.target.DeletePod(f.podargs.Namespace, name)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete pod %q: %v", name, err)
+	}
+	fmt.Printf("pod %q deleted (target %q is gone, slot %d)\n", name, f.slots[idx], idx)
+	f.slots[idx] = ""
+	return nil
+}
+
+// sync adds senders for new target pods and removes senders for the target
+// pods which are gone.
+func (f *tapFollower) sync() error {
+	podList, err := listTargetPods(f.clients.target, f.podargs.Namespace, f.kind, f.name, f.selector)
+	if err != nil {
+		return err
+	}
+	pods := map[string]*v1.Pod{}
+	for i := range podList {
+		if isTapReady(&podList[i], f.podargs) {
+			pods[f.podargs.podKey(&podList[i])] = &podList[i]
+		}
+	}
+
+	tapped := map[string]bool{}
+	for idx, podName := range f.slots {
+		if podName == "" {
+			continue
+		}
+		if _, ok := pods[podName]; ok {
+			tapped[podName] = true
+			continue
+		}
+		if err := f.removeSender(idx); err != nil {
+			return err
+		}
+	}
+
+	names := []string{}
+	for name := range pods {
+		if !tapped[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := f.addSender(pods[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// run watches the target pods and syncs the senders until stop is closed.
+func (f *tapFollower) run(stop <-chan struct{}) {
+	for {
+		w, err := watchTargetPods(f.clients.target, f.podargs.Namespace, f.kind, f.name, f.selector)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to watch target pods: %v\n", err)
+			select {
+			case <-stop:
+				return
+			case <-time.After(5 * time.Second):
+				continue
+			}
+		}
+
+	watchLoop:
+		for {
+			select {
+			case <-stop:
+				w.Stop()
+				return
+			case _, ok := <-w.ResultChan():
+				if !ok {
+					break watchLoop
+				}
+				if err := f.sync(); err != nil {
+					fmt.Fprintf(os.Stderr, "failed to follow target pods: %v\n", err)
+				}
+			}
+		}
+	}
+}
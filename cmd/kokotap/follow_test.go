@@ -0,0 +1,198 @@
+// Copyright 2018 Red Hat
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"io"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// fakeFollowClient lists targets as the target pods, and creates/deletes the
+// tap pods in the pods of fakeKubeClient.
+type fakeFollowClient struct {
+	fakeKubeClient
+	targets []v1.Pod
+}
+
+func (f *fakeFollowClient) ListPods(namespace, labelSelector string) (*v1.PodList, error) {
+	return &v1.PodList{Items: f.targets}, nil
+}
+
+func (f *fakeFollowClient) CreatePod(pod *v1.Pod) (*v1.Pod, error) {
+	key := pod.Namespace + "/" + pod.Name
+	if _, ok := f.pods[key]; ok {
+		return nil, apierrors.NewAlreadyExists(schema.GroupResource{Resource: "pods"}, pod.Name)
+	}
+	f.pods[key] = pod
+	return pod, nil
+}
+
+func (f *fakeFollowClient) DeletePod(namespace, name string) error {
+	if _, ok := f.pods[namespace+"/"+name]; !ok {
+		return apierrors.NewNotFound(schema.GroupResource{Resource: "pods"}, name)
+	}
+	delete(f.pods, namespace+"/"+name)
+	return nil
+}
+
+func (f *fakeFollowClient) StreamPodLogs(namespace, name string) (io.ReadCloser, error) {
+	return nil, fmt.Errorf("no logs")
+}
+
+// tapPodNames returns the sorted names of the tap pods of role.
+func (f *fakeFollowClient) tapPodNames(role string) []string {
+	names := []string{}
+	for _, pod := range f.pods {
+		if pod.Labels[tapRoleLabel] == role {
+			names = append(names, pod.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newFollowTarget returns the running target pod on node of hostIP.
+func newFollowTarget(name, node, hostIP string) v1.Pod {
+	pod := newFakePod("default", name)
+	pod.Spec.NodeName = node
+	pod.Status.Phase = v1.PodRunning
+	pod.Status.HostIP = hostIP
+	pod.Status.ContainerStatuses = []v1.ContainerStatus{{Name: "web", ContainerID: "containerd://" + name}}
+	return *pod
+}
+
+func newFollowPodArgs() *kokotapPodArgs {
+	podargs := &kokotapPodArgs{
+		Name:              "app=web",
+		Namespace:         "default",
+		Encap:             "vxlan",
+		VxlanID:           100,
+		VxlanPort:         4789,
+		MirrorType:        "both",
+		IFName:            "mirror",
+		DestIP:            "10.0.0.1",
+		Image:             "kokotap",
+		ReceiverPerSender: true,
+		IndexIFName:       true,
+	}
+	podargs.Receiver.Node = "kube-master"
+	return podargs
+}
+
+func TestFollowerSync(t *testing.T) {
+	client := &fakeFollowClient{fakeKubeClient: fakeKubeClient{pods: map[string]*v1.Pod{}}}
+	clients := &tapClients{target: client, dest: client}
+	podargs := newFollowPodArgs()
+	follower := newTapFollower(clients, podargs, "", "", "app=web")
+
+	steps := []struct {
+		name      string
+		targets   []string
+		slots     []string
+		senders   int
+		receivers int
+	}{
+		{name: "initial pods", targets: []string{"web-a", "web-b"}, slots: []string{"web-a", "web-b"}, senders: 2, receivers: 2},
+		{name: "no change", targets: []string{"web-a", "web-b"}, slots: []string{"web-a", "web-b"}, senders: 2, receivers: 2},
+		{name: "pod replaced", targets: []string{"web-b", "web-c"}, slots: []string{"web-c", "web-b"}, senders: 2, receivers: 2},
+		{name: "pod gone", targets: []string{"web-c"}, slots: []string{"web-c", ""}, senders: 1, receivers: 2},
+		{name: "pod added", targets: []string{"web-c", "web-d", "web-e"}, slots: []string{"web-c", "web-d", "web-e"}, senders: 3, receivers: 3},
+	}
+
+	for _, step := range steps {
+		client.targets = nil
+		for _, name := range step.targets {
+			client.targets = append(client.targets, newFollowTarget(name, "kube-node-1", "10.0.0.2"))
+		}
+		if err := follower.sync(); err != nil {
+			t.Fatalf("%s: unexpected error: %v", step.name, err)
+		}
+		if !reflect.DeepEqual(follower.slots, step.slots) {
+			t.Errorf("%s: slots = %v, want %v", step.name, follower.slots, step.slots)
+		}
+		senders := client.tapPodNames(tapRoleSender)
+		receivers := client.tapPodNames(tapRoleReceiver)
+		if len(senders) != step.senders || len(receivers) != step.receivers {
+			t.Errorf("%s: senders = %v, receivers = %v, want %d, %d",
+				step.name, senders, receivers, step.senders, step.receivers)
+		}
+	}
+}
+
+func TestFollowerReceiverOfOtherSlot(t *testing.T) {
+	client := &fakeFollowClient{fakeKubeClient: fakeKubeClient{pods: map[string]*v1.Pod{}}}
+	clients := &tapClients{target: client, dest: client}
+	podargs := newFollowPodArgs()
+	follower := newTapFollower(clients, podargs, "", "", "app=web")
+
+	// the pod of the receiver name exists, but it is for other interface
+	sender := kokotapSenderArgs{IFName: receiverIFName(podargs.IFName, 0, true)}
+	other := newFakePod("default", podargs.GenerateReceiverPodName(&sender))
+	other.Annotations = map[string]string{
+		tapIFNameAnnotation:   "mirror5",
+		tapDestNodeAnnotation: podargs.Receiver.Node,
+	}
+	client.pods["default/"+other.Name] = other
+
+	client.targets = []v1.Pod{newFollowTarget("web-a", "kube-node-1", "10.0.0.2")}
+	if err := follower.sync(); err == nil {
+		t.Errorf("no error for the receiver of other slot")
+	}
+	if client.pods["default/"+other.Name] != other {
+		t.Errorf("receiver of other slot is replaced")
+	}
+}
+
+func TestFollowerSenderMoved(t *testing.T) {
+	client := &fakeFollowClient{fakeKubeClient: fakeKubeClient{pods: map[string]*v1.Pod{}}}
+	clients := &tapClients{target: client, dest: client}
+	podargs := newFollowPodArgs()
+	follower := newTapFollower(clients, podargs, "", "", "app=web")
+
+	steps := []struct {
+		name     string
+		target   v1.Pod
+		senderIP string
+	}{
+		{name: "initial pod", target: newFollowTarget("web-a", "kube-node-1", "10.0.0.2"), senderIP: "10.0.0.2"},
+		{name: "same node", target: newFollowTarget("web-b", "kube-node-1", "10.0.0.2"), senderIP: "10.0.0.2"},
+		{name: "other node", target: newFollowTarget("web-c", "kube-node-2", "10.0.0.3"), senderIP: "10.0.0.3"},
+	}
+
+	var receiver *v1.Pod
+	for _, step := range steps {
+		client.targets = []v1.Pod{step.target}
+		if err := follower.sync(); err != nil {
+			t.Fatalf("%s: unexpected error: %v", step.name, err)
+		}
+		receivers := client.tapPodNames(tapRoleReceiver)
+		if len(receivers) != 1 {
+			t.Fatalf("%s: receivers = %v, want 1", step.name, receivers)
+		}
+		pod := client.pods["default/"+receivers[0]]
+		if ip := pod.Annotations[tapSenderIPAnnotation]; ip != step.senderIP {
+			t.Errorf("%s: sender IP of receiver = %q, want %q", step.name, ip, step.senderIP)
+		}
+		if receiver != nil && (pod == receiver) != (step.senderIP == receiver.Annotations[tapSenderIPAnnotation]) {
+			t.Errorf("%s: receiver recreated = %v", step.name, pod != receiver)
+		}
+		receiver = pod
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright 2018 Red Hat
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+/*
+ * kokotap: show interfaces in the network namespace of the pod
+ *
+ * A short-lived pod on the node of the target pod finds the network
+ * namespace as the sender does, then prints the interfaces as JSON to its
+ * logs.
+ */
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"os"
+	"os/signal"
+	"sigs.k8s.io/yaml"
+	"syscall"
+	"text/template"
+	"time"
+)
+
+// tapRoleInterfaces is tapRoleLabel value of the pod for 'kokotap interfaces'
+const tapRoleInterfaces = "interfaces"
+
+// kokotapInterfacesPodTemplate is the pod which prints the interfaces of the
+// target pod. It has no tap label, so it is not a part of the taps.
+const kokotapInterfacesPodTemplate = `apiVersion: v1
+kind: Pod
+metadata:
+  generateName: {{.PodName}}-
+  labels:
+    kokotap.redhat-nfvpe.github.io/role: interfaces
+  annotations:
+    kokotap.redhat-nfvpe.github.io/target-pod: "{{.TargetPod}}"
+    kokotap.redhat-nfvpe.github.io/target-namespace: "{{.TargetNamespace}}"
+spec:
+  hostNetwork: true
+  nodeName: {{.NodeName}}
+  restartPolicy: Never
+  containers:
+    - name: kokotap-interfaces
+      image: {{.ContainerImage}}
+      imagePullPolicy: Always
+      command: ["/bin/kokotap_pod"]
+      args: ["--procprefix=/host", "mode", "interfaces", "--containerid={{.ContainerID}}",
+{{- if .RuntimeSocket}}
+             "--runtime-socket={{.RuntimeSocket}}",
+{{- end}}
+             "--pod-uid={{.PodUID}}", "--netns-discovery={{.NetnsDiscovery}}"]
+      securityContext:
+        privileged: true
+      volumeMounts:
+{{- if .RuntimeSocket}}
+      - name: runtime-socket
+        mountPath: {{.RuntimeSocket}}
+{{- end}}
+      - name: proc
+        mountPath: /host/proc
+  volumes:
+{{- if .RuntimeSocket}}
+    - name: runtime-socket
+      hostPath:
+        path: {{.RuntimeSocket}}
+{{- end}}
+    - name: proc
+      hostPath:
+        path: /proc
+`
+
+// generateInterfacesPod returns the pod which prints the interfaces of the
+// target pod.
+func (podargs *kokotapPodArgs) generateInterfacesPod(pod *v1.Pod) (*v1.Pod, error) {
+	containerID, err := getContainerID(pod, podargs.Container)
+	if err != nil {
+		return nil, err
+	}
+	socket, err := podargs.runtimeSocket(pod, containerID)
+	if err != nil {
+		return nil, err
+	}
+	netnsDiscovery := podargs.NetnsDiscovery
+	if pod.Spec.HostNetwork {
+		netnsDiscovery = "host"
+	}
+
+	podTemplate, _ := template.New("kokotapInterfacesPodTemplate").Parse(kokotapInterfacesPodTemplate)
+	var podYaml bytes.Buffer
+	err = podTemplate.Execute(&podYaml, map[string]interface{}{
+		"PodName":         truncateName("kokotap-interfaces-"+sanitizeName(pod.Name), 56),
+		"TargetPod":       pod.Name,
+		"TargetNamespace": pod.Namespace,
+		"NodeName":        pod.Spec.NodeName,
+		"ContainerImage":  podargs.Image,
+		"ContainerID":     containerID,
+		"RuntimeSocket":   socket,
+		"PodUID":          string(pod.UID),
+		"NetnsDiscovery":  netnsDiscovery,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	interfacesPod := &v1.Pod{}
+	if err := yaml.Unmarshal(podYaml.Bytes(), interfacesPod); err != nil {
+		return nil, fmt.Errorf("failed to decode pod yaml: %v", err)
+	}
+	interfacesPod.Namespace = podargs.Namespace
+	return interfacesPod, nil
+}
+
+// waitForPodCompleted waits until the pod is succeeded or failed.
+func waitForPodCompleted(kubeClient kubeClient, namespace, name string, timeout time.Duration) (*v1.Pod, error) {
+	w, err := kubeClient.WatchPods(namespace, fmt.Sprintf("%s=%s", tapRoleLabel, tapRoleInterfaces))
+	if err != nil {
+		return nil, err
+	}
+	defer w.Stop()
+
+	timer := time.After(timeout)
+	for {
+		select {
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				return nil, fmt.Errorf("watch for pods is closed")
+			}
+			pod, ok := event.Object.(*v1.Pod)
+			if !ok || pod.Name != name {
+				continue
+			}
+			if event.Type == watch.Deleted {
+				return nil, fmt.Errorf("pod %q is deleted", pod.Name)
+			}
+			if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+				return pod, nil
+			}
+			if err := podError(pod); err != nil {
+				return nil, err
+			}
+		case <-timer:
+			return nil, fmt.Errorf("timed out waiting for pod %q completed", name)
+		}
+	}
+}
+
+// readPodLogs returns the logs of the completed pod.
+func readPodLogs(kubeClient kubeClient, namespace, name string) (string, error) {
+	logs, err := kubeClient.StreamPodLogs(namespace, name)
+	if err != nil {
+		return "", fmt.Errorf("failed to get logs of pod %q: %v", name, err)
+	}
+	defer logs.Close()
+
+	out, err := ioutil.ReadAll(logs)
+	return string(out), err
+}
+
+// showInterfaces prints the interfaces (as JSON) in the network namespace of
+// the target pod, through short-lived pod which is deleted at exit.
+func showInterfaces(kubeClient kubeClient, args *kokotapArgs, timeout time.Duration) error {
+	podargs := kokotapPodArgs{
+		Namespace:      args.Namespace,
+		Container:      args.Container,
+		RuntimeSocket:  args.RuntimeSocket,
+		NetnsDiscovery: args.NetnsDiscovery,
+		Image:          args.Image,
+	}
+	if podargs.NetnsDiscovery == "proc" && podargs.RuntimeSocket != "" {
+		return fmt.Errorf("runtime-socket is not used by proc netns discovery")
+	}
+	pod, err := kubeClient.GetPod(args.Namespace, args.Pod)
+	if err != nil {
+		return fmt.Errorf("%v", err)
+	}
+	interfacesPod, err := podargs.generateInterfacesPod(pod)
+	if err != nil {
+		return err
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sig)
+
+	created, err := kubeClient.CreatePod(interfacesPod)
+	if err != nil {
+		return fmt.Errorf("failed to create pod %q: %v", interfacesPod.GenerateName, err)
+	}
+	defer func() {
+		if err := kubeClient.DeletePod(created.Namespace, created.Name); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to delete pod %q: %v\n", created.Name, err)
+		}
+	}()
+
+	type result struct {
+		pod *v1.Pod
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		pod, err := waitForPodCompleted(kubeClient, created.Namespace, created.Name, timeout)
+		done <- result{pod, err}
+	}()
+	var completed *v1.Pod
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return r.err
+		}
+		completed = r.pod
+	case <-sig:
+		return fmt.Errorf("interrupted while waiting for pod %q", created.Name)
+	}
+
+	logs, err := readPodLogs(kubeClient, created.Namespace, created.Name)
+	if err != nil {
+		return err
+	}
+	if completed.Status.Phase == v1.PodFailed {
+		return fmt.Errorf("pod %q failed: %s", created.Name, logs)
+	}
+	fmt.Print(logs)
+	return nil
+}
@@ -0,0 +1,147 @@
+// Copyright 2018 Red Hat
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGenerateInterfacesPod(t *testing.T) {
+	tests := []struct {
+		name        string
+		podargs     kokotapPodArgs
+		hostNetwork bool
+		socket      string
+		discovery   string
+		wantErr     bool
+	}{
+		{name: "containerd", podargs: kokotapPodArgs{NetnsDiscovery: "cri"},
+			socket: runtimeSockets["containerd"], discovery: "cri"},
+		{name: "proc", podargs: kokotapPodArgs{NetnsDiscovery: "proc"}, discovery: "proc"},
+		{name: "host network", podargs: kokotapPodArgs{NetnsDiscovery: "cri"}, hostNetwork: true, discovery: "host"},
+		{name: "no container", podargs: kokotapPodArgs{Container: "sidecar"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		tt.podargs.Namespace, tt.podargs.Image = "kokotap", "quay.io/s1061123/kokotap:latest"
+		pod := newFakePod("default", "web-0")
+		pod.UID = "1111-2222"
+		pod.Spec.NodeName = "kube-node-1"
+		pod.Spec.HostNetwork = tt.hostNetwork
+		pod.Status.ContainerStatuses = []v1.ContainerStatus{{Name: "web", ContainerID: "containerd://abcd"}}
+
+		interfacesPod, err := tt.podargs.generateInterfacesPod(pod)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if interfacesPod.Namespace != "kokotap" || interfacesPod.Spec.NodeName != "kube-node-1" {
+			t.Errorf("%s: pod is %s/%s on %q", tt.name, interfacesPod.Namespace,
+				interfacesPod.GenerateName, interfacesPod.Spec.NodeName)
+		}
+		if role := interfacesPod.Labels[tapRoleLabel]; role != tapRoleInterfaces {
+			t.Errorf("%s: role is %q", tt.name, role)
+		}
+		if _, ok := interfacesPod.Labels[tapLabel]; ok {
+			t.Errorf("%s: pod has tap label", tt.name)
+		}
+		args := strings.Join(interfacesPod.Spec.Containers[0].Args, " ")
+		for _, want := range []string{"mode interfaces", "--containerid=containerd://abcd",
+			"--pod-uid=1111-2222", "--netns-discovery=" + tt.discovery} {
+			if !strings.Contains(args, want) {
+				t.Errorf("%s: %q is not in args %q", tt.name, want, args)
+			}
+		}
+		hasSocket := strings.Contains(args, "--runtime-socket=")
+		if hasSocket != (tt.socket != "") || (tt.socket != "" && !strings.Contains(args, "--runtime-socket="+tt.socket)) {
+			t.Errorf("%s: args %q, want runtime socket %q", tt.name, args, tt.socket)
+		}
+		if len(interfacesPod.Spec.Volumes) != len(interfacesPod.Spec.Containers[0].VolumeMounts) {
+			t.Errorf("%s: volumes and mounts differ", tt.name)
+		}
+	}
+}
+
+func TestWaitForPodCompleted(t *testing.T) {
+	pod := func(name string, phase v1.PodPhase) *v1.Pod {
+		return newTapPodStatus(name, phase, v1.ContainerStatus{})
+	}
+	tests := []struct {
+		name    string
+		events  []watch.Event
+		phase   v1.PodPhase
+		wantErr bool
+	}{
+		{name: "succeeded", events: []watch.Event{
+			{Type: watch.Added, Object: pod("interfaces", v1.PodPending)},
+			{Type: watch.Added, Object: pod("other", v1.PodFailed)},
+			{Type: watch.Modified, Object: pod("interfaces", v1.PodSucceeded)},
+		}, phase: v1.PodSucceeded},
+		{name: "failed", events: []watch.Event{
+			{Type: watch.Modified, Object: pod("interfaces", v1.PodFailed)},
+		}, phase: v1.PodFailed},
+		{name: "deleted", events: []watch.Event{
+			{Type: watch.Deleted, Object: pod("interfaces", v1.PodRunning)},
+		}, wantErr: true},
+		{name: "image pull error", events: []watch.Event{
+			{Type: watch.Modified, Object: newTapPodStatus("interfaces", v1.PodPending, v1.ContainerStatus{
+				State: v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: "ErrImagePull"}}})},
+		}, wantErr: true},
+		{name: "timeout", events: []watch.Event{
+			{Type: watch.Added, Object: pod("interfaces", v1.PodRunning)},
+		}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		client := &fakeWatchClient{events: tt.events}
+		completed, err := waitForPodCompleted(client, "default", "interfaces", 100*time.Millisecond)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if err == nil && completed.Status.Phase != tt.phase {
+			t.Errorf("%s: phase is %q, want %q", tt.name, completed.Status.Phase, tt.phase)
+		}
+	}
+}
+
+// fakeLogsClient streams the logs.
+type fakeLogsClient struct {
+	fakeKubeClient
+	logs string
+}
+
+func (f *fakeLogsClient) StreamPodLogs(namespace, name string) (io.ReadCloser, error) {
+	return ioutil.NopCloser(strings.NewReader(f.logs)), nil
+}
+
+func TestReadPodLogs(t *testing.T) {
+	logs := `[{"name":"lo","type":"device"}]`
+	out, err := readPodLogs(&fakeLogsClient{logs: logs}, "default", "interfaces")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != logs {
+		t.Errorf("logs are %q, want %q", out, logs)
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2018 Red Hat
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+/*
+ * kokotap: IPsec keys of encrypted tap
+ *
+ * kokotap generates the master key of the tap and puts it in a Secret, which
+ * is mounted by sender/receiver pods. Each sender has own SPI (base SPI of
+ * the tap + sender index), and kokotap_pod derives the key of the SA from the
+ * master key and SPI. The sender on the dest node is not encrypted, as the
+ * tunnel does not leave the node.
+ */
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/yaml"
+	"text/template"
+)
+
+// ipsecKeyLen is the length of the master key (bytes)
+const ipsecKeyLen = 32
+
+// SPI of the senders are in ipsecMinSPI to ipsecMaxSPI (0-255 are reserved)
+const (
+	ipsecMinSPI = 0x100
+	ipsecMaxSPI = 0x7fffffff
+)
+
+// ipsecSPIRange is the number of SPIs reserved for the senders of a tap
+const ipsecSPIRange = 0x10000
+
+// ipsecPort is the default UDP port of the encrypted tunnel. The policy
+// encrypts all packets to the port between the nodes, so the port must not
+// be used by CNI.
+const ipsecPort = 14789
+
+// cniTunnelPorts are UDP ports of CNI overlay (VxLAN of Calico, Cilium and
+// flannel, and Geneve of OVN), which ipsec cannot use.
+var cniTunnelPorts = map[int]bool{
+	4789: true,
+	8472: true,
+	6081: true,
+}
+
+// ipsecKeyDir is the mount path of the secret in sender/receiver pods
+const ipsecKeyDir = "/etc/kokotap/ipsec"
+
+// kokotapSecretTemplate is the secret which has IPsec master key of the tap.
+const kokotapSecretTemplate = `
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: {{.SecretName}}
+  labels:
+    kokotap.redhat-nfvpe.github.io/tap: "{{.TapName}}"
+type: Opaque
+data:
+  key: {{.Key}}
+`
+
+// ipsecSecretName returns the secret name of the tap.
+func ipsecSecretName(tapName string) string {
+	return truncateName(objectName(fmt.Sprintf("kokotap-%s-ipsec", tapName)), 253)
+}
+
+// setIPsecKey generates the master key and base SPI of the tap.
+func (podargs *kokotapPodArgs) setIPsecKey() error {
+	key := make([]byte, ipsecKeyLen+4)
+	if _, err := rand.Read(key); err != nil {
+		return fmt.Errorf("failed to generate ipsec key: %v", err)
+	}
+	podargs.IPsec.Key = key[0:ipsecKeyLen]
+	spi := int(binary.BigEndian.Uint32(key[ipsecKeyLen:]))
+	podargs.IPsec.SPI = ipsecMinSPI + spi%(ipsecMaxSPI-ipsecMinSPI-ipsecSPIRange)
+	return nil
+}
+
+// checkIPsecSelector returns error if the policy cannot select the tunnel
+// packets only, i.e. UDP port of CNI overlay, or GRE without key (the
+// selector matches GRE key instead of ports).
+func (podargs *kokotapPodArgs) checkIPsecSelector() error {
+	switch podargs.Encap {
+	case "vxlan", "geneve":
+		if cniTunnelPorts[podargs.VxlanPort] {
+			return fmt.Errorf("ipsec cannot use UDP port %d, which may be used by CNI, please set other vxlan-port",
+				podargs.VxlanPort)
+		}
+	case "gretap":
+		if podargs.VxlanID == 0 {
+			return fmt.Errorf("ipsec needs non-zero vxlan-id (GRE key) for gretap")
+		}
+	default:
+		return fmt.Errorf("ipsec needs vxlan, gretap or geneve encap")
+	}
+	return nil
+}
+
+// ipsecSPI returns SPI of idx-th sender, or 0 if the sender is not encrypted.
+func (podargs *kokotapPodArgs) ipsecSPI(egressIP string, idx int) int {
+	if podargs.Encrypt != "ipsec" || egressIP == podargs.DestIP {
+		return 0
+	}
+	return podargs.IPsec.SPI + idx
+}
+
+// GenerateSecretYaml generates the secret yaml, or "" if not encrypted.
+func (podargs *kokotapPodArgs) GenerateSecretYaml() (string, error) {
+	if podargs.Encrypt != "ipsec" {
+		return "", nil
+	}
+	secretTemplate, _ := template.New("kokotapSecretTemplate").Parse(kokotapSecretTemplate)
+
+	var yaml bytes.Buffer
+	err := secretTemplate.Execute(&yaml, map[string]interface{}{
+		"SecretName": ipsecSecretName(podargs.TapName()),
+		"TapName":    podargs.TapName(),
+		"Key":        base64.StdEncoding.EncodeToString(podargs.IPsec.Key),
+	})
+	return yaml.String(), err
+}
+
+// createTapSecret creates the secret of the tap, if encrypted. Senders and
+// receivers are in the same namespace (ipsec does not support dest cluster).
+func createTapSecret(kubeClient kubeClient, podargs *kokotapPodArgs) error {
+	secretYaml, err := podargs.GenerateSecretYaml()
+	if err != nil || secretYaml == "" {
+		return err
+	}
+	secret := &v1.Secret{}
+	if err := yaml.Unmarshal([]byte(secretYaml), secret); err != nil {
+		return fmt.Errorf("failed to decode secret yaml: %v", err)
+	}
+
+	secret.Namespace = podargs.Namespace
+	if _, err := kubeClient.CreateSecret(secret); err != nil {
+		return fmt.Errorf("failed to create secret %q: %v", secret.Name, err)
+	}
+	fmt.Printf("secret/%s created\n", secret.Name)
+	return nil
+}
+
+// deleteTapSecret deletes the secret of the tap, if any.
+func deleteTapSecret(kubeClient kubeClient, namespace, tapName string) error {
+	name := ipsecSecretName(tapName)
+	err := kubeClient.DeleteSecret(namespace, name)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete secret %q: %v", name, err)
+	}
+	fmt.Printf("secret %q deleted\n", name)
+	return nil
+}
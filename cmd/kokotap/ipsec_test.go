@@ -0,0 +1,113 @@
+// Copyright 2018 Red Hat
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+	"testing"
+)
+
+func TestCheckIPsecSelector(t *testing.T) {
+	tests := []struct {
+		name    string
+		encap   string
+		port    int
+		id      int
+		wantErr bool
+	}{
+		{name: "vxlan default port", encap: "vxlan", port: ipsecPort, id: 100},
+		{name: "geneve other port", encap: "geneve", port: 16081, id: 100},
+		{name: "vxlan of calico", encap: "vxlan", port: 4789, id: 100, wantErr: true},
+		{name: "vxlan of flannel", encap: "vxlan", port: 8472, id: 100, wantErr: true},
+		{name: "geneve of ovn", encap: "geneve", port: 6081, id: 100, wantErr: true},
+		{name: "gretap key", encap: "gretap", port: ipsecPort, id: 100},
+		{name: "gretap without key", encap: "gretap", port: ipsecPort, id: 0, wantErr: true},
+		{name: "erspan", encap: "erspan", port: ipsecPort, id: 100, wantErr: true},
+		{name: "vlan", encap: "vlan", port: ipsecPort, id: 100, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		podargs := &kokotapPodArgs{Encap: tt.encap, VxlanPort: tt.port, VxlanID: tt.id}
+		if err := podargs.checkIPsecSelector(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		}
+	}
+}
+
+func TestIPsecSPI(t *testing.T) {
+	podargs := &kokotapPodArgs{Encrypt: "ipsec", DestIP: "10.0.0.1"}
+	for i := 0; i < 100; i++ {
+		if err := podargs.setIPsecKey(); err != nil {
+			t.Fatal(err)
+		}
+		if len(podargs.IPsec.Key) != ipsecKeyLen {
+			t.Fatalf("key length = %d", len(podargs.IPsec.Key))
+		}
+		spi := podargs.IPsec.SPI
+		if spi < ipsecMinSPI || spi+ipsecSPIRange > ipsecMaxSPI {
+			t.Fatalf("SPI %#x is out of range", spi)
+		}
+	}
+
+	podargs.IPsec.SPI = 0x1000
+	tests := []struct {
+		name     string
+		encrypt  string
+		egressIP string
+		idx      int
+		want     int
+	}{
+		{name: "first sender", encrypt: "ipsec", egressIP: "10.0.0.2", idx: 0, want: 0x1000},
+		{name: "third sender", encrypt: "ipsec", egressIP: "10.0.0.3", idx: 2, want: 0x1002},
+		{name: "sender on dest node", encrypt: "ipsec", egressIP: "10.0.0.1", idx: 1, want: 0},
+		{name: "not encrypted", encrypt: "none", egressIP: "10.0.0.2", idx: 0, want: 0},
+	}
+	for _, tt := range tests {
+		podargs.Encrypt = tt.encrypt
+		if spi := podargs.ipsecSPI(tt.egressIP, tt.idx); spi != tt.want {
+			t.Errorf("%s: SPI = %#x, want %#x", tt.name, spi, tt.want)
+		}
+	}
+}
+
+func TestGenerateSecretYaml(t *testing.T) {
+	podargs := &kokotapPodArgs{Name: "My_Tap", Encrypt: "ipsec"}
+	if err := podargs.setIPsecKey(); err != nil {
+		t.Fatal(err)
+	}
+	secretYaml, err := podargs.GenerateSecretYaml()
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := &v1.Secret{}
+	if err := yaml.Unmarshal([]byte(secretYaml), secret); err != nil {
+		t.Fatalf("failed to decode secret yaml: %v\n%s", err, secretYaml)
+	}
+	if secret.Name != "kokotap-my-tap-ipsec" {
+		t.Errorf("secret name = %q", secret.Name)
+	}
+	if secret.Labels[tapLabel] != "My_Tap" {
+		t.Errorf("secret labels = %v", secret.Labels)
+	}
+	if !bytes.Equal(secret.Data["key"], podargs.IPsec.Key) {
+		t.Errorf("secret key = %x, want %x", secret.Data["key"], podargs.IPsec.Key)
+	}
+
+	podargs.Encrypt = "none"
+	if secretYaml, err = podargs.GenerateSecretYaml(); err != nil || secretYaml != "" {
+		t.Errorf("secret of not encrypted tap: %q, %v", secretYaml, err)
+	}
+}
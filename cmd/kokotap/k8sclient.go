@@ -17,12 +17,14 @@ package main
 
 import (
 	"fmt"
+	"io"
+	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
-	"os"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 )
 
 // NoK8sNetworkError indicates error, no network in kubernetes
@@ -32,7 +34,23 @@ type NoK8sNetworkError struct {
 
 type kubeClient interface {
 	GetRawWithPath(path string) ([]byte, error)
+	ListRawWithPath(path, labelSelector string) ([]byte, error)
 	GetPod(namespace, name string) (*v1.Pod, error)
+	ListPods(namespace, labelSelector string) (*v1.PodList, error)
+	CreatePod(pod *v1.Pod) (*v1.Pod, error)
+	DeletePod(namespace, name string) error
+	CreateSecret(secret *v1.Secret) (*v1.Secret, error)
+	DeleteSecret(namespace, name string) error
+	WatchPods(namespace, labelSelector string) (watch.Interface, error)
+	ListNodePods(nodeName string) (*v1.PodList, error)
+	WatchNodePods(nodeName string) (watch.Interface, error)
+	StreamPodLogs(namespace, name string) (io.ReadCloser, error)
+	GetDeployment(namespace, name string) (*appsv1.Deployment, error)
+	GetStatefulSet(namespace, name string) (*appsv1.StatefulSet, error)
+	GetDaemonSet(namespace, name string) (*appsv1.DaemonSet, error)
+	ListReplicaSets(namespace, labelSelector string) (*appsv1.ReplicaSetList, error)
+	GetService(namespace, name string) (*v1.Service, error)
+	GetEndpoints(namespace, name string) (*v1.Endpoints, error)
 	UpdatePodStatus(pod *v1.Pod) (*v1.Pod, error)
 	GetNode(name string) (*v1.Node, error)
 	List() (*v1.NodeList, error)
@@ -57,10 +75,74 @@ func (d *defaultKubeClient) GetRawWithPath(path string) ([]byte, error) {
 	return d.client.ExtensionsV1beta1().RESTClient().Get().AbsPath(path).DoRaw()
 }
 
+func (d *defaultKubeClient) ListRawWithPath(path, labelSelector string) ([]byte, error) {
+	return d.client.ExtensionsV1beta1().RESTClient().Get().AbsPath(path).Param("labelSelector", labelSelector).DoRaw()
+}
+
 func (d *defaultKubeClient) GetPod(namespace, name string) (*v1.Pod, error) {
 	return d.client.CoreV1().Pods(namespace).Get(name, metav1.GetOptions{})
 }
 
+func (d *defaultKubeClient) ListPods(namespace, labelSelector string) (*v1.PodList, error) {
+	return d.client.CoreV1().Pods(namespace).List(metav1.ListOptions{LabelSelector: labelSelector})
+}
+
+func (d *defaultKubeClient) CreatePod(pod *v1.Pod) (*v1.Pod, error) {
+	return d.client.CoreV1().Pods(pod.Namespace).Create(pod)
+}
+
+func (d *defaultKubeClient) DeletePod(namespace, name string) error {
+	return d.client.CoreV1().Pods(namespace).Delete(name, &metav1.DeleteOptions{})
+}
+
+func (d *defaultKubeClient) CreateSecret(secret *v1.Secret) (*v1.Secret, error) {
+	return d.client.CoreV1().Secrets(secret.Namespace).Create(secret)
+}
+
+func (d *defaultKubeClient) DeleteSecret(namespace, name string) error {
+	return d.client.CoreV1().Secrets(namespace).Delete(name, &metav1.DeleteOptions{})
+}
+
+func (d *defaultKubeClient) WatchPods(namespace, labelSelector string) (watch.Interface, error) {
+	return d.client.CoreV1().Pods(namespace).Watch(metav1.ListOptions{LabelSelector: labelSelector})
+}
+
+func (d *defaultKubeClient) ListNodePods(nodeName string) (*v1.PodList, error) {
+	return d.client.CoreV1().Pods("").List(metav1.ListOptions{FieldSelector: "spec.nodeName=" + nodeName})
+}
+
+func (d *defaultKubeClient) WatchNodePods(nodeName string) (watch.Interface, error) {
+	return d.client.CoreV1().Pods("").Watch(metav1.ListOptions{FieldSelector: "spec.nodeName=" + nodeName})
+}
+
+func (d *defaultKubeClient) StreamPodLogs(namespace, name string) (io.ReadCloser, error) {
+	return d.client.CoreV1().Pods(namespace).GetLogs(name, &v1.PodLogOptions{Follow: true}).Stream()
+}
+
+func (d *defaultKubeClient) GetDeployment(namespace, name string) (*appsv1.Deployment, error) {
+	return d.client.AppsV1().Deployments(namespace).Get(name, metav1.GetOptions{})
+}
+
+func (d *defaultKubeClient) GetStatefulSet(namespace, name string) (*appsv1.StatefulSet, error) {
+	return d.client.AppsV1().StatefulSets(namespace).Get(name, metav1.GetOptions{})
+}
+
+func (d *defaultKubeClient) GetDaemonSet(namespace, name string) (*appsv1.DaemonSet, error) {
+	return d.client.AppsV1().DaemonSets(namespace).Get(name, metav1.GetOptions{})
+}
+
+func (d *defaultKubeClient) ListReplicaSets(namespace, labelSelector string) (*appsv1.ReplicaSetList, error) {
+	return d.client.AppsV1().ReplicaSets(namespace).List(metav1.ListOptions{LabelSelector: labelSelector})
+}
+
+func (d *defaultKubeClient) GetService(namespace, name string) (*v1.Service, error) {
+	return d.client.CoreV1().Services(namespace).Get(name, metav1.GetOptions{})
+}
+
+func (d *defaultKubeClient) GetEndpoints(namespace, name string) (*v1.Endpoints, error) {
+	return d.client.CoreV1().Endpoints(namespace).Get(name, metav1.GetOptions{})
+}
+
 func (d *defaultKubeClient) UpdatePodStatus(pod *v1.Pod) (*v1.Pod, error) {
 	return d.client.CoreV1().Pods(pod.Namespace).UpdateStatus(pod)
 }
@@ -73,32 +155,36 @@ func (d *defaultKubeClient) List() (*v1.NodeList, error) {
 	return d.client.CoreV1().Nodes().List(metav1.ListOptions{})
 }
 
-func getK8sClient(kubeconfig string, kubeClient kubeClient) (kubeClient, error) {
+// newClientConfig returns the client config loaded as kubectl does: the
+// kubeconfig file if given, otherwise KUBECONFIG (merged list of files) or
+// ~/.kube/config, then in-cluster config if none of them is found. Context,
+// cluster and user override the ones of current context.
+func newClientConfig(kubeconfig, context, cluster, user string) clientcmd.ClientConfig {
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = kubeconfig
+	overrides := &clientcmd.ConfigOverrides{
+		CurrentContext: context,
+		Context: clientcmdapi.Context{
+			Cluster:  cluster,
+			AuthInfo: user,
+		},
+	}
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, overrides)
+}
+
+func getK8sClient(clientConfig clientcmd.ClientConfig, kubeClient kubeClient) (kubeClient, error) {
 	// If we get a valid kubeClient (eg from testcases) just return that
 	// one.
 	if kubeClient != nil {
 		return kubeClient, nil
 	}
 
-	var err error
-	var config *rest.Config
-
-	// Otherwise try to create a kubeClient from a given kubeConfig
-	if kubeconfig != "" {
-		// uses the current context in kubeconfig
-		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
-		if err != nil {
-			return nil, fmt.Errorf("GetK8sClient: failed to get context for the kubeconfig %v, refer Multus README.md for the usage guide: %v", kubeconfig, err)
-		}
-	} else if os.Getenv("KUBERNETES_SERVICE_HOST") != "" && os.Getenv("KUBERNETES_SERVICE_PORT") != "" {
-		// Try in-cluster config where multus might be running in a kubernetes pod
-		config, err = rest.InClusterConfig()
-		if err != nil {
-			return nil, fmt.Errorf("createK8sClient: failed to get context for in-cluster kube config, refer Multus README.md for the usage guide: %v", err)
-		}
-	} else {
-		// No kubernetes config; assume we shouldn't talk to Kube at all
-		return nil, nil
+	config, err := clientConfig.ClientConfig()
+	if clientcmd.IsEmptyConfig(err) {
+		return nil, fmt.Errorf("no kubeconfig is found, please set kubeconfig (or KUBECONFIG), or run kokotap in cluster")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubeconfig: %v", err)
 	}
 
 	// creates the clientset
@@ -122,6 +208,17 @@ func getHostIP(nodeaddr *[]v1.NodeAddress) (hostname, hostip string) {
 	return
 }
 
+// getNodeAddress returns the address of the type, or "" if the node has no
+// address of the type.
+func getNodeAddress(nodeaddr *[]v1.NodeAddress, addrType v1.NodeAddressType) string {
+	for _, val := range *nodeaddr {
+		if val.Type == addrType {
+			return val.Address
+		}
+	}
+	return ""
+}
+
 /*
 var kubeconfig = flag.String("kubeconfig", "/etc/kubeconfig", "help message for s option")
 func main() {
@@ -18,80 +18,325 @@ package main
  */
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"gopkg.in/alecthomas/kingpin.v2"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/clientcmd"
 	"net"
 	"os"
 	"path/filepath"
+	"sigs.k8s.io/yaml"
 	"strconv"
 	"strings"
 	"text/template"
+	"time"
 )
 
 var version = "master@git"
 var commit = "unknown commit"
 var date = "unknown date"
 
+// erspanMaxSessionID is the max ERSPAN session ID (10 bits)
+const erspanMaxSessionID = 0x3ff
+
+// vlanMaxID is the max VLAN ID (0 and 4095 are reserved)
+const vlanMaxID = 4094
+
 type kokotapArgs struct {
-	Pod        string
-	Namespace  string // optional
-	Container  string // optional
-	PodIFName  string // optional
-	IFName     string // optional (ifname for tapping if)
-	DestNode   string
-	DestIP     net.IP
-	MirrorType string
-	VxlanID    int
-	VxlanPort  int    // UDP port, optional
-	KubeConfig string // optional
-	Image      string // optional
+	Pod            string
+	Selector       string   // optional (label selector for tap target pods)
+	Deployment     string   // optional
+	StatefulSet    string   // optional
+	DaemonSet      string   // optional
+	Service        string   // optional (target, or peers of other target)
+	PeerPods       []string // optional (peers of target)
+	AllPodsOnNode  string   // optional (all pods on the node)
+	NamespaceWide  bool     // optional (all pods in the namespace)
+	Node           string   // optional (node to tap its interface)
+	NodeIFName     string   // optional (node interface to tap, with Node)
+	VMI            string   // optional (KubeVirt VMI to tap its interface)
+	VMIIFName      string   // optional (VMI interface to tap, with VMI)
+	TapName        string   // optional
+	Namespace      string   // optional
+	Container      string   // optional (target container name in the pod)
+	PodIFName      string   // optional (comma-separated, or 'all')
+	Network        string   // optional (Multus network of pod interface, instead of PodIFName)
+	IFName         string   // optional (ifname for tapping if)
+	DestNode       string
+	DestIP         net.IP
+	DestPod        string // optional (analysis pod on the node of target, for veth)
+	MirrorType     string
+	VxlanID        int
+	VxlanIDSet     bool   // vxlan-id is given (not needed by vlan/macvlan)
+	VxlanPort      int    // UDP port, optional
+	Encap          string // vxlan, gretap, erspan, geneve, vlan, macvlan or veth
+	VlanID         int    // optional (VLAN ID for vlan, instead of VxlanID)
+	ParentIF       string // optional (physical interface at node for vlan/macvlan)
+	ErspanVersion  int    // optional (1: type II, 2: type III)
+	ErspanDir      string // optional (ERSPAN type III direction, default: by mirror type)
+	Pcap           string // optional (pcapng file in receiver, for geneve)
+	KubeConfig     string // optional
+	Context        string // optional (kubeconfig context)
+	Cluster        string // optional (kubeconfig cluster)
+	User           string // optional (kubeconfig user)
+	DestKubeConfig string // optional (kubeconfig of dest cluster)
+	DestContext    string // optional (kubeconfig context of dest cluster)
+	DestNamespace  string // optional (namespace of receiver in dest cluster)
+	Image          string // optional
+	Follow         bool   // optional (follow target pods of selector/workload)
+	RuntimeSocket  string // optional (container runtime socket)
+	NetnsDiscovery string // optional (runtime or proc)
+	Encrypt        string // optional (none or ipsec)
+}
+
+// runtimeSockets are default runtime sockets for container ID prefixes
+var runtimeSockets = map[string]string{
+	"docker":     "/var/run/docker.sock",
+	"cri-o":      "/var/run/crio/crio.sock",
+	"containerd": "/run/containerd/containerd.sock",
+}
+
+// kokotapSenderArgs is the sender for one tap target pod.
+type kokotapSenderArgs struct {
+	PodName       string // tap target pod name (namespace/name if not in tap namespace)
+	Node          string
+	ContainerID   string
+	PodUID        string
+	MirrorIF      string   // tap target interface of the pod
+	RuntimeSocket string   // container runtime socket at the node
+	HostNetns     bool     // tap the node interface (node or hostNetwork pod)
+	Filters       []string // protocol:ip:port to mirror (hostNetwork pod)
+	VxlanEgressIP string   // Egress IF's IP
+	VxlanIP       string   // Dest Vxlan IP
+	VxlanID       int
+	IFName        string // receiver interface name for this sender
+	IPsecSPI      int    // SPI of IPsec SA to the receiver (0: not encrypted)
 }
 
 type kokotapPodArgs struct {
-	ContainerRuntime string
-	PodName          string
-	VxlanID          int
-	VxlanPort        int // UDP port, optional
-	IFName           string
-	Sender           struct {
-		Node          string
-		ContainerID   string
-		MirrorType    string
-		MirrorIF      string
-		VxlanEgressIP string // Egress IF's IP
-		VxlanIP       string // Dest Vxlan IP
+	RuntimeSocket  string // container runtime socket (optional)
+	NetnsDiscovery string // runtime or proc
+	Name           string // tap name
+	Namespace      string
+	Selector       string
+	Workload       string // kind/name of tap target workload
+	Container      string // target container name (optional)
+	AnyContainer   bool   // any container of the pod if Container is not set (node/namespace-wide)
+	VxlanID        int
+	VxlanPort      int    // UDP port, optional
+	Encap          string // vxlan, gretap, erspan, geneve, vlan, macvlan or veth (VxlanID is GRE key, ERSPAN session ID, VNI or VLAN ID)
+	ParentIF       string // physical interface at node (vlan/macvlan)
+	ErspanVersion  int    // 1 (type II) or 2 (type III)
+	ErspanDir      string // ERSPAN type III direction (optional)
+	Pcap           string // pcapng file in receiver (geneve, optional)
+	Encrypt        string // none or ipsec
+	IPsec          struct {
+		Key []byte // master key, in the secret
+		SPI int    // SPI of first sender
+	}
+	IFName       string
+	MirrorType   string
+	MirrorIF     string
+	PodMirrorIFs map[string]string // MirrorIF of the pod (by podKey) instead of MirrorIF (e.g. VMI tap)
+	Network      string            // Multus network to find MirrorIF (optional)
+	DestIP       string            // Dest Vxlan IP
+	DestPod      struct {
+		Name        string // analysis pod for veth (optional, default: host)
+		ContainerID string
+		UID         string
 	}
-	Receiver struct {
+	Senders           []kokotapSenderArgs
+	IndexIFName       bool // suffix receiver interface name by sender index
+	ReceiverPerSender bool // receiver pod for each sender (follow mode)
+	Receiver          struct {
 		Node          string
 		VxlanEgressIP string // Egress IF's IP
-		VxlanIP       string // Dest Vxlan IP
+		Namespace     string // namespace of receiver pods (in dest cluster)
+		Context       string // kubeconfig context of dest cluster (if other cluster)
 	}
 	Image string
 }
 
-func (podargs *kokotapPodArgs) GeneratePodName() (string, string) {
-	nodeName := strings.Replace(podargs.Receiver.Node, ".", "-", -1)
-	sender := fmt.Sprintf("kokotap-%s-sender", podargs.PodName)
-	receiver := fmt.Sprintf("kokotap-%s-receiver-%s", podargs.PodName, nodeName)
+// truncateName shortens name to fit in maxLen and drops trailing characters
+// which are not allowed at the end of kubernetes names and label values.
+func truncateName(name string, maxLen int) string {
+	if len(name) > maxLen {
+		name = name[0:maxLen]
+	}
+	return strings.TrimRight(name, "-_.")
+}
 
-	if len(sender) > 62 {
-		sender = sender[0:61]
+// uniqueName returns name with suffix, in maxLen. If it is too long, name is
+// truncated and the hash of key is added, so that the names which differ only
+// in the truncated part are still unique.
+func uniqueName(name, suffix, key string, maxLen int) string {
+	if len(name)+len(suffix) <= maxLen {
+		return name + suffix
 	}
-	if len(receiver) > 62 {
-		receiver = receiver[0:61]
+	sum := sha256.Sum256([]byte(key))
+	hash := hex.EncodeToString(sum[:])[0:8]
+	return truncateName(name, maxLen-len(hash)-len(suffix)-1) + "-" + hash + suffix
+}
+
+// sanitizeName replaces the characters which are not allowed in label values.
+func sanitizeName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9',
+			r == '-', r == '_', r == '.':
+			return r
+		}
+		return '-'
+	}, name)
+	return strings.TrimLeft(name, "-_.")
+}
+
+// objectName returns the name for kubernetes object names (DNS subdomain),
+// which do not allow uppercase letters and '_' unlike label values.
+func objectName(name string) string {
+	return strings.ToLower(strings.Replace(sanitizeName(name), "_", "-", -1))
+}
+
+// TapName returns the name that identifies the tap, used as label value.
+func (podargs *kokotapPodArgs) TapName() string {
+	return truncateName(sanitizeName(podargs.Name), 63)
+}
+
+// GenerateSenderPodName returns the sender pod name. The tap name is added
+// unless it is the target pod name, so that the senders of several taps for
+// the pod do not collide. The long name is made unique by uniqueName, as the
+// pods of a workload differ only at the end of their names.
+func (podargs *kokotapPodArgs) GenerateSenderPodName(sender *kokotapSenderArgs) string {
+	podName := objectName(sender.PodName)
+	if sender.PodName == "" {
+		podName = "host-" + strings.Replace(sender.Node, ".", "-", -1)
+	}
+	tapName := objectName(podargs.TapName())
+	key := podargs.TapName() + "/" + podName
+	if tapName == podName {
+		return uniqueName("kokotap-"+podName, "-sender", key, 61)
+	}
+	return uniqueName(fmt.Sprintf("kokotap-%s-%s", truncateName(tapName, 20), podName),
+		"-sender", key, 61)
+}
+
+// podKey returns the name of the target pod to identify its sender, with its
+// namespace if it is not in the tap namespace (e.g. all pods on node).
+func (podargs *kokotapPodArgs) podKey(pod *v1.Pod) string {
+	if pod.Namespace == "" || pod.Namespace == podargs.Namespace {
+		return pod.Name
 	}
-	return sender, receiver
+	return pod.Namespace + "/" + pod.Name
 }
 
-func (podargs *kokotapPodArgs) GenerateDockerYaml() string {
-	senderPod, receiverPod := podargs.GeneratePodName()
+// senderTarget returns the target of the sender as namespace/pod (or node
+// name for the node interface), which is sent in Geneve options.
+func (podargs *kokotapPodArgs) senderTarget(sender *kokotapSenderArgs) string {
+	if sender.PodName == "" {
+		return sender.Node
+	}
+	if strings.Contains(sender.PodName, "/") {
+		return sender.PodName
+	}
+	return podargs.Namespace + "/" + sender.PodName
+}
+
+// GenerateReceiverPodName returns the receiver pod name. If sender is given,
+// the name is for the receiver of the sender (ReceiverPerSender), which is
+// unique by the receiver interface even if the name is truncated.
+func (podargs *kokotapPodArgs) GenerateReceiverPodName(sender *kokotapSenderArgs) string {
+	nodeName := strings.Replace(podargs.Receiver.Node, ".", "-", -1)
+	name := fmt.Sprintf("kokotap-%s-receiver-%s", podargs.TapName(), nodeName)
+	if sender != nil {
+		name = fmt.Sprintf("kokotap-%s-receiver-%s-%s", podargs.TapName(), sender.IFName, nodeName)
+	}
+	return uniqueName(objectName(name), "", name, 61)
+}
 
-	kokoTapPodDockerSenderTemplate, _ := template.New("kokotapPodDockerSenderTemplate").Parse(`
+// kokotapPodMetadataTemplate is the metadata of kokotap sender/receiver pods.
+// The labels/annotations are used to find the taps in the cluster.
+const kokotapPodMetadataTemplate = `metadata:
+  name: {{.PodName}}
+  labels:
+    kokotap.redhat-nfvpe.github.io/tap: "{{.TapName}}"
+    kokotap.redhat-nfvpe.github.io/role: {{.Role}}
+  annotations:
+    kokotap.redhat-nfvpe.github.io/target-pod: "{{.TargetPod}}"
+    kokotap.redhat-nfvpe.github.io/target-namespace: "{{.TargetNamespace}}"
+    kokotap.redhat-nfvpe.github.io/target-selector: "{{.TargetSelector}}"
+    kokotap.redhat-nfvpe.github.io/target-workload: "{{.TargetWorkload}}"
+    kokotap.redhat-nfvpe.github.io/target-ifname: "{{.TargetIFName}}"
+    kokotap.redhat-nfvpe.github.io/target-network: "{{.TargetNetwork}}"
+    kokotap.redhat-nfvpe.github.io/ifname: "{{.TapIFName}}"
+    kokotap.redhat-nfvpe.github.io/mirrortype: "{{.TapMirrorType}}"
+    kokotap.redhat-nfvpe.github.io/vxlan-id: "{{.TapVXLANID}}"
+    kokotap.redhat-nfvpe.github.io/vxlan-port: "{{.VXLANPort}}"
+    kokotap.redhat-nfvpe.github.io/encap: "{{.Encap}}"
+    kokotap.redhat-nfvpe.github.io/parent-if: "{{.ParentIF}}"
+    kokotap.redhat-nfvpe.github.io/encrypt: "{{.Encrypt}}"
+    kokotap.redhat-nfvpe.github.io/sender-ip: "{{.SenderIP}}"
+    kokotap.redhat-nfvpe.github.io/dest-node: "{{.DestNode}}"
+    kokotap.redhat-nfvpe.github.io/dest-ip: "{{.DestIP}}"
+    kokotap.redhat-nfvpe.github.io/dest-pod: "{{.DestPod}}"
+    kokotap.redhat-nfvpe.github.io/dest-context: "{{.DestContext}}"`
+
+// metadataMap returns template values for kokotapPodMetadataTemplate. Target
+// pods, receiver interfaces and VxLAN IDs are the ones of given senders.
+func (podargs *kokotapPodArgs) metadataMap(podName, role string, senders []kokotapSenderArgs) map[string]interface{} {
+	targetPods := []string{}
+	targetIFNames := []string{}
+	seenIFNames := map[string]bool{}
+	ifNames := []string{}
+	vxlanIDs := []string{}
+	senderIPs := []string{}
+	for _, sender := range senders {
+		targetPods = append(targetPods, sender.PodName)
+		ifNames = append(ifNames, sender.IFName)
+		vxlanIDs = append(vxlanIDs, strconv.Itoa(sender.VxlanID))
+		senderIPs = append(senderIPs, sender.VxlanEgressIP)
+		if !seenIFNames[sender.MirrorIF] {
+			seenIFNames[sender.MirrorIF] = true
+			targetIFNames = append(targetIFNames, sender.MirrorIF)
+		}
+	}
+
+	return map[string]interface{}{
+		"PodName":         podName,
+		"TapName":         podargs.TapName(),
+		"Role":            role,
+		"TargetPod":       strings.Join(targetPods, ","),
+		"TargetNamespace": podargs.Namespace,
+		"TargetSelector":  podargs.Selector,
+		"TargetWorkload":  podargs.Workload,
+		"TargetIFName":    strings.Join(targetIFNames, ","),
+		"TargetNetwork":   podargs.Network,
+		"TapIFName":       strings.Join(ifNames, ","),
+		"TapMirrorType":   podargs.MirrorType,
+		"TapVXLANID":      strings.Join(vxlanIDs, ","),
+		"VXLANPort":       strconv.Itoa(podargs.VxlanPort),
+		"Encap":           podargs.Encap,
+		"ParentIF":        podargs.ParentIF,
+		"Encrypt":         podargs.Encrypt,
+		"ErspanVersion":   strconv.Itoa(podargs.ErspanVersion),
+		"ErspanDir":       podargs.ErspanDir,
+		"SenderIP":        strings.Join(senderIPs, ","),
+		"DestNode":        podargs.Receiver.Node,
+		"DestIP":          podargs.DestIP,
+		"DestPod":         podargs.DestPod.Name,
+		"DestContext":     podargs.Receiver.Context,
+	}
+}
+
+// kokotapPodSenderTemplate is the sender pod, which finds the target
+// container through the container runtime socket, or from /proc (by pod UID)
+// if no socket is given.
+const kokotapPodSenderTemplate = `
 ---
 apiVersion: v1
 kind: Pod
-metadata:
-  name: {{.PodName}}
+` + kokotapPodMetadataTemplate + `
 spec:
   hostNetwork: true
   nodeName: {{.NodeName}}
@@ -101,31 +346,78 @@ spec:
       imagePullPolicy: Always
       command: ["/bin/kokotap_pod"]
       args: ["--procprefix=/host", "mode", "sender", "--containerid={{.ContainerID}}",
+             "--pod-uid={{.PodUID}}", "--netns-discovery={{.NetnsDiscovery}}",
+{{- range .Filters}}
+             "--filter={{.}}",
+{{- end}}
+{{- if .RuntimeSocket}}
+             "--runtime-socket={{.RuntimeSocket}}",
+{{- end}}
              "--mirrortype={{.MirrorType}}", "--mirrorif={{.MirrorIF}}", "--ifname={{.IFName}}",
-             "--vxlan-egressip={{.EgressIP}}", "--vxlan-ip={{.VXLANIP}}", "--vxlan-id={{.VXLANID}}",
-             "--vxlan-port={{.VXLANPort}}"]
+             "--vxlan-egressip={{.EgressIP}}", "--vxlan-id={{.VXLANID}}",
+{{- if .VXLANIP}}
+             "--vxlan-ip={{.VXLANIP}}",
+{{- end}}
+{{- if .ParentIF}}
+             "--parent-if={{.ParentIF}}",
+{{- end}}
+{{- if eq .Encap "erspan"}}
+             "--erspan-version={{.ErspanVersion}}",
+{{- if .ErspanDir}}
+             "--erspan-dir={{.ErspanDir}}",
+{{- end}}
+{{- end}}
+{{- if eq .Encap "geneve"}}
+             "--target={{.Target}}",
+{{- end}}
+{{- if eq .Encap "veth"}}
+             "--dest-ifname={{.DestIFName}}",
+{{- if .DestContainerID}}
+             "--dest-containerid={{.DestContainerID}}", "--dest-pod-uid={{.DestPodUID}}",
+{{- end}}
+{{- end}}
+{{- if .IPsecSPI}}
+             "--ipsec-key={{.IPsecKeyDir}}/key", "--ipsec-spi={{.IPsecSPI}}",
+{{- end}}
+             "--vxlan-port={{.VXLANPort}}", "--encap={{.Encap}}"]
       securityContext:
         privileged: true
       volumeMounts:
-      - name: var-docker
-        mountPath: /var/run/docker.sock
+{{- if .RuntimeSocket}}
+      - name: runtime-socket
+        mountPath: {{.RuntimeSocket}}
+{{- end}}
+{{- if .IPsecSPI}}
+      - name: ipsec
+        mountPath: {{.IPsecKeyDir}}
+        readOnly: true
+{{- end}}
       - name: proc
         mountPath: /host/proc
   volumes:
-    - name: var-docker
+{{- if .RuntimeSocket}}
+    - name: runtime-socket
       hostPath:
-        path: /var/run/docker.sock
+        path: {{.RuntimeSocket}}
+{{- end}}
+{{- if .IPsecSPI}}
+    - name: ipsec
+      secret:
+        secretName: {{.IPsecSecret}}
+{{- end}}
     - name: proc
       hostPath:
         path: /proc
-`)
+`
 
-	kokoTapPodDockerReceiverTemplate, _ := template.New("kokotapPodDockerReceiverTemplate").Parse(`
+// kokotapPodReceiverTemplate is the receiver pod, which has vxlan interface
+// (or VLAN interface on parent-if) for each sender, and IPsec SA of each
+// sender if encrypted.
+const kokotapPodReceiverTemplate = `
 ---
 apiVersion: v1
 kind: Pod
-metadata:
-  name: {{.PodName}}
+` + kokotapPodMetadataTemplate + `
 spec:
   hostNetwork: true
   nodeName: {{.NodeName}}
@@ -134,264 +426,878 @@ spec:
       image: {{.ContainerImage}}
       imagePullPolicy: Always
       command: ["/bin/kokotap_pod"]
-      args: ["--procprefix=/host", "mode", "receiver",
-             "--ifname={{.IFName}}", "--vxlan-egressip={{.EgressIP}}",
-             "--vxlan-ip={{.VXLANIP}}", "--vxlan-id={{.VXLANID}}",
-             "--vxlan-port={{.VXLANPort}}"]
+      args: ["--procprefix=/host", "mode", "receiver", "--vxlan-egressip={{.EgressIP}}",
+{{- range .Senders}}
+             "--ifname={{.IFName}}", "--vxlan-ip={{.VxlanEgressIP}}", "--vxlan-id={{.VxlanID}}",
+{{- if $.IPsecSecret}}
+             "--ipsec-spi={{.IPsecSPI}}",
+{{- end}}
+{{- end}}
+{{- if .IPsecSecret}}
+             "--ipsec-key={{.IPsecKeyDir}}/key",
+{{- end}}
+{{- if eq .Encap "erspan"}}
+             "--erspan-version={{.ErspanVersion}}",
+{{- end}}
+{{- if .Pcap}}
+             "--pcap={{.Pcap}}",
+{{- end}}
+{{- if .ParentIF}}
+             "--parent-if={{.ParentIF}}",
+{{- end}}
+             "--vxlan-port={{.VXLANPort}}", "--encap={{.Encap}}"]
       securityContext:
         privileged: true
-`)
-
-	senderMap := map[string]string {
-		"PodName": senderPod,
-		"NodeName": podargs.Sender.Node,
-		"ContainerImage": podargs.Image,
-		"ContainerID": podargs.Sender.ContainerID,
-		"MirrorType": podargs.Sender.MirrorType,
-		"MirrorIF": podargs.Sender.MirrorIF,
-		"IFName": podargs.IFName,
-		"EgressIP": podargs.Sender.VxlanEgressIP,
-		"VXLANIP": podargs.Sender.VxlanIP,
-		"VXLANID": strconv.Itoa(podargs.VxlanID),
-		"VXLANPort": strconv.Itoa(podargs.VxlanPort),
-	}
+{{- if .IPsecSecret}}
+      volumeMounts:
+      - name: ipsec
+        mountPath: {{.IPsecKeyDir}}
+        readOnly: true
+  volumes:
+    - name: ipsec
+      secret:
+        secretName: {{.IPsecSecret}}
+{{- end}}
+`
 
+// GenerateYaml generates sender pod yaml for each sender and receiver pod
+// yaml (after the secret yaml, if encrypted). The pods are container runtime
+// neutral: sender finds the target container through the runtime socket
+// given for each sender, or from /proc.
+func (podargs *kokotapPodArgs) GenerateYaml() (string, error) {
+	senderTemplate, _ := template.New("kokotapPodSenderTemplate").Parse(kokotapPodSenderTemplate)
+	receiverTemplate, _ := template.New("kokotapPodReceiverTemplate").Parse(kokotapPodReceiverTemplate)
+
+	secretYaml, err := podargs.GenerateSecretYaml()
+	if err != nil {
+		return "", err
+	}
 	var yaml bytes.Buffer
-	if err := kokoTapPodDockerSenderTemplate.Execute(&yaml, senderMap); err != nil {
-		panic(err)
+	yaml.WriteString(secretYaml)
+	ipsecSecret := ""
+	if secretYaml != "" {
+		ipsecSecret = ipsecSecretName(podargs.TapName())
+	}
+	for i := range podargs.Senders {
+		sender := &podargs.Senders[i]
+		senderMap := podargs.metadataMap(podargs.GenerateSenderPodName(sender),
+			tapRoleSender, podargs.Senders[i:i+1])
+		senderMap["NodeName"] = sender.Node
+		senderMap["ContainerImage"] = podargs.Image
+		senderMap["ContainerID"] = sender.ContainerID
+		senderMap["PodUID"] = sender.PodUID
+		senderMap["NetnsDiscovery"] = podargs.NetnsDiscovery
+		if sender.HostNetns {
+			senderMap["NetnsDiscovery"] = "host"
+		}
+		senderMap["Filters"] = sender.Filters
+		senderMap["RuntimeSocket"] = sender.RuntimeSocket
+		senderMap["MirrorType"] = podargs.MirrorType
+		senderMap["MirrorIF"] = sender.MirrorIF
+		senderMap["IFName"] = podargs.IFName
+		senderMap["EgressIP"] = sender.VxlanEgressIP
+		senderMap["VXLANIP"] = sender.VxlanIP
+		senderMap["VXLANID"] = strconv.Itoa(sender.VxlanID)
+		senderMap["Target"] = podargs.senderTarget(sender)
+		senderMap["DestIFName"] = sender.IFName
+		senderMap["DestContainerID"] = podargs.DestPod.ContainerID
+		senderMap["DestPodUID"] = podargs.DestPod.UID
+		senderMap["IPsecSPI"] = sender.IPsecSPI
+		senderMap["IPsecSecret"] = ipsecSecret
+		senderMap["IPsecKeyDir"] = ipsecKeyDir
+
+		if err := senderTemplate.Execute(&yaml, senderMap); err != nil {
+			return "", err
+		}
 	}
 
+	// veth delivers to the node (or the analysis pod) by sender
+	if podargs.Receiver.Node == "" || podargs.Encap == "veth" {
+		return yaml.String(), nil
+	}
 
-	if podargs.Receiver.Node != "" {
-		receiverMap := map[string]string {
-			"PodName": receiverPod,
-			"NodeName": podargs.Receiver.Node,
-			"ContainerImage": podargs.Image,
-			"IFName": podargs.IFName,
-			"EgressIP": podargs.Receiver.VxlanEgressIP,
-			"VXLANIP": podargs.Receiver.VxlanIP,
-			"VXLANID": strconv.Itoa(podargs.VxlanID),
-			"VXLANPort": strconv.Itoa(podargs.VxlanPort),
+	receivers := [][]kokotapSenderArgs{podargs.Senders}
+	if podargs.ReceiverPerSender {
+		receivers = [][]kokotapSenderArgs{}
+		for i := range podargs.Senders {
+			receivers = append(receivers, podargs.Senders[i:i+1])
 		}
+	}
+	for _, senders := range receivers {
+		receiverPod := podargs.GenerateReceiverPodName(nil)
+		if podargs.ReceiverPerSender {
+			receiverPod = podargs.GenerateReceiverPodName(&senders[0])
+		}
+		receiverMap := podargs.metadataMap(receiverPod, tapRoleReceiver, senders)
+		receiverMap["NodeName"] = podargs.Receiver.Node
+		receiverMap["ContainerImage"] = podargs.Image
+		receiverMap["EgressIP"] = podargs.Receiver.VxlanEgressIP
+		receiverMap["Senders"] = senders
+		receiverMap["Pcap"] = podargs.Pcap
+		receiverMap["IPsecSecret"] = ipsecSecret
+		receiverMap["IPsecKeyDir"] = ipsecKeyDir
 
-		if err := kokoTapPodDockerReceiverTemplate.Execute(&yaml, receiverMap); err != nil {
-			panic(err)
+		if err := receiverTemplate.Execute(&yaml, receiverMap); err != nil {
+			return "", err
 		}
 	}
 
-	return yaml.String()
+	return yaml.String(), nil
 }
 
-func (podargs *kokotapPodArgs) GenerateCrioYaml() string {
-	senderPod, receiverPod := podargs.GeneratePodName()
-	kokoTapPodCrioSenderTemplate, _ := template.New("kokotapPodCrioSenderTemplate").Parse(`
----
-apiVersion: v1
-kind: Pod
-metadata:
-  name: {{.PodName}}
-spec:
-  hostNetwork: true
-  nodeName: {{.NodeName}}
-  containers:
-    - name: {{.PodName}}
-      image: {{.ContainerImage}}
-      imagePullPolicy: Always
-      command: ["/bin/kokotap_pod"]
-      args: ["--procprefix=/host", "mode", "sender", "--containerid={{.ContainerID}}",
-             "--mirrortype={{.MirrorType}}", "--mirrorif={{.MirrorIF}}", "--ifname={{.IFName}}",
-             "--vxlan-egressip={{.EgressIP}}", "--vxlan-ip={{.VXLANIP}}", "--vxlan-id={{.VXLANID}}",
-             "--vxlan-port={{.VXLANPort}}"]
-      securityContext:
-        privileged: true
-      volumeMounts:
-      - name: var-crio
-        mountPath: /var/run/crio/crio.sock
-      - name: proc
-        mountPath: /host/proc
-  volumes:
-    - name: var-crio
-      hostPath:
-        path: /var/run/crio/crio.sock
-    - name: proc
-      hostPath:
-        path: /proc
-`)
+// GeneratePods generates the sender/receiver pods from the pod yaml. The
+// secret is created by createTapSecret.
+func (podargs *kokotapPodArgs) GeneratePods() ([]*v1.Pod, error) {
+	podYaml, err := podargs.GenerateYaml()
+	if err != nil {
+		return nil, err
+	}
 
-	kokoTapPodCrioReceiverTemplate, _ := template.New("kokotapPodCrioReceiverTemplate").Parse(`
----
-apiVersion: v1
-kind: Pod
-metadata:
-  name: {{.PodName}}
-spec:
-  hostNetwork: true
-  nodeName: {{.NodeName}}
-  containers:
-    - name: {{.PodName}}
-      imagePullPolicy: Always
-      image: {{.ContainerImage}}
-      command: ["/bin/kokotap_pod"]
-      args: ["--procprefix=/host", "mode", "receiver",
-             "--ifname={{.IFName}}", "--vxlan-egressip={{.EgressIP}}",
-             "--vxlan-ip={{.VXLANIP}}", "--vxlan-id={{.VXLANID}}",
-             "--vxlan-port={{.VXLANPort}}"]
-      securityContext:
-        privileged: true
-`)
-
-	senderMap := map[string]string {
-		"PodName": senderPod,
-		"NodeName": podargs.Sender.Node,
-		"ContainerImage": podargs.Image,
-		"ContainerID": podargs.Sender.ContainerID,
-		"MirrorType": podargs.Sender.MirrorType,
-		"MirrorIF": podargs.Sender.MirrorIF,
-		"IFName": podargs.IFName,
-		"EgressIP": podargs.Sender.VxlanEgressIP,
-		"VXLANIP": podargs.Sender.VxlanIP,
-		"VXLANID": strconv.Itoa(podargs.VxlanID),
-		"VXLANPort": strconv.Itoa(podargs.VxlanPort),
+	pods := []*v1.Pod{}
+	for _, doc := range strings.Split(podYaml, "\n---\n") {
+		if strings.TrimSpace(doc) == "" {
+			continue
+		}
+		pod := &v1.Pod{}
+		if err := yaml.Unmarshal([]byte(doc), pod); err != nil {
+			return nil, fmt.Errorf("failed to decode pod yaml: %v", err)
+		}
+		if pod.Kind != "Pod" {
+			continue
+		}
+		pod.Namespace = podargs.Namespace
+		if pod.Labels[tapRoleLabel] == tapRoleReceiver && podargs.Receiver.Namespace != "" {
+			pod.Namespace = podargs.Receiver.Namespace
+		}
+		pods = append(pods, pod)
 	}
+	return pods, nil
+}
 
-	var yaml bytes.Buffer
-	if err := kokoTapPodCrioSenderTemplate.Execute(&yaml, senderMap); err != nil {
-		panic(err)
+// loadKubeClient returns the client by kubeconfig, context, cluster and
+// user. If namespace is empty, the namespace of the context (or the namespace
+// of kokotap pod for in-cluster config) is set to it.
+func loadKubeClient(kubeconfig, context, cluster, user string, namespace *string) (kubeClient, clientcmd.ClientConfig, error) {
+	if kubeconfig != "" {
+		if _, err := os.Stat(kubeconfig); err != nil {
+			return nil, nil, fmt.Errorf("kubeconfig %q is not found: %v", kubeconfig, err)
+		}
 	}
 
-	if podargs.Receiver.Node != "" {
-		receiverMap := map[string]string {
-			"PodName": receiverPod,
-			"NodeName": podargs.Receiver.Node,
-			"ContainerImage": podargs.Image,
-			"IFName": podargs.IFName,
-			"EgressIP": podargs.Receiver.VxlanEgressIP,
-			"VXLANIP": podargs.Receiver.VxlanIP,
-			"VXLANID": strconv.Itoa(podargs.VxlanID),
-			"VXLANPort": strconv.Itoa(podargs.VxlanPort),
+	clientConfig := newClientConfig(kubeconfig, context, cluster, user)
+	kubeClient, err := getK8sClient(clientConfig, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if *namespace == "" {
+		if *namespace, _, err = clientConfig.Namespace(); err != nil {
+			return nil, nil, fmt.Errorf("failed to get namespace of the context: %v", err)
 		}
+	}
+	return kubeClient, clientConfig, nil
+}
 
-		if err := kokoTapPodCrioReceiverTemplate.Execute(&yaml, receiverMap); err != nil {
-			panic(err)
+// newTapClients returns the clients of target cluster (by kubeconfig,
+// context, cluster and user) and dest cluster (by dest kubeconfig and dest
+// context) of args. Dest cluster is the target cluster unless dest
+// kubeconfig/context is given.
+func newTapClients(args *kokotapArgs) (*tapClients, error) {
+	kubeClient, targetConfig, err := loadKubeClient(args.KubeConfig, args.Context, args.Cluster, args.User, &args.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	clients := &tapClients{target: kubeClient, dest: kubeClient, destNamespace: args.Namespace}
+	if args.DestKubeConfig == "" && args.DestContext == "" {
+		if args.DestNamespace != "" {
+			return nil, fmt.Errorf("dest-namespace needs dest-context or dest-kubeconfig")
 		}
+		return clients, nil
 	}
 
-	return yaml.String()
+	kubeconfig := args.DestKubeConfig
+	if kubeconfig == "" {
+		kubeconfig = args.KubeConfig
+	}
+	destNamespace := args.DestNamespace
+	destClient, clientConfig, err := loadKubeClient(kubeconfig, args.DestContext, "", "", &args.DestNamespace)
+	if err != nil {
+		return nil, fmt.Errorf("dest cluster: %v", err)
+	}
+	sameCluster, err := isSameCluster(targetConfig, clientConfig)
+	if err != nil {
+		return nil, err
+	}
+	if sameCluster {
+		// e.g. other context of the target cluster
+		if destNamespace != "" && destNamespace != args.Namespace {
+			return nil, fmt.Errorf("dest-namespace needs dest cluster other than the target cluster")
+		}
+		return clients, nil
+	}
+	if args.DestContext == "" {
+		rawConfig, err := clientConfig.RawConfig()
+		if err != nil {
+			return nil, fmt.Errorf("dest cluster: %v", err)
+		}
+		args.DestContext = rawConfig.CurrentContext
+	}
+	clients.dest = destClient
+	clients.destNamespace = args.DestNamespace
+	return clients, nil
 }
 
-func (podargs *kokotapPodArgs) ParseKokoTapArgs(args *kokotapArgs) error {
-	if args == nil {
-		return fmt.Errorf("Invalid args")
+// isSameCluster returns true if the client configs have the same API server.
+func isSameCluster(config1, config2 clientcmd.ClientConfig) (bool, error) {
+	hosts := []string{}
+	for _, clientConfig := range []clientcmd.ClientConfig{config1, config2} {
+		config, err := clientConfig.ClientConfig()
+		if err != nil {
+			return false, fmt.Errorf("failed to load kubeconfig: %v", err)
+		}
+		hosts = append(hosts, strings.TrimSuffix(config.Host, "/"))
 	}
+	return hosts[0] == hosts[1], nil
+}
 
-	if args.KubeConfig == "" {
-		return fmt.Errorf("no kubeconfig option")
+// receiverIFName returns the receiver interface name for idx-th sender.
+// If indexed, each sender gets own interface (suffixed by index).
+func receiverIFName(ifName string, idx int, indexed bool) string {
+	if !indexed {
+		return ifName
+	}
+	suffix := strconv.Itoa(idx)
+	if len(ifName)+len(suffix) > 15 {
+		ifName = ifName[0 : 15-len(suffix)]
 	}
+	return ifName + suffix
+}
 
-	_, err := os.Stat(args.KubeConfig)
-	if err != nil {
-		return fmt.Errorf("kubeconfig %q is not found: %v", args.KubeConfig, err)
+// isVLANEncap returns true if the encapsulation sends the packets to the
+// network of the parent interface (RSPAN style), without dest IP.
+func isVLANEncap(encap string) bool {
+	return encap == "vlan" || encap == "macvlan"
+}
+
+// encapID returns the first ID of the encapsulation: VLAN ID for vlan (none
+// for macvlan and veth), otherwise vxlan-id, which is required.
+func encapID(encap string, vxlanID int, vxlanIDSet bool, vlanID int, parentIF string) (int, error) {
+	if isVLANEncap(encap) && parentIF == "" {
+		return 0, fmt.Errorf("please set parent-if for %s", encap)
+	}
+	switch encap {
+	case "vlan":
+		if vlanID < 1 || vlanID > vlanMaxID {
+			return 0, fmt.Errorf("please set vlan-id (1-%d) for vlan", vlanMaxID)
+		}
+		return vlanID, nil
+	case "macvlan", "veth":
+		return 0, nil
 	}
+	if !vxlanIDSet {
+		return 0, fmt.Errorf("please set vxlan-id")
+	}
+	return vxlanID, nil
+}
 
-	kubeClient, err := getK8sClient(args.KubeConfig, nil)
+// checkVethNode returns error if the target on the node cannot be delivered
+// by veth, which is on the node only.
+func (podargs *kokotapPodArgs) checkVethNode(node string) error {
+	if podargs.Encap == "veth" && podargs.Receiver.Node != "" && node != podargs.Receiver.Node {
+		return fmt.Errorf("veth needs the target on dest node %q, but it is on %q",
+			podargs.Receiver.Node, node)
+	}
+	return nil
+}
+
+// setDestPod sets the analysis pod, in the tap namespace, to put veth peer.
+// The pod's node is dest node. veth peer of hostNetwork pod is in the host.
+func (podargs *kokotapPodArgs) setDestPod(kubeClient kubeClient, name string) error {
+	pod, err := kubeClient.GetPod(podargs.Namespace, name)
 	if err != nil {
 		return fmt.Errorf("%v", err)
 	}
-	pod, err := kubeClient.GetPod(args.Namespace, args.Pod)
+	if pod.Spec.NodeName == "" || pod.Status.Phase != v1.PodRunning {
+		return fmt.Errorf("dest pod %q is not running", name)
+	}
+	podargs.DestPod.Name = name
+	podargs.Receiver.Node = pod.Spec.NodeName
+	if pod.Spec.HostNetwork {
+		return nil
+	}
+	if podargs.DestPod.ContainerID, err = getContainerID(pod, ""); err != nil {
+		return err
+	}
+	podargs.DestPod.UID = string(pod.UID)
+	return nil
+}
+
+// flagSet returns the action which sets isSet when the flag is given.
+func flagSet(isSet *bool) kingpin.Action {
+	return func(*kingpin.ParseContext) error {
+		*isSet = true
+		return nil
+	}
+}
+
+// encapPort returns the default UDP port of the encapsulation.
+func encapPort(encap string) int {
+	if encap == "geneve" {
+		return 6081
+	}
+	return 4789
+}
+
+// setVMIMirrorIFs sets the tap device of the VMI interface as MirrorIF of
+// virt-launcher pods.
+func (podargs *kokotapPodArgs) setVMIMirrorIFs(kubeClient kubeClient, args *kokotapArgs, name string, pods []v1.Pod) error {
+	if args.Network != "" {
+		return fmt.Errorf("please set vmi-ifname instead of network for vmi")
+	}
+	vmi, err := getVMI(kubeClient, args.Namespace, name)
 	if err != nil {
-		return fmt.Errorf("%v", err)
+		return err
 	}
 
-	podargs.PodName = args.Pod
-	podargs.Sender.VxlanEgressIP = pod.Status.HostIP
-	podargs.Receiver.VxlanIP = pod.Status.HostIP
-	podargs.Sender.Node = pod.Spec.NodeName
-	podargs.Image = args.Image
+	podargs.PodMirrorIFs = map[string]string{}
+	for i := range pods {
+		ifName, err := vmi.getVMITapInterface(&pods[i], args.VMIIFName)
+		if err != nil {
+			return err
+		}
+		podargs.PodMirrorIFs[podargs.podKey(&pods[i])] = ifName
+	}
+	return nil
+}
 
-	isContainerFound := false
-	for _, val := range pod.Status.ContainerStatuses {
-		if val.Ready == true {
-			podargs.Sender.ContainerID = val.ContainerID
-			isContainerFound = true
-			break
+// NewHostSender returns the sender for the interface of the node.
+func (podargs *kokotapPodArgs) NewHostSender(kubeClient kubeClient, nodeName, ifName string, idx int) (kokotapSenderArgs, error) {
+	if ifName == "" {
+		return kokotapSenderArgs{}, fmt.Errorf("please set node-ifname")
+	}
+	node, err := kubeClient.GetNode(nodeName)
+	if err != nil {
+		return kokotapSenderArgs{}, fmt.Errorf("%v", err)
+	}
+	_, nodeIP := getHostIP(&node.Status.Addresses)
+	if err = podargs.checkVethNode(node.Name); err != nil {
+		return kokotapSenderArgs{}, err
+	}
+
+	return kokotapSenderArgs{
+		Node:          node.Name,
+		MirrorIF:      ifName,
+		HostNetns:     true,
+		VxlanEgressIP: nodeIP,
+		VxlanIP:       podargs.DestIP,
+		VxlanID:       podargs.VxlanID + idx,
+		IFName:        receiverIFName(podargs.IFName, idx, podargs.IndexIFName),
+		IPsecSPI:      podargs.ipsecSPI(nodeIP, idx),
+	}, nil
+}
+
+// runtimeSocket returns the container runtime socket to find the network
+// namespace of the container, or "" if the socket is not used.
+func (podargs *kokotapPodArgs) runtimeSocket(pod *v1.Pod, containerID string) (string, error) {
+	if podargs.RuntimeSocket != "" || podargs.NetnsDiscovery == "proc" || pod.Spec.HostNetwork {
+		return podargs.RuntimeSocket, nil
+	}
+	idx := strings.Index(containerID, ":")
+	if idx < 0 {
+		return "", fmt.Errorf("no container runtime in container ID %q of pod %q (container is not started?)",
+			containerID, pod.Name)
+	}
+	runtime := containerID[0:idx]
+	socket := runtimeSockets[runtime]
+	if socket == "" {
+		return "", fmt.Errorf("unknown container runtime %q of pod %q, please set runtime-socket",
+			runtime, pod.Name)
+	}
+	return socket, nil
+}
+
+// NewSender returns the sender for the target pod, using idx-th VxLAN ID and
+// receiver interface.
+func (podargs *kokotapPodArgs) NewSender(pod *v1.Pod, idx int) (kokotapSenderArgs, error) {
+	var err error
+	container := podargs.Container
+	mirrorIF := podargs.MirrorIF
+	if ifName, ok := podargs.PodMirrorIFs[podargs.podKey(pod)]; ok {
+		// VMI tap device, in the compute container of virt-launcher pod
+		mirrorIF = ifName
+		if container == "" {
+			container = vmiComputeContainer
+		}
+	} else if podargs.Network != "" {
+		if mirrorIF, err = getNetworkInterface(pod, podargs.Network); err != nil {
+			return kokotapSenderArgs{}, err
+		}
+	}
+	containerID, err := podargs.targetContainerID(pod, container)
+	if err != nil {
+		return kokotapSenderArgs{}, err
+	}
+	var filters []string
+	if pod.Spec.HostNetwork {
+		if filters, err = hostNetworkFilters(pod); err != nil {
+			return kokotapSenderArgs{}, err
+		}
+	}
+	socket, err := podargs.runtimeSocket(pod, containerID)
+	if err != nil {
+		return kokotapSenderArgs{}, err
+	}
+	if err = podargs.checkVethNode(pod.Spec.NodeName); err != nil {
+		return kokotapSenderArgs{}, err
+	}
+
+	return kokotapSenderArgs{
+		PodName:       podargs.podKey(pod),
+		Node:          pod.Spec.NodeName,
+		ContainerID:   containerID,
+		PodUID:        string(pod.UID),
+		MirrorIF:      mirrorIF,
+		RuntimeSocket: socket,
+		HostNetns:     pod.Spec.HostNetwork,
+		Filters:       filters,
+		VxlanEgressIP: pod.Status.HostIP,
+		VxlanIP:       podargs.DestIP,
+		VxlanID:       podargs.VxlanID + idx,
+		IFName:        receiverIFName(podargs.IFName, idx, podargs.IndexIFName),
+		IPsecSPI:      podargs.ipsecSPI(pod.Status.HostIP, idx),
+	}, nil
+}
+
+func (podargs *kokotapPodArgs) ParseKokoTapArgs(clients *tapClients, args *kokotapArgs) error {
+	if args == nil {
+		return fmt.Errorf("Invalid args")
+	}
+	kubeClient := clients.target
+
+	kind, name, err := getTargetWorkload(args)
+	if err != nil {
+		return err
+	}
+	peerService := args.Service
+	if kind == workloadService && name == args.Service {
+		peerService = ""
+	}
+	if args.Follow && (kind == workloadPod || kind == workloadHost || kind == workloadVMI) {
+		return fmt.Errorf("follow needs selector, deployment, statefulset, daemonset or service")
+	}
+	if args.Follow && (len(args.PeerPods) > 0 || peerService != "") {
+		return fmt.Errorf("follow does not support peer-pod or service with other target")
+	}
+	if args.Follow && args.Encap == "geneve" {
+		// geneve receiver listens the UDP port, so only one receiver per port
+		return fmt.Errorf("follow does not support geneve")
+	}
+	if args.Follow && args.Encrypt == "ipsec" {
+		// a new sender of the slot starts ESP sequence from 1 again (and may
+		// be on other node), which the SAs of the receiver drop
+		return fmt.Errorf("follow does not support ipsec encryption")
+	}
+	pods := []v1.Pod{}
+	if kind != workloadHost {
+		if pods, err = getTargetPods(kubeClient, args.Namespace, kind, name, args.Selector); err != nil {
+			return err
 		}
 	}
-	if isContainerFound != true {
-		return fmt.Errorf("no ready container in pod: %q", args.Pod)
+	peers, err := getPeerPods(kubeClient, args.Namespace, args.PeerPods, peerService, pods)
+	if err != nil {
+		return err
 	}
+	targets := pods
+	pods = append(pods, peers...)
 
-	podargs.ContainerRuntime = podargs.Sender.
-		ContainerID[0:strings.Index(podargs.Sender.ContainerID, ":")]
+	switch kind {
+	case workloadPod:
+		podargs.Name = name
+	case "":
+		podargs.Name = args.Selector
+		podargs.Selector = args.Selector
+	default:
+		podargs.Workload = kind + "/" + name
+		podargs.Name = podargs.Workload
+	}
+	if args.TapName != "" {
+		podargs.Name = args.TapName
+	}
+	podargs.Namespace = args.Namespace
+	podargs.Container = args.Container
+	podargs.AnyContainer = kind == workloadNode || kind == workloadNamespace
+	podargs.Image = args.Image
 	podargs.IFName = args.IFName
-	podargs.Sender.MirrorType = args.MirrorType
-	podargs.Sender.MirrorIF = args.PodIFName
-	podargs.VxlanID = args.VxlanID
+	podargs.MirrorType = args.MirrorType
+	podargs.MirrorIF = args.PodIFName
+	podargs.Network = args.Network
+	podargs.Encap = args.Encap
+	if podargs.VxlanID, err = encapID(args.Encap, args.VxlanID, args.VxlanIDSet, args.VlanID, args.ParentIF); err != nil {
+		return err
+	}
+	if isVLANEncap(podargs.Encap) {
+		podargs.ParentIF = args.ParentIF
+	}
 	podargs.VxlanPort = args.VxlanPort
+	if podargs.VxlanPort == 0 && args.Encrypt == "ipsec" {
+		podargs.VxlanPort = ipsecPort
+	}
+	if podargs.VxlanPort == 0 {
+		podargs.VxlanPort = encapPort(podargs.Encap)
+	}
+	if args.Pcap != "" && podargs.Encap != "geneve" {
+		return fmt.Errorf("pcap needs geneve encap")
+	}
+	podargs.Pcap = args.Pcap
+	if podargs.Encap == "erspan" {
+		if args.ErspanVersion != 1 && args.ErspanVersion != 2 {
+			return fmt.Errorf("erspan-version should be 1 (type II) or 2 (type III)")
+		}
+		podargs.ErspanVersion = args.ErspanVersion
+		podargs.ErspanDir = args.ErspanDir
+	}
+	podargs.ReceiverPerSender = args.Follow
+	podargs.RuntimeSocket = args.RuntimeSocket
+	podargs.NetnsDiscovery = args.NetnsDiscovery
+	if podargs.NetnsDiscovery == "proc" && podargs.RuntimeSocket != "" {
+		return fmt.Errorf("runtime-socket is not used by proc netns discovery")
+	}
+	if kind == workloadVMI {
+		if err = podargs.setVMIMirrorIFs(kubeClient, args, name, targets); err != nil {
+			return err
+		}
+	}
 
-	if args.DestNode != "" && args.DestIP == nil {
-		destNode, err := kubeClient.GetNode(args.DestNode)
+	// vlan/macvlan packets go to the network of parent-if. The receiver of
+	// vlan has VLAN interface on parent-if of dest-node. veth delivers to
+	// the node of the target (dest-node, if given), or to dest-pod.
+	veth := podargs.Encap == "veth"
+	noDestIP := isVLANEncap(podargs.Encap) || veth
+	if noDestIP && args.DestIP != nil {
+		return fmt.Errorf("dest-ip is not used by %s", podargs.Encap)
+	}
+	if podargs.Encap == "macvlan" && args.DestNode != "" {
+		return fmt.Errorf("no receiver for macvlan, please capture on the network of parent-if")
+	}
+	if veth && clients.isMultiCluster() {
+		return fmt.Errorf("veth needs dest in the cluster of the target")
+	}
+	if args.DestPod != "" {
+		if !veth {
+			return fmt.Errorf("dest-pod needs veth encap")
+		}
+		if args.DestNode != "" {
+			return fmt.Errorf("please set dest-node or dest-pod")
+		}
+		if err = podargs.setDestPod(kubeClient, args.DestPod); err != nil {
+			return err
+		}
+	} else if args.DestNode != "" && args.DestIP == nil {
+		destNode, err := clients.dest.GetNode(args.DestNode)
 		if err != nil {
 			return fmt.Errorf("%v", err)
 		}
-		destNodeName, destIP := getHostIP(&destNode.Status.Addresses)
+		// the name of the node object, which the receiver pod is bound to (the
+		// hostname address may differ, or not resolve from other cluster)
+		podargs.Receiver.Node = destNode.Name
+		destIP := getNodeAddress(&destNode.Status.Addresses, v1.NodeInternalIP)
+		if destIP == "" {
+			destIP = getNodeAddress(&destNode.Status.Addresses, v1.NodeExternalIP)
+		}
+		if destIP == "" && !noDestIP {
+			return fmt.Errorf("no address of dest-node %q", destNode.Name)
+		}
 		podargs.Receiver.VxlanEgressIP = destIP
-		podargs.Sender.VxlanIP = destIP
-		podargs.Receiver.Node = destNodeName
+		podargs.DestIP = destIP
+		if clients.isMultiCluster() {
+			// internal IP of dest node may not be reachable from other cluster
+			if externalIP := getNodeAddress(&destNode.Status.Addresses, v1.NodeExternalIP); externalIP != "" {
+				podargs.DestIP = externalIP
+			}
+			podargs.Receiver.Namespace = clients.destNamespace
+			podargs.Receiver.Context = args.DestContext
+		}
+		if noDestIP {
+			podargs.DestIP = ""
+		}
 	} else if args.DestNode == "" && args.DestIP != nil {
-		podargs.Receiver.VxlanEgressIP = string(args.DestIP)
-		podargs.Sender.VxlanIP = args.DestIP.String()
-	} else {
+		if clients.isMultiCluster() {
+			return fmt.Errorf("dest-context/dest-kubeconfig needs dest-node")
+		}
+		podargs.DestIP = args.DestIP.String()
+	} else if !noDestIP {
 		return fmt.Errorf("please set dest-node or dest-ip")
 	}
 
+	// the receiver decrypts the tunnel, hence dest-node is needed. ESP has no
+	// NAT traversal, so dest cluster (by external IP) is not supported.
+	podargs.Encrypt = args.Encrypt
+	if podargs.Encrypt == "ipsec" {
+		if err = podargs.checkIPsecSelector(); err != nil {
+			return err
+		}
+		if args.DestNode == "" {
+			return fmt.Errorf("ipsec needs dest-node for the receiver")
+		}
+		if clients.isMultiCluster() {
+			return fmt.Errorf("ipsec does not support dest-context/dest-kubeconfig")
+		}
+		if err = podargs.setIPsecKey(); err != nil {
+			return err
+		}
+	}
+
+	// veth peer of the host target is in the host as well, hence indexed
+	podargs.IndexIFName = len(pods) > 1 || args.Follow || veth
+	if kind == workloadHost {
+		podargs.IndexIFName = len(pods) > 0 || veth
+		sender, err := podargs.NewHostSender(kubeClient, name, args.NodeIFName, 0)
+		if err != nil {
+			return err
+		}
+		podargs.Senders = append(podargs.Senders, sender)
+	}
+	for i := range pods {
+		sender, err := podargs.NewSender(&pods[i], len(podargs.Senders))
+		if err != nil {
+			return err
+		}
+		podargs.Senders = append(podargs.Senders, sender)
+	}
+	// ERSPAN session ID is 10 bits
+	if podargs.Encap == "erspan" && podargs.VxlanID+len(podargs.Senders)-1 > erspanMaxSessionID {
+		return fmt.Errorf("ERSPAN session ID (vxlan-id) of %d senders exceeds %d",
+			len(podargs.Senders), erspanMaxSessionID)
+	}
+	if podargs.Encap == "vlan" && podargs.VxlanID+len(podargs.Senders)-1 > vlanMaxID {
+		return fmt.Errorf("VLAN ID (vlan-id) of %d senders exceeds %d",
+			len(podargs.Senders), vlanMaxID)
+	}
+
 	return nil
 }
 
+func addTapFlags(c *kingpin.CmdClause, args *kokotapArgs) {
+	c.Flag("pod", "tap target pod name (or kind/name, e.g. deploy/foo)").StringVar(&args.Pod)
+	c.Flag("selector", "label selector for tap target pods (instead of pod)").
+		Short('l').StringVar(&args.Selector)
+	c.Flag("deployment", "tap target deployment name (instead of pod)").
+		StringVar(&args.Deployment)
+	c.Flag("statefulset", "tap target statefulset name (instead of pod)").
+		StringVar(&args.StatefulSet)
+	c.Flag("daemonset", "tap target daemonset name (instead of pod)").
+		StringVar(&args.DaemonSet)
+	c.Flag("container", "tap target container name (optional if the pod has one container)").
+		Short('c').StringVar(&args.Container)
+	c.Flag("service", "tap target service, or peer service of other target (pods of its endpoints)").
+		StringVar(&args.Service)
+	c.Flag("peer-pod", "peer pod of the target to tap as well (repeatable)").
+		StringsVar(&args.PeerPods)
+	c.Flag("all-pods-on-node", "tap all pods (which have own network) on the node (instead of pod)").
+		StringVar(&args.AllPodsOnNode)
+	c.Flag("namespace-wide", "tap all pods (which have own network) in the namespace (instead of pod)").
+		BoolVar(&args.NamespaceWide)
+	c.Flag("node", "tap target node, to tap its interface (instead of pod)").
+		StringVar(&args.Node)
+	c.Flag("node-ifname", "tap target interface name of node (with node, comma-separated)").
+		StringVar(&args.NodeIFName)
+	c.Flag("vmi", "tap target KubeVirt VMI, to tap its interface in virt-launcher pod (instead of pod)").
+		StringVar(&args.VMI)
+	c.Flag("vmi-ifname", "tap target interface name of VMI (with vmi, default: first interface)").
+		StringVar(&args.VMIIFName)
+	c.Flag("tap-name", "tap name (optional, default: pod name, workload or selector)").
+		StringVar(&args.TapName)
+	c.Flag("pod-ifname", "tap target interface names of pod, comma-separated or 'all' (optional)").
+		Default("eth0").StringVar(&args.PodIFName)
+	c.Flag("network", "tap target Multus network ([namespace/]name) to find pod interface (instead of pod-ifname)").
+		StringVar(&args.Network)
+	c.Flag("vxlan-id", "VxLAN ID to encap tap traffic (incremented for each target pod, not used by vlan/macvlan)").
+		Action(flagSet(&args.VxlanIDSet)).IntVar(&args.VxlanID)
+	c.Flag("vxlan-port", "VxLAN (or Geneve) UDP port (optional, default: 4789, 6081 for geneve, 14789 for ipsec)").
+		IntVar(&args.VxlanPort)
+	c.Flag("encap", "encapsulation {vxlan|gretap|erspan|geneve|vlan|macvlan|veth} (vxlan-id is used as GRE key, ERSPAN session ID or Geneve VNI)").
+		Default("vxlan").EnumVar(&args.Encap, "vxlan", "gretap", "erspan", "geneve", "vlan", "macvlan", "veth")
+	c.Flag("vlan-id", "VLAN ID to tag tap traffic on parent-if (vlan, incremented for each target pod)").
+		IntVar(&args.VlanID)
+	c.Flag("parent-if", "physical interface of nodes to send tap traffic (vlan/macvlan, e.g. ens2f1)").
+		StringVar(&args.ParentIF)
+	c.Flag("erspan-version", "ERSPAN version {1|2} (1: type II, 2: type III)").
+		Default("1").IntVar(&args.ErspanVersion)
+	c.Flag("erspan-dir", "ERSPAN type III direction {ingress|egress} (optional, default: by mirrortype)").
+		EnumVar(&args.ErspanDir, "ingress", "egress")
+	c.Flag("pcap", "pcapng file path in receiver pod to write with target pod/interface/direction labels (geneve)").
+		StringVar(&args.Pcap)
+	c.Flag("ifname", "Mirror interface name").Default("mirror").StringVar(&args.IFName)
+	c.Flag("mirrortype", "mirroring type {ingress|egress|both}").
+		Default("both").EnumVar(&args.MirrorType, "ingress", "egress", "both")
+	c.Flag("dest-node", "kubernetes node for tap interface").StringVar(&args.DestNode)
+	c.Flag("dest-ip", "IP address for destination tap interface").IPVar(&args.DestIP)
+	c.Flag("dest-pod", "analysis pod to put tap interface by veth (veth, instead of dest-node)").
+		StringVar(&args.DestPod)
+	c.Flag("encrypt", "encrypt tap traffic between nodes {none|ipsec} (ipsec: key in secret, needs dest-node)").
+		Default("none").EnumVar(&args.Encrypt, "none", "ipsec")
+	c.Flag("runtime-socket", "container runtime socket path at node (optional, default: by runtime)").
+		StringVar(&args.RuntimeSocket)
+	c.Flag("netns-discovery", "how to find target netns {runtime|proc} (proc: scan /proc without runtime socket)").
+		Default("runtime").EnumVar(&args.NetnsDiscovery, "runtime", "proc")
+	c.Flag("image", "kokotap container image").Default("quay.io/s1061123/kokotap:latest").StringVar(&args.Image)
+}
+
+// commandName returns the command name to show in usage, e.g. 'kubectl tap'
+// for kubectl plugin 'kubectl-tap'.
+func commandName(arg0 string) string {
+	name := filepath.Base(arg0)
+	if strings.HasPrefix(name, "kubectl-") {
+		return "kubectl " + strings.Replace(strings.TrimPrefix(name, "kubectl-"), "_", "-", -1)
+	}
+	return name
+}
+
 func main() {
 	var args kokotapArgs
-	/*
-		a := kingpin.New(filepath.Base(os.Args[0]), "kokotap_pod")
-		a.Version(VERSION)
-		a.HelpFlag.Short('h')
-
-		k := a.Command("create", "create tap interface for kubernetes pod")
-	*/
-	k := kingpin.New(filepath.Base(os.Args[0]), "kokotap")
+	var localArgs localArgs
+	var tapName string
+	var timeout time.Duration
+
+	k := kingpin.New(commandName(os.Args[0]), "kokotap")
 	k.Version(fmt.Sprintf("%s/%s/%s", version, commit, date))
 	k.HelpFlag.Short('h')
 	k.VersionFlag.Short('v')
 
-	k.Flag("pod", "tap target pod name").Required().StringVar(&args.Pod)
-	k.Flag("pod-ifname", "tap target interface name of pod (optional)").
-		Default("eth0").StringVar(&args.PodIFName)
-	k.Flag("vxlan-id", "VxLAN ID to encap tap traffic").
-		Required().IntVar(&args.VxlanID)
-	k.Flag("vxlan-port", "VxLAN UDP port").Default("4789").IntVar(&args.VxlanPort)
-	k.Flag("ifname", "Mirror interface name").Default("mirror").StringVar(&args.IFName)
-	k.Flag("mirrortype", "mirroring type {ingress|egress|both}").
-		Default("both").EnumVar(&args.MirrorType, "ingress", "egress", "both")
-	k.Flag("dest-node", "kubernetes node for tap interface").StringVar(&args.DestNode)
-	k.Flag("dest-ip", "IP address for destination tap interface").IPVar(&args.DestIP)
-	k.Flag("namespace", "namespace for pod/container (optional)").
-		Default("default").StringVar(&args.Namespace)
-	k.Flag("kubeconfig", "kubeconfig file path (optional)").
-		Envar("KUBECONFIG").StringVar(&args.KubeConfig)
-	k.Flag("image", "kokotap container image").Default("quay.io/s1061123/kokotap:latest").StringVar(&args.Image)
+	k.Flag("namespace", "namespace for pod/container (optional, default: namespace of the context)").
+		Short('n').StringVar(&args.Namespace)
+	k.Flag("kubeconfig", "kubeconfig file path (optional, default: KUBECONFIG or ~/.kube/config)").
+		StringVar(&args.KubeConfig)
+	k.Flag("context", "kubeconfig context (optional, default: current context)").
+		StringVar(&args.Context)
+	k.Flag("cluster", "kubeconfig cluster (optional, default: the one of the context)").
+		StringVar(&args.Cluster)
+	k.Flag("user", "kubeconfig user (optional, default: the one of the context)").
+		StringVar(&args.User)
+	k.Flag("dest-kubeconfig", "kubeconfig file path of dest cluster for receiver (optional, default: kubeconfig)").
+		StringVar(&args.DestKubeConfig)
+	k.Flag("dest-context", "kubeconfig context of dest cluster for receiver (optional, default: same cluster)").
+		StringVar(&args.DestContext)
+	k.Flag("dest-namespace", "namespace of receiver in dest cluster (optional, default: namespace of dest context)").
+		StringVar(&args.DestNamespace)
+
+	g := k.Command("generate", "generate tap pod yaml for kubectl").Default()
+	addTapFlags(g, &args)
 
-	kingpin.MustParse(k.Parse(os.Args[1:]))
+	c := k.Command("create", "create tap pods and wait until they are running")
+	addTapFlags(c, &args)
+	c.Flag("timeout", "timeout to wait for tap pods running").
+		Default("2m").DurationVar(&timeout)
 
-	podArgs := kokotapPodArgs{}
-	err := podArgs.ParseKokoTapArgs(&args)
+	r := k.Command("run", "create tap pods, follow their logs and delete them at exit")
+	addTapFlags(r, &args)
+	r.Flag("timeout", "timeout to wait for tap pods running").
+		Default("2m").DurationVar(&timeout)
+	r.Flag("follow", "add/remove senders as the pods of selector/workload come and go").
+		BoolVar(&args.Follow)
 
+	d := k.Command("delete", "delete tap pods")
+	d.Arg("tap", "tap name").Required().StringVar(&tapName)
+
+	l := k.Command("list", "list taps in all namespaces")
+
+	desc := k.Command("describe", "show tap details")
+	desc.Arg("tap", "tap name").Required().StringVar(&tapName)
+
+	ifs := k.Command("interfaces", "show interfaces in the network namespace of the pod (as JSON)")
+	ifs.Flag("pod", "target pod name").Required().StringVar(&args.Pod)
+	ifs.Flag("container", "target container name (optional if the pod has one container)").
+		Short('c').StringVar(&args.Container)
+	ifs.Flag("runtime-socket", "container runtime socket path at node (optional, default: by runtime)").
+		StringVar(&args.RuntimeSocket)
+	ifs.Flag("netns-discovery", "how to find target netns {runtime|proc} (proc: scan /proc without runtime socket)").
+		Default("runtime").EnumVar(&args.NetnsDiscovery, "runtime", "proc")
+	ifs.Flag("image", "kokotap container image").Default("quay.io/s1061123/kokotap:latest").StringVar(&args.Image)
+	ifs.Flag("timeout", "timeout to wait for the pod completed").
+		Default("2m").DurationVar(&timeout)
+
+	lo := k.Command("local", "tap docker/podman container on this host without kubernetes, until interrupted")
+	lo.Flag("container", "tap target container ID or name").Required().StringVar(&localArgs.Container)
+	lo.Flag("runtime", "container runtime {docker|podman} (optional, default: by socket found)").
+		EnumVar(&localArgs.Runtime, "docker", "podman")
+	lo.Flag("runtime-socket", "docker (or podman's docker compatible) API socket path (optional)").
+		StringVar(&localArgs.RuntimeSocket)
+	lo.Flag("pod-ifname", "tap target interface names of container, comma-separated or 'all'").
+		Default("eth0").StringVar(&localArgs.PodIFName)
+	lo.Flag("vxlan-id", "VxLAN ID to encap tap traffic (not used by vlan/macvlan)").
+		Action(flagSet(&localArgs.VxlanIDSet)).IntVar(&localArgs.VxlanID)
+	lo.Flag("vxlan-port", "VxLAN (or Geneve) UDP port (optional, default: 4789, 6081 for geneve)").
+		IntVar(&localArgs.VxlanPort)
+	lo.Flag("encap", "encapsulation {vxlan|gretap|erspan|geneve|vlan|macvlan|veth} (vxlan-id is used as GRE key, ERSPAN session ID or Geneve VNI)").
+		Default("vxlan").EnumVar(&localArgs.Encap, "vxlan", "gretap", "erspan", "geneve", "vlan", "macvlan", "veth")
+	lo.Flag("vlan-id", "VLAN ID to tag tap traffic on parent-if (vlan)").
+		IntVar(&localArgs.VlanID)
+	lo.Flag("parent-if", "physical interface of this host to send tap traffic (vlan/macvlan, e.g. ens2f1)").
+		StringVar(&localArgs.ParentIF)
+	lo.Flag("erspan-version", "ERSPAN version {1|2} (1: type II, 2: type III)").
+		Default("1").IntVar(&localArgs.ErspanVersion)
+	lo.Flag("erspan-dir", "ERSPAN type III direction {ingress|egress} (optional, default: by mirrortype)").
+		EnumVar(&localArgs.ErspanDir, "ingress", "egress")
+	lo.Flag("ifname", "Mirror interface name").Default("mirror").StringVar(&localArgs.IFName)
+	lo.Flag("mirrortype", "mirroring type {ingress|egress|both}").
+		Default("both").EnumVar(&localArgs.MirrorType, "ingress", "egress", "both")
+	lo.Flag("dest-ip", "IP address for destination tap interface (not used by vlan/macvlan/veth)").IPVar(&localArgs.DestIP)
+	lo.Flag("egress-ip", "IP address of this host for VxLAN (optional, default: by route to dest-ip)").
+		IPVar(&localArgs.EgressIP)
+	lo.Flag("sender", "kokotap_pod binary to run as sender").Default("kokotap_pod").StringVar(&localArgs.Sender)
+
+	cmd := kingpin.MustParse(k.Parse(os.Args[1:]))
+	if cmd == lo.FullCommand() {
+		if err := runLocal(&localArgs); err != nil {
+			fmt.Fprintf(os.Stderr, "err: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	clients, err := newTapClients(&args)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "err: %v\n", err)
+		os.Exit(1)
 	}
 
-	switch podArgs.ContainerRuntime {
-	case "docker":
-		fmt.Printf("%s", podArgs.GenerateDockerYaml())
-	case "cri-o":
-		fmt.Printf("%s", podArgs.GenerateCrioYaml())
+	switch cmd {
+	case g.FullCommand(), c.FullCommand(), r.FullCommand():
+		// node/namespace-wide capture always follows the pods in run
+		if cmd == r.FullCommand() && (args.AllPodsOnNode != "" || args.NamespaceWide) {
+			args.Follow = true
+		}
+		podArgs := kokotapPodArgs{}
+		if err = podArgs.ParseKokoTapArgs(clients, &args); err != nil {
+			break
+		}
+		switch cmd {
+		case c.FullCommand():
+			err = createTap(clients, &podArgs, timeout)
+		case r.FullCommand():
+			var follower *tapFollower
+			if args.Follow {
+				kind, name, _ := getTargetWorkload(&args)
+				follower = newTapFollower(clients, &podArgs, kind, name, args.Selector)
+			}
+			err = runTap(clients, &podArgs, timeout, follower)
+		default:
+			var podYaml string
+			if podYaml, err = podArgs.GenerateYaml(); err == nil {
+				fmt.Printf("%s", podYaml)
+			}
+		}
+	case d.FullCommand():
+		err = deleteTap(clients, args.Namespace, tapName)
+	case l.FullCommand():
+		err = listTaps(clients)
+	case desc.FullCommand():
+		err = describeTap(clients, args.Namespace, tapName)
+	case ifs.FullCommand():
+		err = showInterfaces(clients.target, &args, timeout)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "err: %v\n", err)
+		os.Exit(1)
 	}
-	return
 }
@@ -0,0 +1,628 @@
+// Copyright 2018 Red Hat
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"io/ioutil"
+	v1 "k8s.io/api/core/v1"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// dnsSubdomain is the pattern of kubernetes object names
+var dnsSubdomain = regexp.MustCompile(`^[a-z0-9]([-a-z0-9.]*[a-z0-9])?$`)
+
+func TestSanitizeName(t *testing.T) {
+	tests := []struct {
+		name      string
+		label     string
+		object    string
+		tapName   string
+		truncated string // by truncateName(label, 10)
+	}{
+		{name: "web-0", label: "web-0", object: "web-0", tapName: "web-0", truncated: "web-0"},
+		{name: "My_App.v1", label: "My_App.v1", object: "my-app.v1", tapName: "My_App.v1", truncated: "My_App.v1"},
+		{name: "app=web,tier in (db)", label: "app-web-tier-in--db-", object: "app-web-tier-in--db-",
+			tapName: "app-web-tier-in--db", truncated: "app-web-ti"},
+		{name: "default/web-0", label: "default-web-0", object: "default-web-0", tapName: "default-web-0",
+			truncated: "default-we"},
+		{name: "-_.x", label: "x", object: "x", tapName: "x", truncated: "x"},
+		{name: "abcdefghi_j", label: "abcdefghi_j", object: "abcdefghi-j", tapName: "abcdefghi_j", truncated: "abcdefghi"},
+	}
+
+	for _, tt := range tests {
+		if got := sanitizeName(tt.name); got != tt.label {
+			t.Errorf("%q: sanitizeName = %q, want %q", tt.name, got, tt.label)
+		}
+		if got := objectName(tt.name); got != tt.object {
+			t.Errorf("%q: objectName = %q, want %q", tt.name, got, tt.object)
+		}
+		if got := (&kokotapPodArgs{Name: tt.name}).TapName(); got != tt.tapName {
+			t.Errorf("%q: TapName = %q, want %q", tt.name, got, tt.tapName)
+		}
+		if got := truncateName(tt.label, 10); got != tt.truncated {
+			t.Errorf("%q: truncateName = %q, want %q", tt.name, got, tt.truncated)
+		}
+	}
+}
+
+func TestGeneratePodName(t *testing.T) {
+	tests := []struct {
+		tapName  string
+		sender   kokotapSenderArgs
+		node     string
+		want     string // sender pod name
+		receiver string // receiver pod name of the sender
+	}{
+		{
+			tapName:  "web-0",
+			sender:   kokotapSenderArgs{PodName: "web-0", IFName: "mirror"},
+			node:     "kube-node-1",
+			want:     "kokotap-web-0-sender",
+			receiver: "kokotap-web-0-receiver-mirror-kube-node-1",
+		},
+		{
+			tapName:  "app=web",
+			sender:   kokotapSenderArgs{PodName: "Web_0", IFName: "mirror_1"},
+			node:     "kube-node.1",
+			want:     "kokotap-app-web-web-0-sender",
+			receiver: "kokotap-app-web-receiver-mirror-1-kube-node-1",
+		},
+		{
+			tapName:  "My_Tap",
+			sender:   kokotapSenderArgs{Node: "kube-node.1", IFName: "mirror0"},
+			node:     "kube-master",
+			want:     "kokotap-my-tap-host-kube-node-1-sender",
+			receiver: "kokotap-my-tap-receiver-mirror0-kube-master",
+		},
+	}
+
+	for _, tt := range tests {
+		podargs := &kokotapPodArgs{Name: tt.tapName}
+		podargs.Receiver.Node = tt.node
+		sender := podargs.GenerateSenderPodName(&tt.sender)
+		receiver := podargs.GenerateReceiverPodName(&tt.sender)
+		if sender != tt.want {
+			t.Errorf("%q: sender pod name = %q, want %q", tt.tapName, sender, tt.want)
+		}
+		if receiver != tt.receiver {
+			t.Errorf("%q: receiver pod name = %q, want %q", tt.tapName, receiver, tt.receiver)
+		}
+		for _, name := range []string{sender, receiver} {
+			if len(name) > 61 || !dnsSubdomain.MatchString(name) {
+				t.Errorf("%q: invalid pod name %q", tt.tapName, name)
+			}
+		}
+	}
+}
+
+func TestSenderPodNameUnique(t *testing.T) {
+	tests := []struct {
+		tapName string
+		pods    []string
+	}{
+		{
+			tapName: "deployment/frontend",
+			pods: []string{
+				"frontend-service-deployment-5d8f7c9b4-x7k2p",
+				"frontend-service-deployment-5d8f7c9b4-q9zzt",
+			},
+		},
+		{
+			tapName: "frontend-service-deployment-5d8f7c9b4-x7k2p",
+			pods: []string{
+				"frontend-service-deployment-5d8f7c9b4-x7k2p",
+				"frontend-service-deployment-5d8f7c9b4-q9zzt",
+			},
+		},
+		{
+			tapName: "app.kubernetes.io/name=frontend-service",
+			pods: []string{
+				"kube-system/frontend-service-statefulset-with-a-long-name-0",
+				"kube-system/frontend-service-statefulset-with-a-long-name-1",
+				"default/frontend-service-statefulset-with-a-long-name-0",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		podargs := &kokotapPodArgs{Name: tt.tapName}
+		names := map[string]string{}
+		for _, pod := range tt.pods {
+			name := podargs.GenerateSenderPodName(&kokotapSenderArgs{PodName: pod})
+			if len(name) > 61 || !dnsSubdomain.MatchString(name) || !strings.HasSuffix(name, "-sender") {
+				t.Errorf("%q: invalid sender pod name %q of %q", tt.tapName, name, pod)
+			}
+			if other, ok := names[name]; ok {
+				t.Errorf("%q: same sender pod name %q of %q and %q", tt.tapName, name, other, pod)
+			}
+			names[name] = pod
+			if again := podargs.GenerateSenderPodName(&kokotapSenderArgs{PodName: pod}); again != name {
+				t.Errorf("%q: sender pod name of %q changed: %q, %q", tt.tapName, pod, name, again)
+			}
+		}
+	}
+}
+
+func TestReceiverPodNameUnique(t *testing.T) {
+	tests := []struct {
+		tapName string
+		node    string
+	}{
+		{tapName: "app=web", node: "kube-master"},
+		{tapName: "app.kubernetes.io/name=frontend-service", node: "kube-master"},
+		{tapName: "app.kubernetes.io/name=frontend-service", node: "ip-10-0-0-1.ec2.internal"},
+	}
+
+	for _, tt := range tests {
+		podargs := &kokotapPodArgs{Name: tt.tapName}
+		podargs.Receiver.Node = tt.node
+		names := map[string]string{}
+		for idx := 0; idx < 12; idx++ {
+			sender := &kokotapSenderArgs{IFName: receiverIFName("mirror", idx, true)}
+			name := podargs.GenerateReceiverPodName(sender)
+			if len(name) > 61 || !dnsSubdomain.MatchString(name) {
+				t.Errorf("%q: invalid receiver pod name %q of %q", tt.tapName, name, sender.IFName)
+			}
+			if other, ok := names[name]; ok {
+				t.Errorf("%q: same receiver pod name %q of %q and %q", tt.tapName, name, other, sender.IFName)
+			}
+			names[name] = sender.IFName
+		}
+	}
+}
+
+func TestEncapID(t *testing.T) {
+	tests := []struct {
+		name       string
+		encap      string
+		vxlanID    int
+		vxlanIDSet bool
+		vlanID     int
+		parentIF   string
+		want       int
+		wantErr    bool
+	}{
+		{name: "vxlan", encap: "vxlan", vxlanID: 100, vxlanIDSet: true, want: 100},
+		{name: "vxlan id 0", encap: "vxlan", vxlanID: 0, vxlanIDSet: true, want: 0},
+		{name: "vxlan without id", encap: "vxlan", wantErr: true},
+		{name: "gretap key", encap: "gretap", vxlanID: 7, vxlanIDSet: true, want: 7},
+		{name: "vlan", encap: "vlan", vlanID: 100, parentIF: "eth1", want: 100},
+		{name: "vlan ignores vxlan-id", encap: "vlan", vxlanID: 5, vxlanIDSet: true, vlanID: 4094, parentIF: "eth1", want: 4094},
+		{name: "vlan id 0", encap: "vlan", parentIF: "eth1", wantErr: true},
+		{name: "vlan id 4095", encap: "vlan", vlanID: 4095, parentIF: "eth1", wantErr: true},
+		{name: "vlan without parent", encap: "vlan", vlanID: 100, wantErr: true},
+		{name: "macvlan", encap: "macvlan", parentIF: "eth1", want: 0},
+		{name: "macvlan without parent", encap: "macvlan", wantErr: true},
+		{name: "veth", encap: "veth", want: 0},
+	}
+
+	for _, tt := range tests {
+		id, err := encapID(tt.encap, tt.vxlanID, tt.vxlanIDSet, tt.vlanID, tt.parentIF)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if err == nil && id != tt.want {
+			t.Errorf("%s: id = %d, want %d", tt.name, id, tt.want)
+		}
+	}
+}
+
+func TestParseKokoTapArgsFollow(t *testing.T) {
+	tests := []struct {
+		name string
+		args kokotapArgs
+	}{
+		{name: "pod", args: kokotapArgs{Pod: "web-0", Encap: "vxlan", Encrypt: "none"}},
+		{name: "peer pod", args: kokotapArgs{Selector: "app=web", PeerPods: []string{"db-0"}, Encap: "vxlan", Encrypt: "none"}},
+		{name: "geneve", args: kokotapArgs{Selector: "app=web", Encap: "geneve", Encrypt: "none"}},
+		{name: "ipsec", args: kokotapArgs{Deployment: "web", Encap: "vxlan", Encrypt: "ipsec"}},
+		{name: "ipsec node-wide", args: kokotapArgs{AllPodsOnNode: "kube-node-1", Encap: "vxlan", Encrypt: "ipsec"}},
+	}
+
+	for _, tt := range tests {
+		// refused before the targets are looked up
+		clients := &tapClients{target: &fakeKubeClient{}, dest: &fakeKubeClient{}}
+		tt.args.Follow = true
+		podargs := &kokotapPodArgs{}
+		if err := podargs.ParseKokoTapArgs(clients, &tt.args); err == nil {
+			t.Errorf("%s: no error for follow", tt.name)
+		}
+	}
+}
+
+func TestRuntimeSocket(t *testing.T) {
+	tests := []struct {
+		name        string
+		podargs     kokotapPodArgs
+		hostNetwork bool
+		containerID string
+		want        string
+		wantErr     bool
+	}{
+		{name: "containerd", containerID: "containerd://1111", want: runtimeSockets["containerd"]},
+		{name: "cri-o", containerID: "cri-o://1111", want: runtimeSockets["cri-o"]},
+		{name: "unknown runtime", containerID: "rkt://1111", wantErr: true},
+		{name: "not started", containerID: "", wantErr: true},
+		{name: "no runtime", containerID: "1111", wantErr: true},
+		{name: "given socket", podargs: kokotapPodArgs{RuntimeSocket: "/run/foo.sock"}, containerID: "", want: "/run/foo.sock"},
+		{name: "proc", podargs: kokotapPodArgs{NetnsDiscovery: "proc"}, containerID: "", want: ""},
+		{name: "host network", hostNetwork: true, containerID: "", want: ""},
+	}
+
+	for _, tt := range tests {
+		pod := newFakePod("default", "web-0")
+		pod.Spec.HostNetwork = tt.hostNetwork
+		socket, err := tt.podargs.runtimeSocket(pod, tt.containerID)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if err == nil && socket != tt.want {
+			t.Errorf("%s: socket = %q, want %q", tt.name, socket, tt.want)
+		}
+	}
+}
+
+func TestParseKokoTapArgsDestNode(t *testing.T) {
+	target := &fakeKubeClient{nodes: map[string]*v1.Node{
+		"kube-node-1": newFakeNode("kube-node-1", "10.0.0.2", ""),
+		"kube-master": newFakeNode("kube-master", "10.0.0.1", "192.0.2.1"),
+	}}
+	dest := &fakeKubeClient{nodes: map[string]*v1.Node{
+		"kube-master": newFakeNode("kube-master", "172.16.0.1", "192.0.2.11"),
+		"kube-edge":   newFakeNode("kube-edge", "", "192.0.2.12"),
+	}}
+	tests := []struct {
+		name      string
+		clients   *tapClients
+		destNode  string
+		encap     string
+		node      string
+		egressIP  string
+		destIP    string
+		namespace string
+		wantErr   bool
+	}{
+		{name: "same cluster", clients: &tapClients{target: target, dest: target, destNamespace: "default"},
+			destNode: "kube-master", encap: "vxlan", node: "kube-master", egressIP: "10.0.0.1", destIP: "10.0.0.1"},
+		{name: "vlan", clients: &tapClients{target: target, dest: target, destNamespace: "default"},
+			destNode: "kube-master", encap: "vlan", node: "kube-master", egressIP: "10.0.0.1", destIP: ""},
+		{name: "dest cluster", clients: &tapClients{target: target, dest: dest, destNamespace: "capture"},
+			destNode: "kube-master", encap: "gretap", node: "kube-master", egressIP: "172.16.0.1", destIP: "192.0.2.11", namespace: "capture"},
+		{name: "no internal IP", clients: &tapClients{target: target, dest: dest, destNamespace: "capture"},
+			destNode: "kube-edge", encap: "vxlan", node: "kube-edge", egressIP: "192.0.2.12", destIP: "192.0.2.12", namespace: "capture"},
+		{name: "unknown node", clients: &tapClients{target: target, dest: dest, destNamespace: "capture"},
+			destNode: "kube-node-1", encap: "vxlan", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		args := &kokotapArgs{
+			Node: "kube-node-1", NodeIFName: "bond0", Namespace: "default", IFName: "mirror",
+			DestNode: tt.destNode, MirrorType: "both", Encap: tt.encap, VxlanID: 100, VxlanIDSet: true, VlanID: 100,
+			ParentIF: "eth1", Encrypt: "none",
+		}
+		podargs := &kokotapPodArgs{}
+		err := podargs.ParseKokoTapArgs(tt.clients, args)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if podargs.Receiver.Node != tt.node || podargs.Receiver.VxlanEgressIP != tt.egressIP ||
+			podargs.DestIP != tt.destIP || podargs.Receiver.Namespace != tt.namespace {
+			t.Errorf("%s: receiver = %q %q %q (dest IP %q), want %q %q %q (dest IP %q)", tt.name,
+				podargs.Receiver.Node, podargs.Receiver.VxlanEgressIP, podargs.Receiver.Namespace, podargs.DestIP,
+				tt.node, tt.egressIP, tt.namespace, tt.destIP)
+		}
+	}
+}
+
+// testKubeConfig has two contexts of the same cluster (by other server URLs)
+// and a context of other cluster.
+const testKubeConfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: cluster-a
+  cluster:
+    server: https://10.0.0.1:6443
+- name: cluster-a-admin
+  cluster:
+    server: https://10.0.0.1:6443/
+- name: cluster-b
+  cluster:
+    server: https://10.0.1.1:6443
+users:
+- name: user
+  user:
+    token: secret
+- name: admin
+  user:
+    token: admin-secret
+contexts:
+- name: ctx-a
+  context: {cluster: cluster-a, user: user, namespace: default}
+- name: ctx-a-admin
+  context: {cluster: cluster-a-admin, user: user, namespace: kube-system}
+- name: ctx-b
+  context: {cluster: cluster-b, user: user, namespace: capture}
+current-context: ctx-a
+`
+
+func TestNewTapClients(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kokotap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kubeconfig := filepath.Join(dir, "config")
+	if err = ioutil.WriteFile(kubeconfig, []byte(testKubeConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		destContext   string
+		destNamespace string
+		multiCluster  bool
+		wantNamespace string
+		wantErr       bool
+	}{
+		{name: "no dest", wantNamespace: "default"},
+		{name: "same cluster", destContext: "ctx-a-admin", wantNamespace: "default"},
+		{name: "same cluster in target namespace", destContext: "ctx-a-admin", destNamespace: "default", wantNamespace: "default"},
+		{name: "same cluster in other namespace", destContext: "ctx-a-admin", destNamespace: "capture", wantErr: true},
+		{name: "other cluster", destContext: "ctx-b", multiCluster: true, wantNamespace: "capture"},
+		{name: "other cluster in namespace", destContext: "ctx-b", destNamespace: "mirror", multiCluster: true, wantNamespace: "mirror"},
+		{name: "unknown context", destContext: "ctx-c", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		args := &kokotapArgs{KubeConfig: kubeconfig, DestContext: tt.destContext, DestNamespace: tt.destNamespace}
+		clients, err := newTapClients(args)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if clients.isMultiCluster() != tt.multiCluster || clients.destNamespace != tt.wantNamespace {
+			t.Errorf("%s: multi cluster = %v, dest namespace = %q, want %v, %q", tt.name,
+				clients.isMultiCluster(), clients.destNamespace, tt.multiCluster, tt.wantNamespace)
+		}
+	}
+}
+
+func TestLoadKubeClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kokotap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kubeconfig := filepath.Join(dir, "config")
+	if err = ioutil.WriteFile(kubeconfig, []byte(testKubeConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		kubeconfig    string
+		context       string
+		cluster       string
+		user          string
+		namespace     string
+		wantNamespace string
+		wantHost      string
+		wantToken     string
+		wantErr       bool
+	}{
+		{name: "current context", wantNamespace: "default", wantHost: "https://10.0.0.1:6443", wantToken: "secret"},
+		{name: "context", context: "ctx-b", wantNamespace: "capture", wantHost: "https://10.0.1.1:6443", wantToken: "secret"},
+		{name: "namespace", context: "ctx-b", namespace: "web", wantNamespace: "web", wantHost: "https://10.0.1.1:6443", wantToken: "secret"},
+		{name: "cluster", cluster: "cluster-b", wantNamespace: "default", wantHost: "https://10.0.1.1:6443", wantToken: "secret"},
+		{name: "user", user: "admin", wantNamespace: "default", wantHost: "https://10.0.0.1:6443", wantToken: "admin-secret"},
+		{name: "unknown context", context: "ctx-c", wantErr: true},
+		{name: "no kubeconfig", kubeconfig: filepath.Join(dir, "nothing"), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		if tt.kubeconfig == "" {
+			tt.kubeconfig = kubeconfig
+		}
+		namespace := tt.namespace
+		_, clientConfig, err := loadKubeClient(tt.kubeconfig, tt.context, tt.cluster, tt.user, &namespace)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if namespace != tt.wantNamespace {
+			t.Errorf("%s: namespace = %q, want %q", tt.name, namespace, tt.wantNamespace)
+		}
+		config, err := clientConfig.ClientConfig()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if config.Host != tt.wantHost || config.BearerToken != tt.wantToken {
+			t.Errorf("%s: host = %q, token = %q, want %q, %q", tt.name,
+				config.Host, config.BearerToken, tt.wantHost, tt.wantToken)
+		}
+	}
+
+	// neither kubeconfig nor in-cluster config
+	defer os.Setenv("KUBECONFIG", os.Getenv("KUBECONFIG"))
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("KUBECONFIG", filepath.Join(dir, "nothing"))
+	os.Setenv("HOME", dir)
+	namespace := ""
+	if _, _, err := loadKubeClient("", "", "", "", &namespace); err == nil || !strings.Contains(err.Error(), "no kubeconfig") {
+		t.Errorf("empty config: unexpected error: %v", err)
+	}
+}
+
+func TestParseKokoTapArgsErspan(t *testing.T) {
+	target := &fakeKubeClient{nodes: map[string]*v1.Node{
+		"kube-node-1": newFakeNode("kube-node-1", "10.0.0.2", ""),
+		"kube-master": newFakeNode("kube-master", "10.0.0.1", ""),
+	}}
+	tests := []struct {
+		name     string
+		version  int
+		dir      string
+		id       int
+		wantArgs []string
+		wantErr  bool
+	}{
+		{name: "type II", version: 1, id: 100,
+			wantArgs: []string{"--encap=erspan", "--vxlan-id=100", "--erspan-version=1"}},
+		{name: "type III", version: 2, dir: "egress", id: 100,
+			wantArgs: []string{"--encap=erspan", "--erspan-version=2", "--erspan-dir=egress"}},
+		{name: "max session ID", version: 1, id: 1023, wantArgs: []string{"--vxlan-id=1023"}},
+		{name: "session ID out of range", version: 1, id: 1024, wantErr: true},
+		{name: "unknown version", version: 3, id: 100, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		args := &kokotapArgs{
+			Node: "kube-node-1", NodeIFName: "bond0", Namespace: "default", IFName: "mirror",
+			DestNode: "kube-master", MirrorType: "both", Encap: "erspan", VxlanID: tt.id, VxlanIDSet: true,
+			ErspanVersion: tt.version, ErspanDir: tt.dir, Encrypt: "none",
+		}
+		podargs := &kokotapPodArgs{}
+		clients := &tapClients{target: target, dest: target, destNamespace: "default"}
+		err := podargs.ParseKokoTapArgs(clients, args)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		pods, err := podargs.GeneratePods()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(pods) != 2 {
+			t.Errorf("%s: %d pods, want sender and receiver", tt.name, len(pods))
+			continue
+		}
+		for _, pod := range pods {
+			podArgs := strings.Join(pod.Spec.Containers[0].Args, " ")
+			for _, want := range tt.wantArgs {
+				// the direction is of the sender only
+				if strings.HasPrefix(want, "--erspan-dir") && pod.Labels[tapRoleLabel] == tapRoleReceiver {
+					continue
+				}
+				if !strings.Contains(podArgs, want) {
+					t.Errorf("%s: %q is not in %s args %q", tt.name, want, pod.Labels[tapRoleLabel], podArgs)
+				}
+			}
+		}
+	}
+}
+
+func TestParseKokoTapArgsVeth(t *testing.T) {
+	analyzer := newFakePod("default", "analyzer")
+	analyzer.UID = "1111-2222"
+	analyzer.Spec.NodeName = "kube-node-1"
+	analyzer.Status.Phase = v1.PodRunning
+	analyzer.Status.ContainerStatuses = []v1.ContainerStatus{{Name: "wireshark", ContainerID: "containerd://abcd"}}
+	pending := newFakePod("default", "pending")
+	pending.Status.Phase = v1.PodPending
+	target := &fakeKubeClient{
+		nodes: map[string]*v1.Node{
+			"kube-node-1": newFakeNode("kube-node-1", "10.0.0.2", ""),
+			"kube-master": newFakeNode("kube-master", "10.0.0.1", ""),
+		},
+		pods: map[string]*v1.Pod{"default/analyzer": analyzer, "default/pending": pending},
+	}
+	dest := &fakeKubeClient{nodes: target.nodes}
+
+	tests := []struct {
+		name     string
+		clients  *tapClients
+		encap    string
+		destNode string
+		destPod  string
+		destIP   net.IP
+		wantArgs []string
+		wantErr  bool
+	}{
+		{name: "host", encap: "veth",
+			wantArgs: []string{"--encap=veth", "--dest-ifname=mirror0"}},
+		{name: "dest node", encap: "veth", destNode: "kube-node-1",
+			wantArgs: []string{"--encap=veth", "--dest-ifname=mirror0"}},
+		{name: "dest pod", encap: "veth", destPod: "analyzer",
+			wantArgs: []string{"--dest-containerid=containerd://abcd", "--dest-pod-uid=1111-2222"}},
+		{name: "other node", encap: "veth", destNode: "kube-master", wantErr: true},
+		{name: "dest pod not running", encap: "veth", destPod: "pending", wantErr: true},
+		{name: "dest pod of vxlan", encap: "vxlan", destPod: "analyzer", wantErr: true},
+		{name: "dest pod and node", encap: "veth", destPod: "analyzer", destNode: "kube-node-1", wantErr: true},
+		{name: "dest ip", encap: "veth", destIP: net.ParseIP("10.0.0.1"), wantErr: true},
+		{name: "dest cluster", clients: &tapClients{target: target, dest: dest, destNamespace: "capture"},
+			encap: "veth", destNode: "kube-node-1", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		clients := tt.clients
+		if clients == nil {
+			clients = &tapClients{target: target, dest: target, destNamespace: "default"}
+		}
+		args := &kokotapArgs{
+			Node: "kube-node-1", NodeIFName: "bond0", Namespace: "default", IFName: "mirror",
+			DestNode: tt.destNode, DestPod: tt.destPod, DestIP: tt.destIP, MirrorType: "both",
+			Encap: tt.encap, VxlanID: 100, VxlanIDSet: true, Encrypt: "none",
+		}
+		podargs := &kokotapPodArgs{}
+		err := podargs.ParseKokoTapArgs(clients, args)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if podargs.DestIP != "" {
+			t.Errorf("%s: dest IP is %q", tt.name, podargs.DestIP)
+		}
+		// the sender delivers by veth, without receiver
+		pods, err := podargs.GeneratePods()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(pods) != 1 || pods[0].Labels[tapRoleLabel] != tapRoleSender {
+			t.Errorf("%s: %d pods, want sender only", tt.name, len(pods))
+			continue
+		}
+		podArgs := strings.Join(pods[0].Spec.Containers[0].Args, " ")
+		for _, want := range tt.wantArgs {
+			if !strings.Contains(podArgs, want) {
+				t.Errorf("%s: %q is not in sender args %q", tt.name, want, podArgs)
+			}
+		}
+	}
+}
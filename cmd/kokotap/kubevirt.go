@@ -0,0 +1,190 @@
+// Copyright 2018 Red Hat
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+/*
+ * kokotap: resolve KubeVirt VMI interface
+ *
+ * The VMI runs in virt-launcher pod, and the guest NIC (bridge or masquerade
+ * binding) is the tap device in the pod network namespace, connected to pod
+ * interface through bridge 'k6t-<pod interface>'. KubeVirt names the tap
+ * device 'tap' + pod interface name without its 3 letter prefix (e.g. eth0
+ * -> tap0, net1 -> tap1), so kokotap mirrors the tap device to capture the
+ * traffic of the VM instead of the pod.
+ */
+import (
+	"encoding/json"
+	"fmt"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strings"
+)
+
+// kubevirtVersions are API versions of VirtualMachineInstance, tried in order
+var kubevirtVersions = []string{"v1", "v1alpha3"}
+
+// vmiCreatedByLabel is the label of virt-launcher pod which has VMI UID
+const vmiCreatedByLabel = "kubevirt.io/created-by"
+
+// vmiComputeContainer is the container of virt-launcher pod which runs VMI
+const vmiComputeContainer = "compute"
+
+// vmiDefaultInterface is the interface name of the VMI which has no
+// interface in its spec (KubeVirt adds it to pod network).
+const vmiDefaultInterface = "default"
+
+// vmiInterface is an interface of VMI domain devices.
+type vmiInterface struct {
+	Name       string    `json:"name"`
+	Bridge     *struct{} `json:"bridge"`
+	Masquerade *struct{} `json:"masquerade"`
+}
+
+// vmiNetwork is a network of VMI, which backs the interface of same name.
+type vmiNetwork struct {
+	Name   string    `json:"name"`
+	Pod    *struct{} `json:"pod"`
+	Multus *struct {
+		NetworkName string `json:"networkName"`
+		Default     bool   `json:"default"`
+	} `json:"multus"`
+}
+
+// virtualMachineInstance is the fields of VirtualMachineInstance used by
+// kokotap.
+type virtualMachineInstance struct {
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              struct {
+		Domain struct {
+			Devices struct {
+				Interfaces []vmiInterface `json:"interfaces"`
+			} `json:"devices"`
+		} `json:"domain"`
+		Networks []vmiNetwork `json:"networks"`
+	} `json:"spec"`
+	Status struct {
+		NodeName   string `json:"nodeName"`
+		Interfaces []struct {
+			Name             string `json:"name"`
+			PodInterfaceName string `json:"podInterfaceName"`
+		} `json:"interfaces"`
+	} `json:"status"`
+}
+
+// getVMI returns the VirtualMachineInstance.
+func getVMI(kubeClient kubeClient, namespace, name string) (*virtualMachineInstance, error) {
+	var raw []byte
+	var err error
+	for _, version := range kubevirtVersions {
+		raw, err = kubeClient.GetRawWithPath(fmt.Sprintf(
+			"/apis/kubevirt.io/%s/namespaces/%s/virtualmachineinstances/%s", version, namespace, name))
+		if !apierrors.IsNotFound(err) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get vmi %q: %v", name, err)
+	}
+
+	vmi := &virtualMachineInstance{}
+	if err := json.Unmarshal(raw, vmi); err != nil {
+		return nil, fmt.Errorf("failed to parse vmi %q: %v", name, err)
+	}
+	return vmi, nil
+}
+
+// getVMIPods returns the virt-launcher pods of the VMI. While the VMI is
+// migrating, only the pod on the node of the VMI is returned.
+func getVMIPods(kubeClient kubeClient, namespace, name string) ([]v1.Pod, error) {
+	vmi, err := getVMI(kubeClient, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	podList, err := kubeClient.ListPods(namespace, vmiCreatedByLabel+"="+string(vmi.UID))
+	if err != nil {
+		return nil, err
+	}
+
+	pods := []v1.Pod{}
+	for _, pod := range podList.Items {
+		if vmi.Status.NodeName == "" || pod.Spec.NodeName == vmi.Status.NodeName {
+			pods = append(pods, pod)
+		}
+	}
+	return pods, nil
+}
+
+// vmiPodInterface returns the pod interface name which backs the network of
+// the VMI interface.
+func (vmi *virtualMachineInstance) vmiPodInterface(pod *v1.Pod, network *vmiNetwork) (string, error) {
+	for _, status := range vmi.Status.Interfaces {
+		if status.Name == network.Name && status.PodInterfaceName != "" {
+			return status.PodInterfaceName, nil
+		}
+	}
+	if network.Pod != nil || (network.Multus != nil && network.Multus.Default) {
+		return "eth0", nil
+	}
+	if network.Multus == nil {
+		return "", fmt.Errorf("network %q of vmi %q is neither pod nor multus network",
+			network.Name, vmi.Name)
+	}
+	return getNetworkInterface(pod, network.Multus.NetworkName)
+}
+
+// getVMITapInterface returns the tap device name in virt-launcher pod, which
+// backs the VMI interface (the first interface if ifName is empty).
+func (vmi *virtualMachineInstance) getVMITapInterface(pod *v1.Pod, ifName string) (string, error) {
+	interfaces := vmi.Spec.Domain.Devices.Interfaces
+	if len(interfaces) == 0 {
+		if ifName != "" && ifName != vmiDefaultInterface {
+			return "", fmt.Errorf("no interface %q in vmi %q", ifName, vmi.Name)
+		}
+		return "tap0", nil
+	}
+
+	var iface *vmiInterface
+	candidates := []string{}
+	for i := range interfaces {
+		candidates = append(candidates, interfaces[i].Name)
+		if iface == nil && (ifName == "" || interfaces[i].Name == ifName) {
+			iface = &interfaces[i]
+		}
+	}
+	if iface == nil {
+		return "", fmt.Errorf("no interface %q in vmi %q (interfaces: %s)",
+			ifName, vmi.Name, strings.Join(candidates, ", "))
+	}
+	if iface.Bridge == nil && iface.Masquerade == nil {
+		return "", fmt.Errorf("interface %q of vmi %q has no tap device (only bridge or masquerade binding is supported)",
+			iface.Name, vmi.Name)
+	}
+
+	for i := range vmi.Spec.Networks {
+		if vmi.Spec.Networks[i].Name != iface.Name {
+			continue
+		}
+		podIFName, err := vmi.vmiPodInterface(pod, &vmi.Spec.Networks[i])
+		if err != nil {
+			return "", err
+		}
+		if len(podIFName) <= 3 {
+			return "", fmt.Errorf("unexpected pod interface %q for interface %q of vmi %q",
+				podIFName, iface.Name, vmi.Name)
+		}
+		return "tap" + podIFName[3:], nil
+	}
+	return "", fmt.Errorf("no network %q in vmi %q", iface.Name, vmi.Name)
+}
@@ -0,0 +1,74 @@
+// Copyright 2018 Red Hat
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	v1 "k8s.io/api/core/v1"
+	"testing"
+)
+
+func TestGetVMITapInterface(t *testing.T) {
+	pod := &v1.Pod{}
+	pod.Namespace, pod.Name = "default", "virt-launcher-vm1-abcde"
+	pod.Annotations = map[string]string{
+		networkStatusAnnotations[0]: `[{"name":"default/br-net","interface":"net1"}]`,
+	}
+	spec := `{"metadata":{"name":"vm1"},"spec":{
+		"domain":{"devices":{"interfaces":[
+			{"name":"default","masquerade":{}},
+			{"name":"secondary","bridge":{}},
+			{"name":"third","bridge":{}},
+			{"name":"sriov","sriov":{}}]}},
+		"networks":[
+			{"name":"default","pod":{}},
+			{"name":"secondary","multus":{"networkName":"br-net"}},
+			{"name":"third","multus":{"networkName":"other-net"}},
+			{"name":"sriov","multus":{"networkName":"sriov-net"}}]},
+		"status":{"interfaces":[{"name":"third","podInterfaceName":"pod7a2b"}]}}`
+
+	tests := []struct {
+		name    string
+		vmi     string
+		ifName  string
+		want    string
+		wantErr bool
+	}{
+		{name: "first interface", vmi: spec, want: "tap0"},
+		{name: "pod network", vmi: spec, ifName: "default", want: "tap0"},
+		{name: "multus network", vmi: spec, ifName: "secondary", want: "tap1"},
+		{name: "pod interface in status", vmi: spec, ifName: "third", want: "tap7a2b"},
+		{name: "sriov binding", vmi: spec, ifName: "sriov", wantErr: true},
+		{name: "no such interface", vmi: spec, ifName: "fourth", wantErr: true},
+		{name: "no interface in spec", vmi: `{"metadata":{"name":"vm1"}}`, want: "tap0"},
+		{name: "no interface in spec by name", vmi: `{"metadata":{"name":"vm1"}}`, ifName: "secondary", wantErr: true},
+		{name: "no network", vmi: `{"metadata":{"name":"vm1"},"spec":{"domain":{"devices":{"interfaces":[
+			{"name":"default","bridge":{}}]}}}}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		vmi := &virtualMachineInstance{}
+		if err := json.Unmarshal([]byte(tt.vmi), vmi); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		tap, err := vmi.getVMITapInterface(pod, tt.ifName)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if err == nil && tap != tt.want {
+			t.Errorf("%s: tap = %q, want %q", tt.name, tap, tt.want)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+// Copyright 2018 Red Hat
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+/*
+ * kokotap: list/describe taps in kubernetes cluster
+ */
+import (
+	"fmt"
+	v1 "k8s.io/api/core/v1"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// tapInfo is a tap found in the cluster, built from its pods' metadata.
+type tapInfo struct {
+	Name      string
+	Namespace string
+	Pods      []v1.Pod
+}
+
+// annotation returns the annotation of the tap. Values of the pods
+// (comma-separated) are merged without duplicates.
+func (tap *tapInfo) annotation(key string) string {
+	values := []string{}
+	found := map[string]bool{}
+	for _, pod := range tap.Pods {
+		val, ok := pod.Annotations[key]
+		if !ok || val == "" {
+			continue
+		}
+		for _, v := range strings.Split(val, ",") {
+			if !found[v] {
+				found[v] = true
+				values = append(values, v)
+			}
+		}
+	}
+	return strings.Join(values, ",")
+}
+
+// target returns the tap target, as namespace/kind/name, namespace/selector
+// or namespace/pods.
+func (tap *tapInfo) target() string {
+	if workload := tap.annotation(tapTargetWorkloadAnnotation); workload != "" {
+		return fmt.Sprintf("%s/%s", tap.annotation(tapTargetNSAnnotation), workload)
+	}
+	if selector := tap.annotation(tapTargetSelectorAnnotation); selector != "" {
+		return fmt.Sprintf("%s/%s", tap.annotation(tapTargetNSAnnotation), selector)
+	}
+	return fmt.Sprintf("%s/%s", tap.annotation(tapTargetNSAnnotation),
+		tap.annotation(tapTargetPodAnnotation))
+}
+
+// roleStatus returns the status of the pods of given role.
+func (tap *tapInfo) roleStatus(role string) string {
+	status := ""
+	for _, pod := range tap.Pods {
+		if pod.Labels[tapRoleLabel] != role {
+			continue
+		}
+		if status != "" {
+			status += ","
+		}
+		status += podStatus(&pod)
+	}
+	if status == "" {
+		return "<none>"
+	}
+	return status
+}
+
+// destination returns the dest-node of the tap (with dest context if it is
+// in other cluster), or dest-ip if no dest-node. vlan/macvlan tap without
+// dest-node sends to the network of parent-if (e.g. 'vlan:ens2f1'), and veth
+// tap to the node of each target.
+func (tap *tapInfo) destination() string {
+	node := tap.annotation(tapDestNodeAnnotation)
+	if node == "" {
+		if parentIF := tap.annotation(tapParentIFAnnotation); parentIF != "" {
+			return tap.annotation(tapEncapAnnotation) + ":" + parentIF
+		}
+		if tap.annotation(tapEncapAnnotation) == "veth" {
+			return "veth"
+		}
+		return tap.annotation(tapDestIPAnnotation)
+	}
+	if context := tap.annotation(tapDestContextAnnotation); context != "" {
+		return context + "/" + node
+	}
+	return node
+}
+
+// podStatus returns a short status of the pod, as 'kubectl get pod' shows.
+func podStatus(pod *v1.Pod) string {
+	if pod.DeletionTimestamp != nil {
+		return "Terminating"
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.State.Waiting != nil && status.State.Waiting.Reason != "" {
+			return status.State.Waiting.Reason
+		}
+		if status.State.Terminated != nil && status.State.Terminated.Reason != "" {
+			return status.State.Terminated.Reason
+		}
+	}
+	if pod.Status.Reason != "" {
+		return pod.Status.Reason
+	}
+	return string(pod.Status.Phase)
+}
+
+// tapNamespace returns the namespace of the tap which has the pod. Receiver
+// pods in dest cluster may be in other namespace, so the target namespace is
+// the tap namespace.
+func tapNamespace(pod *v1.Pod) string {
+	if namespace := pod.Annotations[tapTargetNSAnnotation]; namespace != "" {
+		return namespace
+	}
+	return pod.Namespace
+}
+
+// listTapPods lists kokotap pods in namespace (all namespaces if namespace
+// is empty) of target cluster, and receiver pods of the taps in dest
+// cluster.
+func listTapPods(clients *tapClients, namespace, selector string) ([]v1.Pod, error) {
+	podList, err := clients.target.ListPods(namespace, selector)
+	if err != nil {
+		return nil, err
+	}
+	pods := podList.Items
+	if !clients.isMultiCluster() {
+		return pods, nil
+	}
+
+	destNamespace := clients.destNamespace
+	if namespace == "" {
+		destNamespace = ""
+	}
+	destList, err := clients.dest.ListPods(destNamespace, selector)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods in dest cluster: %v", err)
+	}
+	for _, pod := range destList.Items {
+		if namespace == "" || tapNamespace(&pod) == namespace {
+			pods = append(pods, pod)
+		}
+	}
+	return pods, nil
+}
+
+// getTaps finds the taps by kokotap pods in namespace (all namespaces if
+// namespace is empty). If tapName is given, only the tap is returned.
+func getTaps(clients *tapClients, namespace, tapName string) ([]*tapInfo, error) {
+	selector := tapLabel
+	if tapName != "" {
+		selector = tapSelector(tapName)
+	}
+	pods, err := listTapPods(clients, namespace, selector)
+	if err != nil {
+		return nil, err
+	}
+
+	tapMap := map[string]*tapInfo{}
+	taps := []*tapInfo{}
+	for _, pod := range pods {
+		key := tapNamespace(&pod) + "/" + pod.Labels[tapLabel]
+		tap, ok := tapMap[key]
+		if !ok {
+			tap = &tapInfo{Name: pod.Labels[tapLabel], Namespace: tapNamespace(&pod)}
+			tapMap[key] = tap
+			taps = append(taps, tap)
+		}
+		tap.Pods = append(tap.Pods, pod)
+	}
+
+	sort.Slice(taps, func(i, j int) bool {
+		if taps[i].Namespace != taps[j].Namespace {
+			return taps[i].Namespace < taps[j].Namespace
+		}
+		return taps[i].Name < taps[j].Name
+	})
+	for _, tap := range taps {
+		sort.Slice(tap.Pods, func(i, j int) bool {
+			return tap.Pods[i].Name < tap.Pods[j].Name
+		})
+	}
+	return taps, nil
+}
+
+// listTaps shows the taps in all namespaces.
+func listTaps(clients *tapClients) error {
+	taps, err := getTaps(clients, "", "")
+	if err != nil {
+		return err
+	}
+	if len(taps) == 0 {
+		fmt.Fprintf(os.Stderr, "No taps found.\n")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tTAP\tTARGET\tIFNAME\tMIRROR\tVNI\tDESTINATION\tSENDER\tRECEIVER")
+	for _, tap := range taps {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			tap.Namespace, tap.Name, tap.target(),
+			tap.annotation(tapTargetIFNameAnnotation),
+			tap.annotation(tapMirrorTypeAnnotation),
+			tap.annotation(tapVxlanIDAnnotation),
+			tap.destination(),
+			tap.roleStatus(tapRoleSender),
+			tap.roleStatus(tapRoleReceiver))
+	}
+	return w.Flush()
+}
+
+// describeTap shows the detail of the tap in namespace.
+func describeTap(clients *tapClients, namespace, tapName string) error {
+	taps, err := getTaps(clients, namespace, tapName)
+	if err != nil {
+		return err
+	}
+	if len(taps) == 0 {
+		return fmt.Errorf("no tap %q in namespace %q", tapName, namespace)
+	}
+	tap := taps[0]
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	fmt.Fprintf(w, "Name:\t%s\n", tap.Name)
+	fmt.Fprintf(w, "Namespace:\t%s\n", tap.Namespace)
+	fmt.Fprintf(w, "Target Pod:\t%s\n", tap.annotation(tapTargetPodAnnotation))
+	fmt.Fprintf(w, "Target Namespace:\t%s\n", tap.annotation(tapTargetNSAnnotation))
+	fmt.Fprintf(w, "Target Selector:\t%s\n", tap.annotation(tapTargetSelectorAnnotation))
+	fmt.Fprintf(w, "Target Workload:\t%s\n", tap.annotation(tapTargetWorkloadAnnotation))
+	fmt.Fprintf(w, "Target Interface:\t%s\n", tap.annotation(tapTargetIFNameAnnotation))
+	fmt.Fprintf(w, "Target Network:\t%s\n", tap.annotation(tapTargetNetworkAnnotation))
+	fmt.Fprintf(w, "Mirror Type:\t%s\n", tap.annotation(tapMirrorTypeAnnotation))
+	fmt.Fprintf(w, "Mirror Interface:\t%s\n", tap.annotation(tapIFNameAnnotation))
+	fmt.Fprintf(w, "Encap:\t%s\n", tap.annotation(tapEncapAnnotation))
+	fmt.Fprintf(w, "Parent Interface:\t%s\n", tap.annotation(tapParentIFAnnotation))
+	fmt.Fprintf(w, "Encrypt:\t%s\n", tap.annotation(tapEncryptAnnotation))
+	fmt.Fprintf(w, "VxLAN ID:\t%s\n", tap.annotation(tapVxlanIDAnnotation))
+	fmt.Fprintf(w, "VxLAN Port:\t%s\n", tap.annotation(tapVxlanPortAnnotation))
+	fmt.Fprintf(w, "Dest Node:\t%s\n", tap.annotation(tapDestNodeAnnotation))
+	fmt.Fprintf(w, "Dest IP:\t%s\n", tap.annotation(tapDestIPAnnotation))
+	fmt.Fprintf(w, "Dest Pod:\t%s\n", tap.annotation(tapDestPodAnnotation))
+	fmt.Fprintf(w, "Dest Context:\t%s\n", tap.annotation(tapDestContextAnnotation))
+	fmt.Fprintf(w, "Pods:\n")
+	fmt.Fprintf(w, "  NAME\tROLE\tNODE\tTARGET\tVNI\tSTATUS\tAGE\n")
+	for _, pod := range tap.Pods {
+		age := "<unknown>"
+		if !pod.CreationTimestamp.IsZero() {
+			age = time.Since(pod.CreationTimestamp.Time).Round(time.Second).String()
+		}
+		fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%s\t%s\t%s\n", pod.Name,
+			pod.Labels[tapRoleLabel], pod.Spec.NodeName,
+			pod.Annotations[tapTargetPodAnnotation],
+			pod.Annotations[tapVxlanIDAnnotation], podStatus(&pod), age)
+	}
+	return w.Flush()
+}
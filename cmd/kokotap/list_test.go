@@ -0,0 +1,171 @@
+// Copyright 2018 Red Hat
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"testing"
+)
+
+// fakeListClient lists the pods in listed, by namespace and label selector.
+type fakeListClient struct {
+	fakeKubeClient
+	listed []v1.Pod
+}
+
+func (f *fakeListClient) ListPods(namespace, labelSelector string) (*v1.PodList, error) {
+	selector, err := labels.Parse(labelSelector)
+	if err != nil {
+		return nil, err
+	}
+	list := &v1.PodList{}
+	for _, pod := range f.listed {
+		if (namespace == "" || pod.Namespace == namespace) && selector.Matches(labels.Set(pod.Labels)) {
+			list.Items = append(list.Items, pod)
+		}
+	}
+	return list, nil
+}
+
+// newListedPods returns the tap pods of podargs, as listed from the cluster
+// (the senders are running, and the receiver is pending).
+func newListedPods(t *testing.T, podargs *kokotapPodArgs) []v1.Pod {
+	pods, err := podargs.GeneratePods()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed := []v1.Pod{}
+	for _, pod := range pods {
+		pod.Status.Phase = v1.PodRunning
+		if pod.Labels[tapRoleLabel] == tapRoleReceiver {
+			pod.Status.Phase = v1.PodPending
+		}
+		listed = append(listed, *pod)
+	}
+	return listed
+}
+
+// newListPodArgs returns the tap of two pods of selector.
+func newListPodArgs() *kokotapPodArgs {
+	podargs := &kokotapPodArgs{
+		Name:        "app=web",
+		Selector:    "app=web",
+		Namespace:   "default",
+		Encap:       "vxlan",
+		VxlanID:     100,
+		VxlanPort:   4789,
+		MirrorType:  "both",
+		MirrorIF:    "eth0",
+		IFName:      "mirror",
+		DestIP:      "10.0.0.1",
+		Image:       "kokotap",
+		IndexIFName: true,
+	}
+	podargs.Receiver.Node = "kube-master"
+	for i, name := range []string{"web-a", "web-b"} {
+		podargs.Senders = append(podargs.Senders, kokotapSenderArgs{
+			PodName: name, Node: "kube-node-1", ContainerID: "containerd://" + name, MirrorIF: "eth0",
+			VxlanEgressIP: "10.0.0.2", VxlanIP: "10.0.0.1", VxlanID: 100 + i,
+			IFName: receiverIFName("mirror", i, true),
+		})
+	}
+	return podargs
+}
+
+func TestGetTaps(t *testing.T) {
+	podargs := newListPodArgs()
+	other := newListPodArgs()
+	other.Name, other.Selector, other.Namespace = "web-0", "", "prod"
+	other.Senders = other.Senders[:1]
+	other.Senders[0].PodName = "web-0"
+
+	client := &fakeListClient{}
+	client.listed = append(newListedPods(t, podargs), newListedPods(t, other)...)
+	clients := &tapClients{target: client, dest: client, destNamespace: "default"}
+
+	taps, err := getTaps(clients, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(taps) != 2 || taps[0].Namespace != "default" || taps[1].Namespace != "prod" {
+		t.Fatalf("taps = %+v, want default/app-web and prod/web-0", taps)
+	}
+
+	tests := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{name: "tap name", got: taps[0].Name, want: podargs.TapName()},
+		{name: "target", got: taps[0].target(), want: "default/app=web"},
+		{name: "target pods", got: taps[0].annotation(tapTargetPodAnnotation), want: "web-a,web-b"},
+		{name: "target interface", got: taps[0].annotation(tapTargetIFNameAnnotation), want: "eth0"},
+		{name: "receiver interfaces", got: taps[0].annotation(tapIFNameAnnotation), want: "mirror0,mirror1"},
+		{name: "vni", got: taps[0].annotation(tapVxlanIDAnnotation), want: "100,101"},
+		{name: "mirror type", got: taps[0].annotation(tapMirrorTypeAnnotation), want: "both"},
+		{name: "destination", got: taps[0].destination(), want: "kube-master"},
+		{name: "senders", got: taps[0].roleStatus(tapRoleSender), want: "Running,Running"},
+		{name: "receiver", got: taps[0].roleStatus(tapRoleReceiver), want: "Pending"},
+		{name: "pod target", got: taps[1].target(), want: "prod/web-0"},
+		{name: "pod senders", got: taps[1].roleStatus(tapRoleSender), want: "Running"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: %q, want %q", tt.name, tt.got, tt.want)
+		}
+	}
+
+	// describe finds the tap by name in the namespace
+	if err = describeTap(clients, "default", podargs.TapName()); err != nil {
+		t.Errorf("describe: unexpected error: %v", err)
+	}
+	if err = describeTap(clients, "default", "web-0"); err == nil {
+		t.Errorf("describe: no error for the tap in other namespace")
+	}
+}
+
+func TestGetTapsMultiCluster(t *testing.T) {
+	podargs := newListPodArgs()
+	podargs.Receiver.Namespace = "capture"
+	podargs.Receiver.Context = "analysis"
+	listed := newListedPods(t, podargs)
+
+	target := &fakeListClient{}
+	dest := &fakeListClient{}
+	for _, pod := range listed {
+		if pod.Labels[tapRoleLabel] == tapRoleReceiver {
+			dest.listed = append(dest.listed, pod)
+		} else {
+			target.listed = append(target.listed, pod)
+		}
+	}
+	clients := &tapClients{target: target, dest: dest, destNamespace: "capture"}
+
+	for _, namespace := range []string{"", "default"} {
+		taps, err := getTaps(clients, namespace, podargs.TapName())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(taps) != 1 || taps[0].Namespace != "default" || len(taps[0].Pods) != 3 {
+			t.Fatalf("%q: taps = %+v, want one tap of 3 pods in default", namespace, taps)
+		}
+		if dest := taps[0].destination(); dest != "analysis/kube-master" {
+			t.Errorf("%q: destination = %q, want %q", namespace, dest, "analysis/kube-master")
+		}
+		if status := taps[0].roleStatus(tapRoleReceiver); status != "Pending" {
+			t.Errorf("%q: receiver = %q, want %q", namespace, status, "Pending")
+		}
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright 2018 Red Hat
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+/*
+ * kokotap: local mode for docker/podman container without kubernetes
+ *
+ * kokotap resolves the container through docker (or podman's docker
+ * compatible) API socket, then runs kokotap_pod sender on the host with the
+ * same arguments as sender pod. The sender removes the mirror and the vxlan
+ * interface at exit, so the signals to kokotap are passed to the sender.
+ */
+import (
+	"context"
+	"fmt"
+	docker "github.com/docker/docker/client"
+	"github.com/vishvananda/netlink"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// localRuntimeSockets are the API sockets of container runtimes for local
+// mode, probed in order if runtime is not given.
+var localRuntimeSockets = []struct {
+	runtime string
+	socket  string
+}{
+	{"docker", "/var/run/docker.sock"},
+	{"podman", "/run/podman/podman.sock"},
+}
+
+// localArgs is the args of local mode.
+type localArgs struct {
+	Container     string // container ID or name
+	Runtime       string // docker or podman (optional)
+	RuntimeSocket string // optional (API socket of the runtime)
+	PodIFName     string // comma-separated, or 'all'
+	IFName        string
+	MirrorType    string
+	VxlanID       int
+	VxlanIDSet    bool // vxlan-id is given (not needed by vlan/macvlan)
+	VxlanPort     int
+	Encap         string // vxlan, gretap, erspan, geneve, vlan, macvlan or veth
+	VlanID        int    // VLAN ID (vlan)
+	ParentIF      string // physical interface (vlan/macvlan)
+	ErspanVersion int    // 1 (type II) or 2 (type III)
+	ErspanDir     string // optional (ERSPAN type III direction)
+	DestIP        net.IP
+	EgressIP      net.IP // optional (default: by route to DestIP)
+	Sender        string // kokotap_pod binary
+}
+
+// getLocalRuntimeSocket returns the API socket of the runtime. If neither
+// runtime nor socket is given, the first socket which exists is used.
+func getLocalRuntimeSocket(args *localArgs) (string, error) {
+	if args.RuntimeSocket != "" {
+		return args.RuntimeSocket, nil
+	}
+	for _, s := range localRuntimeSockets {
+		if args.Runtime != "" && args.Runtime != s.runtime {
+			continue
+		}
+		if _, err := os.Stat(s.socket); err == nil || args.Runtime != "" {
+			return s.socket, nil
+		}
+	}
+	return "", fmt.Errorf("no docker or podman socket is found, please set runtime-socket")
+}
+
+// getLocalContainerID returns the ID of running container, given by ID or
+// name.
+func getLocalContainerID(socket, container string) (string, error) {
+	ctx := context.Background()
+	cli, err := docker.NewClientWithOpts(docker.WithHost("unix://" + socket))
+	if err != nil {
+		return "", err
+	}
+	cli.NegotiateAPIVersion(ctx)
+
+	info, err := cli.ContainerInspect(ctx, container)
+	if err != nil {
+		return "", fmt.Errorf("failed to get container %q: %v", container, err)
+	}
+	if info.State == nil || !info.State.Running {
+		return "", fmt.Errorf("container %q is not running", container)
+	}
+	return info.ID, nil
+}
+
+// getEgressInterface returns the interface name which has the IP, or the
+// interface of the route to dest if IP is not given.
+func getEgressInterface(ip, dest net.IP) (string, error) {
+	if ip != nil {
+		ifaces, err := net.Interfaces()
+		if err != nil {
+			return "", err
+		}
+		for _, iface := range ifaces {
+			addrs, err := iface.Addrs()
+			if err != nil {
+				return "", err
+			}
+			for _, addr := range addrs {
+				if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+					return iface.Name, nil
+				}
+			}
+		}
+		return "", fmt.Errorf("no interface has egress-ip %s", ip)
+	}
+
+	routes, err := netlink.RouteGet(dest)
+	if err != nil || len(routes) == 0 {
+		return "", fmt.Errorf("no route to dest-ip %s: %v", dest, err)
+	}
+	link, err := netlink.LinkByIndex(routes[0].LinkIndex)
+	if err != nil {
+		return "", err
+	}
+	return link.Attrs().Name, nil
+}
+
+// getSenderBinary returns kokotap_pod path, found next to kokotap binary or
+// in PATH.
+func getSenderBinary(sender string) (string, error) {
+	if filepath.Base(sender) == sender {
+		if self, err := os.Executable(); err == nil {
+			path := filepath.Join(filepath.Dir(self), sender)
+			if _, err := os.Stat(path); err == nil {
+				return path, nil
+			}
+		}
+	}
+	path, err := exec.LookPath(sender)
+	if err != nil {
+		return "", fmt.Errorf("kokotap_pod is not found, please set sender: %v", err)
+	}
+	return path, nil
+}
+
+// runLocal runs kokotap_pod sender for the container on the host, until the
+// user interrupts (or the terminal is closed).
+func runLocal(args *localArgs) error {
+	socket, err := getLocalRuntimeSocket(args)
+	if err != nil {
+		return err
+	}
+	containerID, err := getLocalContainerID(socket, args.Container)
+	if err != nil {
+		return err
+	}
+	id, err := encapID(args.Encap, args.VxlanID, args.VxlanIDSet, args.VlanID, args.ParentIF)
+	if err != nil {
+		return err
+	}
+	sender, err := getSenderBinary(args.Sender)
+	if err != nil {
+		return err
+	}
+
+	if args.VxlanPort == 0 {
+		args.VxlanPort = encapPort(args.Encap)
+	}
+
+	// podman container is found through docker compatible API as well
+	senderArgs := []string{"mode", "sender",
+		"--containerid=docker://" + containerID, "--runtime-socket=" + socket,
+		"--mirrortype=" + args.MirrorType, "--mirrorif=" + args.PodIFName, "--ifname=" + args.IFName,
+		"--vxlan-id=" + strconv.Itoa(id), "--vxlan-port=" + strconv.Itoa(args.VxlanPort),
+		"--encap=" + args.Encap}
+	dest := args.DestIP.String()
+	if (isVLANEncap(args.Encap) || args.Encap == "veth") && args.DestIP != nil {
+		return fmt.Errorf("dest-ip is not used by %s", args.Encap)
+	}
+	switch {
+	case isVLANEncap(args.Encap):
+		// the packets go to the network of parent-if, without dest IP
+		senderArgs = append(senderArgs, "--parent-if="+args.ParentIF)
+		dest = args.Encap + " on " + args.ParentIF
+	case args.Encap == "veth":
+		// veth peer is in this host, named ifname as well
+		dest = "veth " + args.IFName
+	default:
+		if args.DestIP == nil {
+			return fmt.Errorf("please set dest-ip")
+		}
+		egressIF, err := getEgressInterface(args.EgressIP, args.DestIP)
+		if err != nil {
+			return err
+		}
+		senderArgs = append(senderArgs, "--vxlan-egressif="+egressIF, "--vxlan-ip="+dest)
+	}
+	if args.Encap == "erspan" {
+		senderArgs = append(senderArgs, "--erspan-version="+strconv.Itoa(args.ErspanVersion))
+		if args.ErspanDir != "" {
+			senderArgs = append(senderArgs, "--erspan-dir="+args.ErspanDir)
+		}
+	}
+	if args.Encap == "geneve" {
+		senderArgs = append(senderArgs, "--target="+args.Container)
+	}
+	cmd := exec.Command(sender, senderArgs...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sig)
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to run %s: %v", sender, err)
+	}
+	fmt.Printf("tap container %q (%.12s) to %s, press Ctrl-C to stop\n",
+		args.Container, containerID, dest)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				return fmt.Errorf("sender exited: %v", err)
+			}
+			return nil
+		case <-sig:
+			// the sender cleans up by SIGINT/SIGTERM (not SIGHUP)
+			cmd.Process.Signal(syscall.SIGTERM)
+		}
+	}
+}
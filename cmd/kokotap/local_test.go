@@ -0,0 +1,196 @@
+// Copyright 2018 Red Hat
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newFakeDockerSocket serves container inspect of docker API on the socket
+// in dir, for the running and the stopped containers.
+func newFakeDockerSocket(t *testing.T, dir string) (string, func()) {
+	socket := filepath.Join(dir, "docker.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	containers := map[string]map[string]interface{}{
+		"web":     {"Id": "1111aaaa2222bbbb", "State": map[string]interface{}{"Running": true}},
+		"stopped": {"Id": "3333cccc4444dddd", "State": map[string]interface{}{"Running": false}},
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("API-Version", "1.40")
+		if strings.HasSuffix(r.URL.Path, "/_ping") {
+			w.Write([]byte("OK"))
+			return
+		}
+		fields := strings.Split(r.URL.Path, "/")
+		if len(fields) < 3 || fields[len(fields)-1] != "json" {
+			http.NotFound(w, r)
+			return
+		}
+		container, ok := containers[fields[len(fields)-2]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"message": "No such container"})
+			return
+		}
+		json.NewEncoder(w).Encode(container)
+	})
+	go http.Serve(l, handler)
+	return socket, func() { l.Close() }
+}
+
+func TestGetLocalRuntimeSocket(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    localArgs
+		want    string
+		wantErr bool
+	}{
+		{name: "given socket", args: localArgs{Runtime: "docker", RuntimeSocket: "/tmp/foo.sock"}, want: "/tmp/foo.sock"},
+		{name: "docker", args: localArgs{Runtime: "docker"}, want: "/var/run/docker.sock"},
+		{name: "podman", args: localArgs{Runtime: "podman"}, want: "/run/podman/podman.sock"},
+		{name: "unknown runtime", args: localArgs{Runtime: "rkt"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		socket, err := getLocalRuntimeSocket(&tt.args)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if err == nil && socket != tt.want {
+			t.Errorf("%s: socket = %q, want %q", tt.name, socket, tt.want)
+		}
+	}
+}
+
+func TestGetLocalContainerID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kokotap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket, stop := newFakeDockerSocket(t, dir)
+	defer stop()
+
+	tests := []struct {
+		container string
+		want      string
+		wantErr   bool
+	}{
+		{container: "web", want: "1111aaaa2222bbbb"},
+		{container: "stopped", wantErr: true},
+		{container: "nothing", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		id, err := getLocalContainerID(socket, tt.container)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: unexpected error: %v", tt.container, err)
+			continue
+		}
+		if err == nil && id != tt.want {
+			t.Errorf("%s: ID = %q, want %q", tt.container, id, tt.want)
+		}
+	}
+}
+
+func TestGetEgressInterface(t *testing.T) {
+	loopback := net.ParseIP("127.0.0.1")
+	if ifName, err := getEgressInterface(loopback, nil); err != nil || ifName != "lo" {
+		t.Errorf("egress-ip: interface is %q (%v), want lo", ifName, err)
+	}
+	if ifName, err := getEgressInterface(nil, loopback); err != nil || ifName != "lo" {
+		t.Errorf("route: interface is %q (%v), want lo", ifName, err)
+	}
+	if _, err := getEgressInterface(net.ParseIP("192.0.2.254"), nil); err == nil {
+		t.Errorf("no error for egress-ip of no interface")
+	}
+}
+
+func TestRunLocal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kokotap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket, stop := newFakeDockerSocket(t, dir)
+	defer stop()
+
+	// the sender records its args
+	out := filepath.Join(dir, "args")
+	sender := filepath.Join(dir, "kokotap_pod")
+	script := "#!/bin/sh\necho \"$@\" > " + out + "\n"
+	if err := ioutil.WriteFile(sender, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		args    localArgs
+		want    []string
+		wantErr bool
+	}{
+		{name: "vxlan", args: localArgs{Container: "web", Encap: "vxlan", VxlanID: 100, VxlanIDSet: true,
+			DestIP: net.ParseIP("127.0.0.1")},
+			want: []string{"--containerid=docker://1111aaaa2222bbbb", "--runtime-socket=" + socket,
+				"--vxlan-id=100", "--vxlan-port=4789", "--vxlan-egressif=lo", "--vxlan-ip=127.0.0.1"}},
+		{name: "vlan", args: localArgs{Container: "web", Encap: "vlan", VlanID: 10, ParentIF: "eth1"},
+			want: []string{"--encap=vlan", "--vxlan-id=10", "--parent-if=eth1"}},
+		{name: "veth", args: localArgs{Container: "web", Encap: "veth", IFName: "mirror0"},
+			want: []string{"--encap=veth", "--ifname=mirror0"}},
+		{name: "no dest-ip", args: localArgs{Container: "web", Encap: "vxlan", VxlanID: 100, VxlanIDSet: true},
+			wantErr: true},
+		{name: "dest-ip of vlan", args: localArgs{Container: "web", Encap: "vlan", VlanID: 10, ParentIF: "eth1",
+			DestIP: net.ParseIP("127.0.0.1")}, wantErr: true},
+		{name: "stopped", args: localArgs{Container: "stopped", Encap: "veth", IFName: "mirror0"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		os.Remove(out)
+		tt.args.RuntimeSocket, tt.args.Sender = socket, sender
+		tt.args.MirrorType, tt.args.PodIFName = "both", "eth0"
+		err := runLocal(&tt.args)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		senderArgs, err := ioutil.ReadFile(out)
+		if err != nil {
+			t.Errorf("%s: sender is not run: %v", tt.name, err)
+			continue
+		}
+		fields := strings.Fields(string(senderArgs))
+		if len(fields) < 2 || fields[0] != "mode" || fields[1] != "sender" {
+			t.Errorf("%s: sender args %q are not sender mode", tt.name, senderArgs)
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(" "+strings.Join(fields, " ")+" ", " "+want+" ") {
+				t.Errorf("%s: %q is not in sender args %q", tt.name, want, senderArgs)
+			}
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2018 Red Hat
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+/*
+ * kokotap: resolve pod interface from Multus network status
+ */
+import (
+	"encoding/json"
+	"fmt"
+	v1 "k8s.io/api/core/v1"
+	"strings"
+)
+
+// networkStatusAnnotations are the pod annotations of network status set by
+// Multus, in order of preference (older Multus uses 'networks-status').
+var networkStatusAnnotations = []string{
+	"k8s.v1.cni.cncf.io/network-status",
+	"k8s.v1.cni.cncf.io/networks-status",
+}
+
+// networkStatus is an element of network status annotation.
+type networkStatus struct {
+	Name      string   `json:"name"`
+	Interface string   `json:"interface"`
+	IPs       []string `json:"ips"`
+	Default   bool     `json:"default"`
+}
+
+// qualifyNetworkName returns the network name as namespace/name, using
+// namespace if the name has no namespace.
+func qualifyNetworkName(name, namespace string) string {
+	if strings.Contains(name, "/") {
+		return name
+	}
+	return namespace + "/" + name
+}
+
+// getNetworkStatus returns the network status of the pod.
+func getNetworkStatus(pod *v1.Pod) ([]networkStatus, error) {
+	for _, key := range networkStatusAnnotations {
+		val, ok := pod.Annotations[key]
+		if !ok {
+			continue
+		}
+		statuses := []networkStatus{}
+		if err := json.Unmarshal([]byte(val), &statuses); err != nil {
+			return nil, fmt.Errorf("failed to parse %s of pod %q: %v", key, pod.Name, err)
+		}
+		return statuses, nil
+	}
+	return nil, fmt.Errorf("no network status annotation in pod %q", pod.Name)
+}
+
+// getNetworkInterface returns the interface name of the pod which is attached
+// to the network (NetworkAttachmentDefinition, given as [namespace/]name).
+func getNetworkInterface(pod *v1.Pod, network string) (string, error) {
+	statuses, err := getNetworkStatus(pod)
+	if err != nil {
+		return "", err
+	}
+
+	network = qualifyNetworkName(network, pod.Namespace)
+	candidates := []string{}
+	for _, status := range statuses {
+		if qualifyNetworkName(status.Name, pod.Namespace) != network {
+			candidates = append(candidates, status.Name)
+			continue
+		}
+		if status.Interface == "" {
+			return "", fmt.Errorf("no interface name of network %q in pod %q", network, pod.Name)
+		}
+		return status.Interface, nil
+	}
+	return "", fmt.Errorf("pod %q is not attached to network %q (networks: %s)",
+		pod.Name, network, strings.Join(candidates, ", "))
+}
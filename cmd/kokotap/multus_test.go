@@ -0,0 +1,65 @@
+// Copyright 2018 Red Hat
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	v1 "k8s.io/api/core/v1"
+	"testing"
+)
+
+func TestGetNetworkInterface(t *testing.T) {
+	status := `[
+		{"name":"k8s-pod-network","interface":"eth0","ips":["10.0.0.5"],"default":true},
+		{"name":"default/macvlan-conf","interface":"net1","ips":["192.168.1.5"]},
+		{"name":"infra/sriov-net","interface":"net2"},
+		{"name":"noif"}]`
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		network     string
+		want        string
+		wantErr     bool
+	}{
+		{name: "network in pod namespace", annotations: map[string]string{networkStatusAnnotations[0]: status},
+			network: "macvlan-conf", want: "net1"},
+		{name: "qualified network", annotations: map[string]string{networkStatusAnnotations[0]: status},
+			network: "default/macvlan-conf", want: "net1"},
+		{name: "network in other namespace", annotations: map[string]string{networkStatusAnnotations[0]: status},
+			network: "infra/sriov-net", want: "net2"},
+		{name: "other namespace without namespace", annotations: map[string]string{networkStatusAnnotations[0]: status},
+			network: "sriov-net", wantErr: true},
+		{name: "old annotation", annotations: map[string]string{networkStatusAnnotations[1]: status},
+			network: "macvlan-conf", want: "net1"},
+		{name: "no interface name", annotations: map[string]string{networkStatusAnnotations[0]: status},
+			network: "noif", wantErr: true},
+		{name: "not attached", annotations: map[string]string{networkStatusAnnotations[0]: status},
+			network: "other", wantErr: true},
+		{name: "broken annotation", annotations: map[string]string{networkStatusAnnotations[0]: `[{"name":`},
+			network: "macvlan-conf", wantErr: true},
+		{name: "no annotation", network: "macvlan-conf", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		pod := &v1.Pod{}
+		pod.Namespace, pod.Name, pod.Annotations = "default", "web-0", tt.annotations
+		ifName, err := getNetworkInterface(pod, tt.network)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if err == nil && ifName != tt.want {
+			t.Errorf("%s: interface = %q, want %q", tt.name, ifName, tt.want)
+		}
+	}
+}
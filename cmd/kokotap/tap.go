@@ -0,0 +1,389 @@
+// Copyright 2018 Red Hat
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+/*
+ * kokotap: create/delete tap pods through kubernetes API
+ */
+import (
+	"bufio"
+	"fmt"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// labels/annotations of kokotap pods, see kokotapPodMetadataTemplate
+const (
+	tapLabel                    = "kokotap.redhat-nfvpe.github.io/tap"
+	tapRoleLabel                = "kokotap.redhat-nfvpe.github.io/role"
+	tapTargetPodAnnotation      = "kokotap.redhat-nfvpe.github.io/target-pod"
+	tapTargetNSAnnotation       = "kokotap.redhat-nfvpe.github.io/target-namespace"
+	tapTargetIFNameAnnotation   = "kokotap.redhat-nfvpe.github.io/target-ifname"
+	tapTargetNetworkAnnotation  = "kokotap.redhat-nfvpe.github.io/target-network"
+	tapTargetSelectorAnnotation = "kokotap.redhat-nfvpe.github.io/target-selector"
+	tapTargetWorkloadAnnotation = "kokotap.redhat-nfvpe.github.io/target-workload"
+	tapIFNameAnnotation         = "kokotap.redhat-nfvpe.github.io/ifname"
+	tapMirrorTypeAnnotation     = "kokotap.redhat-nfvpe.github.io/mirrortype"
+	tapVxlanIDAnnotation        = "kokotap.redhat-nfvpe.github.io/vxlan-id"
+	tapVxlanPortAnnotation      = "kokotap.redhat-nfvpe.github.io/vxlan-port"
+	tapEncapAnnotation          = "kokotap.redhat-nfvpe.github.io/encap"
+	tapParentIFAnnotation       = "kokotap.redhat-nfvpe.github.io/parent-if"
+	tapSenderIPAnnotation       = "kokotap.redhat-nfvpe.github.io/sender-ip"
+	tapDestNodeAnnotation       = "kokotap.redhat-nfvpe.github.io/dest-node"
+	tapDestIPAnnotation         = "kokotap.redhat-nfvpe.github.io/dest-ip"
+	tapDestPodAnnotation        = "kokotap.redhat-nfvpe.github.io/dest-pod"
+	tapDestContextAnnotation    = "kokotap.redhat-nfvpe.github.io/dest-context"
+	tapEncryptAnnotation        = "kokotap.redhat-nfvpe.github.io/encrypt"
+)
+
+// values of tapRoleLabel
+const (
+	tapRoleSender   = "sender"
+	tapRoleReceiver = "receiver"
+)
+
+// waitingErrorReasons are the container waiting reasons which are reported
+// as error while waiting for tap pods.
+var waitingErrorReasons = map[string]bool{
+	"ErrImagePull":               true,
+	"ImagePullBackOff":           true,
+	"InvalidImageName":           true,
+	"CreateContainerConfigError": true,
+	"CreateContainerError":       true,
+	"CrashLoopBackOff":           true,
+}
+
+// tapClients are the clients of the clusters where tap pods run: sender pods
+// run in the cluster of target pods, and receiver pods run in dest cluster,
+// which is the same cluster unless dest context/kubeconfig is given.
+type tapClients struct {
+	target        kubeClient
+	dest          kubeClient
+	destNamespace string // namespace of receiver pods in dest cluster
+}
+
+// isMultiCluster returns true if dest cluster is not the target cluster.
+func (c *tapClients) isMultiCluster() bool {
+	return c.dest != c.target
+}
+
+// podClient returns the client of the cluster where the tap pod runs.
+func (c *tapClients) podClient(pod *v1.Pod) kubeClient {
+	if pod.Labels[tapRoleLabel] == tapRoleReceiver {
+		return c.dest
+	}
+	return c.target
+}
+
+func tapSelector(tapName string) string {
+	return fmt.Sprintf("%s=%s", tapLabel, tapName)
+}
+
+// podError returns the error which prevents the pod from running, if any.
+func podError(pod *v1.Pod) error {
+	if pod.Status.Phase == v1.PodFailed {
+		return fmt.Errorf("pod %q failed: %s %s",
+			pod.Name, pod.Status.Reason, pod.Status.Message)
+	}
+
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == v1.PodScheduled && cond.Status == v1.ConditionFalse {
+			return fmt.Errorf("pod %q is not scheduled: %s %s",
+				pod.Name, cond.Reason, cond.Message)
+		}
+	}
+
+	for _, status := range pod.Status.ContainerStatuses {
+		waiting := status.State.Waiting
+		if waiting != nil && waitingErrorReasons[waiting.Reason] {
+			return fmt.Errorf("pod %q container %q: %s %s",
+				pod.Name, status.Name, waiting.Reason, waiting.Message)
+		}
+	}
+	return nil
+}
+
+// isPodReady returns true if the pod is running and all its containers are
+// ready, or error if a container exited or restarted (tap pods run until they
+// are deleted).
+func isPodReady(pod *v1.Pod) (bool, error) {
+	if pod.Status.Phase != v1.PodRunning || len(pod.Status.ContainerStatuses) == 0 {
+		return false, nil
+	}
+	ready := true
+	for _, status := range pod.Status.ContainerStatuses {
+		terminated := status.State.Terminated
+		if terminated == nil && status.RestartCount > 0 {
+			terminated = status.LastTerminationState.Terminated
+		}
+		if terminated != nil {
+			return false, fmt.Errorf("pod %q container %q exited (exit code %d, restarts %d): %s %s",
+				pod.Name, status.Name, terminated.ExitCode, status.RestartCount,
+				terminated.Reason, terminated.Message)
+		}
+		if status.RestartCount > 0 {
+			return false, fmt.Errorf("pod %q container %q restarted %d times",
+				pod.Name, status.Name, status.RestartCount)
+		}
+		ready = ready && status.Ready
+	}
+	return ready, nil
+}
+
+// waitForPodsRunning waits until all given pods are running and ready.
+func waitForPodsRunning(kubeClient kubeClient, namespace, selector string, names []string, timeout time.Duration) error {
+	w, err := kubeClient.WatchPods(namespace, selector)
+	if err != nil {
+		return err
+	}
+	defer w.Stop()
+
+	running := map[string]bool{}
+	timer := time.After(timeout)
+	for {
+		select {
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				return fmt.Errorf("watch for pods is closed")
+			}
+			pod, ok := event.Object.(*v1.Pod)
+			if !ok {
+				continue
+			}
+			if event.Type == watch.Deleted {
+				return fmt.Errorf("pod %q is deleted", pod.Name)
+			}
+			if err := podError(pod); err != nil {
+				return err
+			}
+			if running[pod.Name], err = isPodReady(pod); err != nil {
+				return err
+			}
+
+			isAllRunning := true
+			for _, name := range names {
+				if running[name] != true {
+					isAllRunning = false
+					break
+				}
+			}
+			if isAllRunning {
+				return nil
+			}
+		case <-timer:
+			waiting := []string{}
+			for _, name := range names {
+				if running[name] != true {
+					waiting = append(waiting, name)
+				}
+			}
+			return fmt.Errorf("timed out waiting for pods running: %s",
+				strings.Join(waiting, ", "))
+		}
+	}
+}
+
+// createTapPods creates the secret (if encrypted) and the sender/receiver
+// pods, and returns the created pods. If no pod is created, the secret is
+// deleted, otherwise the caller deletes the tap with the secret.
+func createTapPods(clients *tapClients, podargs *kokotapPodArgs) ([]*v1.Pod, error) {
+	pods, err := podargs.GeneratePods()
+	if err != nil {
+		return nil, err
+	}
+	if err = createTapSecret(clients.target, podargs); err != nil {
+		return nil, err
+	}
+
+	createdPods := []*v1.Pod{}
+	for _, pod := range pods {
+		created, err := clients.podClient(pod).CreatePod(pod)
+		if err != nil {
+			if len(createdPods) == 0 {
+				// no pod to delete the tap by, so delete the secret here
+				if derr := deleteTapSecret(clients.target, podargs.Namespace, podargs.TapName()); derr != nil {
+					fmt.Fprintf(os.Stderr, "%v\n", derr)
+				}
+			}
+			return createdPods, fmt.Errorf("failed to create pod %q: %v", pod.Name, err)
+		}
+		fmt.Printf("pod/%s created\n", created.Name)
+		createdPods = append(createdPods, created)
+	}
+	return createdPods, nil
+}
+
+// waitForTapRunning waits until all given tap pods are running, in each
+// cluster.
+func waitForTapRunning(clients *tapClients, podargs *kokotapPodArgs, pods []*v1.Pod, timeout time.Duration) error {
+	targetNames := []string{}
+	destNames := []string{}
+	for _, pod := range pods {
+		if clients.isMultiCluster() && clients.podClient(pod) == clients.dest {
+			destNames = append(destNames, pod.Name)
+		} else {
+			targetNames = append(targetNames, pod.Name)
+		}
+	}
+
+	selector := tapSelector(podargs.TapName())
+	if len(targetNames) > 0 {
+		if err := waitForPodsRunning(clients.target, podargs.Namespace, selector, targetNames, timeout); err != nil {
+			return err
+		}
+	}
+	if len(destNames) > 0 {
+		return waitForPodsRunning(clients.dest, podargs.Receiver.Namespace, selector, destNames, timeout)
+	}
+	return nil
+}
+
+// createTap creates the sender/receiver pods and waits until they are running.
+// If it fails, the created pods are deleted, as runTap does.
+func createTap(clients *tapClients, podargs *kokotapPodArgs, timeout time.Duration) error {
+	pods, err := createTapPods(clients, podargs)
+	if err == nil {
+		err = waitForTapRunning(clients, podargs, pods, timeout)
+	}
+	if err != nil {
+		if len(pods) != 0 {
+			if derr := deleteTap(clients, podargs.Namespace, podargs.TapName()); derr != nil {
+				fmt.Fprintf(os.Stderr, "failed to delete tap %q: %v\n", podargs.TapName(), derr)
+			}
+		}
+		return err
+	}
+	fmt.Printf("tap %q is running\n", podargs.TapName())
+	return nil
+}
+
+// deleteTapPods deletes the pods in namespace of the tap in tapNamespace
+// (see tapNamespace) and returns the number of the deleted pods.
+func deleteTapPods(kubeClient kubeClient, namespace, tapNS, tapName string) (int, error) {
+	pods, err := kubeClient.ListPods(namespace, tapSelector(tapName))
+	if err != nil {
+		return 0, err
+	}
+
+	names := []string{}
+	for _, pod := range pods.Items {
+		if tapNamespace(&pod) == tapNS {
+			names = append(names, pod.Name)
+		}
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		if err := kubeClient.DeletePod(namespace, name); err != nil {
+			return i, fmt.Errorf("failed to delete pod %q: %v", name, err)
+		}
+		fmt.Printf("pod %q deleted\n", name)
+	}
+	return len(names), nil
+}
+
+// deleteTap deletes the sender/receiver pods of the tap, in target cluster
+// and dest cluster, and the secret of the tap.
+func deleteTap(clients *tapClients, namespace, tapName string) error {
+	deleted, err := deleteTapPods(clients.target, namespace, namespace, tapName)
+	if err != nil {
+		return err
+	}
+	if err = deleteTapSecret(clients.target, namespace, tapName); err != nil {
+		return err
+	}
+	if clients.isMultiCluster() {
+		n, err := deleteTapPods(clients.dest, clients.destNamespace, namespace, tapName)
+		if err != nil {
+			return err
+		}
+		deleted += n
+	}
+	if deleted == 0 {
+		return fmt.Errorf("no tap %q in namespace %q", tapName, namespace)
+	}
+	return nil
+}
+
+// followPodLogs prints the logs of the pod, prefixed by the pod name,
+// until the log stream is closed.
+func followPodLogs(kubeClient kubeClient, namespace, name string) {
+	logs, err := kubeClient.StreamPodLogs(namespace, name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to get logs of pod %q: %v\n", name, err)
+		return
+	}
+	defer logs.Close()
+
+	scanner := bufio.NewScanner(logs)
+	for scanner.Scan() {
+		fmt.Printf("[%s] %s\n", name, scanner.Text())
+	}
+}
+
+// runTap creates the tap, follows the logs of the tap pods and deletes the
+// tap when the user interrupts (or the terminal is closed). If follower is
+// given, senders are added/removed as the target pods come and go.
+func runTap(clients *tapClients, podargs *kokotapPodArgs, timeout time.Duration, follower *tapFollower) error {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sig)
+
+	pods, err := createTapPods(clients, podargs)
+	if err == nil {
+		result := make(chan error, 1)
+		go func() {
+			result <- waitForTapRunning(clients, podargs, pods, timeout)
+		}()
+
+		select {
+		case err = <-result:
+		case <-sig:
+			err = fmt.Errorf("interrupted while waiting for tap pods")
+		}
+	}
+
+	if err == nil {
+		fmt.Printf("tap %q is running, press Ctrl-C to stop\n", podargs.TapName())
+		for _, pod := range pods {
+			go followPodLogs(clients.podClient(pod), pod.Namespace, pod.Name)
+		}
+
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			if follower != nil {
+				follower.run(stop)
+			}
+			close(done)
+		}()
+
+		<-sig
+		fmt.Printf("\nCatch signal!\n")
+		close(stop)
+		<-done
+	}
+
+	if len(pods) != 0 {
+		if derr := deleteTap(clients, podargs.Namespace, podargs.TapName()); derr != nil {
+			fmt.Fprintf(os.Stderr, "failed to delete tap %q: %v\n", podargs.TapName(), derr)
+		}
+	}
+	return err
+}
@@ -0,0 +1,296 @@
+// Copyright 2018 Red Hat
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"io"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeTapClient records the created objects, and fails to create pod after
+// failAfter pods are created.
+type fakeTapClient struct {
+	fakeKubeClient
+	failAfter int
+	created   []string
+	secrets   map[string]bool
+}
+
+func (f *fakeTapClient) CreatePod(pod *v1.Pod) (*v1.Pod, error) {
+	if len(f.created) >= f.failAfter {
+		return nil, fmt.Errorf("quota exceeded")
+	}
+	f.created = append(f.created, pod.Name)
+	return pod, nil
+}
+
+func (f *fakeTapClient) CreateSecret(secret *v1.Secret) (*v1.Secret, error) {
+	f.secrets[secret.Name] = true
+	return secret, nil
+}
+
+func (f *fakeTapClient) DeleteSecret(namespace, name string) error {
+	if !f.secrets[name] {
+		return apierrors.NewNotFound(schema.GroupResource{Resource: "secrets"}, name)
+	}
+	delete(f.secrets, name)
+	return nil
+}
+
+func TestCreateTapPods(t *testing.T) {
+	tests := []struct {
+		name      string
+		failAfter int
+		created   int
+		secret    bool // secret remains (to be deleted with the created pods)
+		wantErr   bool
+	}{
+		{name: "all created", failAfter: 10, created: 2, secret: true},
+		{name: "first pod fails", failAfter: 0, created: 0, secret: false, wantErr: true},
+		{name: "second pod fails", failAfter: 1, created: 1, secret: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		podargs := &kokotapPodArgs{
+			Name:       "web-0",
+			Namespace:  "default",
+			Encap:      "vxlan",
+			VxlanID:    100,
+			VxlanPort:  ipsecPort,
+			MirrorType: "both",
+			IFName:     "mirror",
+			DestIP:     "10.0.0.1",
+			Encrypt:    "ipsec",
+			Image:      "kokotap",
+		}
+		podargs.Receiver.Node = "kube-master"
+		podargs.Senders = []kokotapSenderArgs{{
+			PodName: "web-0", Node: "kube-node-1", ContainerID: "containerd://1111",
+			VxlanEgressIP: "10.0.0.2", VxlanIP: "10.0.0.1", VxlanID: 100, IFName: "mirror",
+		}}
+		if err := podargs.setIPsecKey(); err != nil {
+			t.Fatal(err)
+		}
+		client := &fakeTapClient{failAfter: tt.failAfter, secrets: map[string]bool{}}
+		clients := &tapClients{target: client, dest: client}
+
+		pods, err := createTapPods(clients, podargs)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		}
+		if len(pods) != tt.created || len(client.created) != tt.created {
+			t.Errorf("%s: created pods = %d (%v), want %d", tt.name, len(pods), client.created, tt.created)
+		}
+		if secret := client.secrets[ipsecSecretName(podargs.TapName())]; secret != tt.secret {
+			t.Errorf("%s: secret remains = %v, want %v", tt.name, secret, tt.secret)
+		}
+	}
+}
+
+// fakeWatchClient watches the events.
+type fakeWatchClient struct {
+	fakeKubeClient
+	events []watch.Event
+}
+
+func (f *fakeWatchClient) WatchPods(namespace, labelSelector string) (watch.Interface, error) {
+	w := watch.NewFakeWithChanSize(len(f.events), false)
+	for _, event := range f.events {
+		w.Action(event.Type, event.Object)
+	}
+	return w, nil
+}
+
+// newTapPodStatus returns the pod in the phase, with the container status.
+func newTapPodStatus(name string, phase v1.PodPhase, status v1.ContainerStatus) *v1.Pod {
+	pod := newFakePod("default", name)
+	pod.Status.Phase = phase
+	status.Name = name
+	pod.Status.ContainerStatuses = []v1.ContainerStatus{status}
+	return pod
+}
+
+func TestWaitForPodsRunning(t *testing.T) {
+	running := v1.ContainerState{Running: &v1.ContainerStateRunning{}}
+	exited := &v1.ContainerStateTerminated{ExitCode: 1, Reason: "Error"}
+	ready := v1.ContainerStatus{State: running, Ready: true}
+	notReady := v1.ContainerStatus{State: running}
+	crashed := v1.ContainerStatus{State: v1.ContainerState{Terminated: exited}}
+	restarted := v1.ContainerStatus{State: running, Ready: true, RestartCount: 1,
+		LastTerminationState: v1.ContainerState{Terminated: exited}}
+
+	tests := []struct {
+		name    string
+		events  []watch.Event
+		wantErr bool
+	}{
+		{name: "ready", events: []watch.Event{
+			{Type: watch.Added, Object: newTapPodStatus("sender", v1.PodPending, v1.ContainerStatus{})},
+			{Type: watch.Added, Object: newTapPodStatus("receiver", v1.PodRunning, ready)},
+			{Type: watch.Modified, Object: newTapPodStatus("sender", v1.PodRunning, ready)},
+		}},
+		{name: "not ready", events: []watch.Event{
+			{Type: watch.Added, Object: newTapPodStatus("sender", v1.PodRunning, notReady)},
+			{Type: watch.Added, Object: newTapPodStatus("receiver", v1.PodRunning, ready)},
+		}, wantErr: true},
+		{name: "exited", events: []watch.Event{
+			{Type: watch.Added, Object: newTapPodStatus("receiver", v1.PodRunning, ready)},
+			{Type: watch.Modified, Object: newTapPodStatus("sender", v1.PodRunning, crashed)},
+		}, wantErr: true},
+		{name: "restarted", events: []watch.Event{
+			{Type: watch.Added, Object: newTapPodStatus("receiver", v1.PodRunning, ready)},
+			{Type: watch.Modified, Object: newTapPodStatus("sender", v1.PodRunning, restarted)},
+		}, wantErr: true},
+		{name: "crash loop", events: []watch.Event{
+			{Type: watch.Modified, Object: newTapPodStatus("sender", v1.PodRunning, v1.ContainerStatus{
+				State: v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}}})},
+		}, wantErr: true},
+		{name: "deleted", events: []watch.Event{
+			{Type: watch.Deleted, Object: newTapPodStatus("sender", v1.PodRunning, ready)},
+		}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		client := &fakeWatchClient{events: tt.events}
+		err := waitForPodsRunning(client, "default", "", []string{"sender", "receiver"}, 100*time.Millisecond)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		}
+	}
+}
+
+// fakeRunClient creates/deletes the tap pods in listed, and the watch shows
+// them in the phase with the container status (no event if phase is empty).
+// The pods are locked by mu, as the watch may outlive runTap.
+type fakeRunClient struct {
+	fakeListClient
+	phase   v1.PodPhase
+	status  v1.ContainerStatus
+	mu      sync.Mutex
+	created int
+}
+
+func (f *fakeRunClient) CreatePod(pod *v1.Pod) (*v1.Pod, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.listed = append(f.listed, *pod)
+	f.created++
+	return pod, nil
+}
+
+func (f *fakeRunClient) ListPods(namespace, labelSelector string) (*v1.PodList, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.fakeListClient.ListPods(namespace, labelSelector)
+}
+
+func (f *fakeRunClient) DeletePod(namespace, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, pod := range f.listed {
+		if pod.Namespace == namespace && pod.Name == name {
+			f.listed = append(f.listed[:i], f.listed[i+1:]...)
+			return nil
+		}
+	}
+	return apierrors.NewNotFound(schema.GroupResource{Resource: "pods"}, name)
+}
+
+func (f *fakeRunClient) WatchPods(namespace, labelSelector string) (watch.Interface, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w := watch.NewFakeWithChanSize(len(f.listed), false)
+	if f.phase == "" {
+		return w, nil
+	}
+	for _, pod := range f.listed {
+		pod := pod.DeepCopy()
+		pod.Status.Phase = f.phase
+		status := f.status
+		status.Name = pod.Name
+		pod.Status.ContainerStatuses = []v1.ContainerStatus{status}
+		w.Add(pod)
+	}
+	return w, nil
+}
+
+func (f *fakeRunClient) StreamPodLogs(namespace, name string) (io.ReadCloser, error) {
+	return nil, fmt.Errorf("no logs")
+}
+
+func (f *fakeRunClient) DeleteSecret(namespace, name string) error {
+	return apierrors.NewNotFound(schema.GroupResource{Resource: "secrets"}, name)
+}
+
+// interruptAfterCreated sends SIGINT to the process when n pods are created.
+func (f *fakeRunClient) interruptAfterCreated(n int) {
+	for {
+		f.mu.Lock()
+		created := f.created
+		f.mu.Unlock()
+		if created >= n {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	syscall.Kill(os.Getpid(), syscall.SIGINT)
+}
+
+func TestRunTap(t *testing.T) {
+	running := v1.ContainerState{Running: &v1.ContainerStateRunning{}}
+	exited := v1.ContainerState{Terminated: &v1.ContainerStateTerminated{ExitCode: 1, Reason: "Error"}}
+
+	tests := []struct {
+		name      string
+		phase     v1.PodPhase
+		status    v1.ContainerStatus
+		interrupt bool
+		wantErr   bool
+	}{
+		{name: "interrupted while running", phase: v1.PodRunning,
+			status: v1.ContainerStatus{State: running, Ready: true}, interrupt: true},
+		{name: "interrupted while waiting", interrupt: true, wantErr: true},
+		{name: "sender exited", phase: v1.PodRunning,
+			status: v1.ContainerStatus{State: exited}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		podargs := newListPodArgs()
+		client := &fakeRunClient{phase: tt.phase, status: tt.status}
+		clients := &tapClients{target: client, dest: client, destNamespace: "default"}
+		if tt.interrupt {
+			go client.interruptAfterCreated(3)
+		}
+
+		err := runTap(clients, podargs, 10*time.Second, nil)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		}
+		client.mu.Lock()
+		if client.created != 3 || len(client.listed) != 0 {
+			t.Errorf("%s: created %d pods, %d pods remain, want 3, 0", tt.name, client.created, len(client.listed))
+		}
+		client.mu.Unlock()
+	}
+}
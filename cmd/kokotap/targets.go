@@ -0,0 +1,551 @@
+// Copyright 2018 Red Hat
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+/*
+ * kokotap: resolve tap target pods
+ */
+import (
+	"encoding/json"
+	"fmt"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"os"
+	"sort"
+	"strings"
+)
+
+// workload kinds for tap target
+const (
+	workloadPod         = "pod"
+	workloadDeployment  = "deployment"
+	workloadStatefulSet = "statefulset"
+	workloadDaemonSet   = "daemonset"
+	workloadService     = "service"
+	workloadNode        = "node"      // all pods on the node
+	workloadNamespace   = "namespace" // all pods in the namespace
+	workloadHost        = "host"      // interface of the node
+	workloadVMI         = "vmi"       // KubeVirt VirtualMachineInstance
+)
+
+// workloadKinds maps kind names (kubectl style, e.g. 'deploy/foo') to kind.
+var workloadKinds = map[string]string{
+	"po":           workloadPod,
+	"pod":          workloadPod,
+	"pods":         workloadPod,
+	"deploy":       workloadDeployment,
+	"deployment":   workloadDeployment,
+	"deployments":  workloadDeployment,
+	"sts":          workloadStatefulSet,
+	"statefulset":  workloadStatefulSet,
+	"statefulsets": workloadStatefulSet,
+	"ds":           workloadDaemonSet,
+	"daemonset":    workloadDaemonSet,
+	"daemonsets":   workloadDaemonSet,
+	"svc":          workloadService,
+	"service":      workloadService,
+	"services":     workloadService,
+	"vmi":          workloadVMI,
+	"vmis":         workloadVMI,
+}
+
+// getTargetWorkload returns the kind and name of tap target from args (kind
+// is empty for selector). Pod flag accepts 'kind/name' syntax as well.
+// Service is the target only if no other target is given, otherwise its
+// pods are the peers of the target (see getPeerPods).
+func getTargetWorkload(args *kokotapArgs) (kind, name string, err error) {
+	numTargets := 0
+	if args.Pod != "" {
+		kind, name = workloadPod, args.Pod
+		if i := strings.Index(args.Pod, "/"); i >= 0 {
+			k, ok := workloadKinds[strings.ToLower(args.Pod[0:i])]
+			if !ok {
+				return "", "", fmt.Errorf("unsupported kind: %q", args.Pod[0:i])
+			}
+			kind, name = k, args.Pod[i+1:]
+		}
+		numTargets++
+	}
+	if args.Deployment != "" {
+		kind, name = workloadDeployment, args.Deployment
+		numTargets++
+	}
+	if args.StatefulSet != "" {
+		kind, name = workloadStatefulSet, args.StatefulSet
+		numTargets++
+	}
+	if args.DaemonSet != "" {
+		kind, name = workloadDaemonSet, args.DaemonSet
+		numTargets++
+	}
+	if args.Selector != "" {
+		kind, name = "", ""
+		numTargets++
+	}
+	if args.AllPodsOnNode != "" {
+		kind, name = workloadNode, args.AllPodsOnNode
+		numTargets++
+	}
+	if args.NamespaceWide {
+		kind, name = workloadNamespace, args.Namespace
+		numTargets++
+	}
+	if args.Node != "" {
+		kind, name = workloadHost, args.Node
+		numTargets++
+	}
+	if args.VMI != "" {
+		kind, name = workloadVMI, args.VMI
+		numTargets++
+	}
+
+	if numTargets > 1 {
+		return "", "", fmt.Errorf("please set only one of pod, selector, deployment, statefulset, daemonset, all-pods-on-node, namespace-wide, node or vmi")
+	}
+	if numTargets == 0 && args.Service != "" {
+		kind, name = workloadService, args.Service
+		numTargets++
+	}
+	if numTargets == 0 {
+		return "", "", fmt.Errorf("please set pod, selector, deployment, statefulset, daemonset, service, all-pods-on-node, namespace-wide, node or vmi")
+	}
+	if kind != "" && name == "" {
+		return "", "", fmt.Errorf("no %s name", kind)
+	}
+	return kind, name, nil
+}
+
+// isOwnedBy returns true if the owner (given by uids) controls the object.
+func isOwnedBy(obj metav1.Object, uids map[string]bool) bool {
+	ref := metav1.GetControllerOf(obj)
+	return ref != nil && uids[string(ref.UID)]
+}
+
+// getWorkloadSelector returns the pod selector and UID of the workload.
+func getWorkloadSelector(kubeClient kubeClient, namespace, kind, name string) (*metav1.LabelSelector, string, error) {
+	switch kind {
+	case workloadDeployment:
+		deploy, err := kubeClient.GetDeployment(namespace, name)
+		if err != nil {
+			return nil, "", err
+		}
+		return deploy.Spec.Selector, string(deploy.UID), nil
+	case workloadStatefulSet:
+		sts, err := kubeClient.GetStatefulSet(namespace, name)
+		if err != nil {
+			return nil, "", err
+		}
+		return sts.Spec.Selector, string(sts.UID), nil
+	case workloadDaemonSet:
+		ds, err := kubeClient.GetDaemonSet(namespace, name)
+		if err != nil {
+			return nil, "", err
+		}
+		return ds.Spec.Selector, string(ds.UID), nil
+	case workloadService:
+		svc, err := kubeClient.GetService(namespace, name)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(svc.Spec.Selector) == 0 {
+			return nil, "", fmt.Errorf("service %q has no selector", name)
+		}
+		return &metav1.LabelSelector{MatchLabels: svc.Spec.Selector}, string(svc.UID), nil
+	}
+	return nil, "", fmt.Errorf("unsupported kind: %q", kind)
+}
+
+// getWorkloadPods returns the pods of the workload, following owner
+// references (deployment -> replicaset -> pod, statefulset/daemonset -> pod).
+func getWorkloadPods(kubeClient kubeClient, namespace, kind, name string) ([]v1.Pod, error) {
+	selector, uid, err := getWorkloadSelector(kubeClient, namespace, kind, name)
+	if err != nil {
+		return nil, err
+	}
+	podSelector, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	owners := map[string]bool{uid: true}
+	if kind == workloadDeployment {
+		owners = map[string]bool{}
+		rsList, err := kubeClient.ListReplicaSets(namespace, podSelector.String())
+		if err != nil {
+			return nil, err
+		}
+		for i := range rsList.Items {
+			rs := &rsList.Items[i]
+			if isOwnedBy(rs, map[string]bool{uid: true}) {
+				owners[string(rs.UID)] = true
+			}
+		}
+	}
+
+	podList, err := kubeClient.ListPods(namespace, podSelector.String())
+	if err != nil {
+		return nil, err
+	}
+
+	pods := []v1.Pod{}
+	for i := range podList.Items {
+		if isOwnedBy(&podList.Items[i], owners) {
+			pods = append(pods, podList.Items[i])
+		}
+	}
+	return pods, nil
+}
+
+// getTargetSelector returns the label selector of the target pods, given by
+// workload (kind/name), or selector if kind is empty.
+func getTargetSelector(kubeClient kubeClient, namespace, kind, name, selector string) (string, error) {
+	if kind == "" {
+		return selector, nil
+	}
+	if kind == workloadNamespace {
+		return "", nil
+	}
+	labelSelector, _, err := getWorkloadSelector(kubeClient, namespace, kind, name)
+	if err != nil {
+		return "", err
+	}
+	podSelector, err := metav1.LabelSelectorAsSelector(labelSelector)
+	if err != nil {
+		return "", err
+	}
+	return podSelector.String(), nil
+}
+
+// endpointSliceVersions are API versions of EndpointSlice, tried in order
+var endpointSliceVersions = []string{"v1", "v1beta1"}
+
+// serviceNameLabel is the label of EndpointSlice which has the service name
+const serviceNameLabel = "kubernetes.io/service-name"
+
+// endpointSliceList is the fields of EndpointSliceList used by kokotap.
+type endpointSliceList struct {
+	Items []struct {
+		Endpoints []struct {
+			TargetRef *v1.ObjectReference `json:"targetRef"`
+		} `json:"endpoints"`
+	} `json:"items"`
+}
+
+// getServiceEndpointRefs returns the target references of the service
+// endpoints (both ready and not ready) from its EndpointSlices, or from its
+// Endpoints if the cluster does not serve EndpointSlice or the service has no
+// EndpointSlice.
+func getServiceEndpointRefs(kubeClient kubeClient, namespace, name string) ([]*v1.ObjectReference, error) {
+	refs := []*v1.ObjectReference{}
+	var raw []byte
+	var err error
+	for _, version := range endpointSliceVersions {
+		raw, err = kubeClient.ListRawWithPath(fmt.Sprintf(
+			"/apis/discovery.k8s.io/%s/namespaces/%s/endpointslices", version, namespace),
+			serviceNameLabel+"="+name)
+		if !apierrors.IsNotFound(err) {
+			break
+		}
+	}
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("failed to list endpointslices of service %q: %v", name, err)
+	}
+	if err == nil {
+		slices := &endpointSliceList{}
+		if err := json.Unmarshal(raw, slices); err != nil {
+			return nil, fmt.Errorf("failed to parse endpointslices of service %q: %v", name, err)
+		}
+		for _, slice := range slices.Items {
+			for _, endpoint := range slice.Endpoints {
+				refs = append(refs, endpoint.TargetRef)
+			}
+		}
+		if len(slices.Items) != 0 {
+			return refs, nil
+		}
+	}
+
+	endpoints, err := kubeClient.GetEndpoints(namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, subset := range endpoints.Subsets {
+		addresses := append(subset.Addresses, subset.NotReadyAddresses...)
+		for _, addr := range addresses {
+			refs = append(refs, addr.TargetRef)
+		}
+	}
+	return refs, nil
+}
+
+// getServicePods returns the pods of the service endpoints (both ready and
+// not ready).
+func getServicePods(kubeClient kubeClient, namespace, name string) ([]v1.Pod, error) {
+	refs, err := getServiceEndpointRefs(kubeClient, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+
+	pods := []v1.Pod{}
+	found := map[string]bool{}
+	for _, ref := range refs {
+		if ref == nil || ref.Kind != "Pod" || found[ref.Name] {
+			continue
+		}
+		found[ref.Name] = true
+		pod, err := kubeClient.GetPod(namespace, ref.Name)
+		if err != nil {
+			return nil, err
+		}
+		pods = append(pods, *pod)
+	}
+	return pods, nil
+}
+
+// watchTargetPods watches the pods given by workload (kind/name), or
+// selector if kind is empty.
+func watchTargetPods(kubeClient kubeClient, namespace, kind, name, selector string) (watch.Interface, error) {
+	if kind == workloadNode {
+		return kubeClient.WatchNodePods(name)
+	}
+	podSelector, err := getTargetSelector(kubeClient, namespace, kind, name, selector)
+	if err != nil {
+		return nil, err
+	}
+	return kubeClient.WatchPods(namespace, podSelector)
+}
+
+// podVeths returns the pods which have own network namespace (i.e. pod veth),
+// except kokotap pods, for node-wide and namespace-wide capture.
+func podVeths(podList []v1.Pod) []v1.Pod {
+	pods := []v1.Pod{}
+	for _, pod := range podList {
+		if _, ok := pod.Labels[tapLabel]; ok || pod.Spec.HostNetwork {
+			continue
+		}
+		pods = append(pods, pod)
+	}
+	return pods
+}
+
+// listTargetPods lists the pods given by workload (kind/name), or selector
+// if kind is empty.
+func listTargetPods(kubeClient kubeClient, namespace, kind, name, selector string) ([]v1.Pod, error) {
+	switch kind {
+	case workloadService:
+		return getServicePods(kubeClient, namespace, name)
+	case workloadVMI:
+		return getVMIPods(kubeClient, namespace, name)
+	case workloadNode:
+		list, err := kubeClient.ListNodePods(name)
+		if err != nil {
+			return nil, err
+		}
+		return podVeths(list.Items), nil
+	case workloadNamespace:
+		list, err := kubeClient.ListPods(namespace, "")
+		if err != nil {
+			return nil, err
+		}
+		return podVeths(list.Items), nil
+	}
+	if kind != "" {
+		return getWorkloadPods(kubeClient, namespace, kind, name)
+	}
+	list, err := kubeClient.ListPods(namespace, selector)
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// runningPods returns the running pods, sorted by namespace and name.
+func runningPods(podList []v1.Pod) []v1.Pod {
+	pods := []v1.Pod{}
+	for _, pod := range podList {
+		if pod.DeletionTimestamp != nil || pod.Status.Phase != v1.PodRunning {
+			fmt.Fprintf(os.Stderr, "skip pod %q: not running\n", pod.Name)
+			continue
+		}
+		pods = append(pods, pod)
+	}
+	sort.Slice(pods, func(i, j int) bool {
+		if pods[i].Namespace != pods[j].Namespace {
+			return pods[i].Namespace < pods[j].Namespace
+		}
+		return pods[i].Name < pods[j].Name
+	})
+	return pods
+}
+
+// getTargetPods returns the tap target pods, given by pod name or workload
+// (kind/name), or selector if kind is empty.
+func getTargetPods(kubeClient kubeClient, namespace, kind, name, selector string) ([]v1.Pod, error) {
+	if kind == workloadPod {
+		pod, err := kubeClient.GetPod(namespace, name)
+		if err != nil {
+			return nil, fmt.Errorf("%v", err)
+		}
+		return []v1.Pod{*pod}, nil
+	}
+
+	podList, err := listTargetPods(kubeClient, namespace, kind, name, selector)
+	if err != nil {
+		return nil, fmt.Errorf("%v", err)
+	}
+	target := fmt.Sprintf("selector %q in namespace %q", selector, namespace)
+	switch kind {
+	case "":
+	case workloadNode:
+		target = fmt.Sprintf("node %q", name)
+	default:
+		target = fmt.Sprintf("%s %q in namespace %q", kind, name, namespace)
+	}
+
+	pods := runningPods(podList)
+	if len(pods) == 0 {
+		return nil, fmt.Errorf("no running pod for %s", target)
+	}
+	return pods, nil
+}
+
+// containerCandidates returns the container names of the pod with their
+// readiness, to show in error messages.
+func containerCandidates(pod *v1.Pod) string {
+	candidates := []string{}
+	for _, status := range pod.Status.ContainerStatuses {
+		state := "ready"
+		if !status.Ready {
+			state = "not ready"
+		}
+		candidates = append(candidates, fmt.Sprintf("%s (%s)", status.Name, state))
+	}
+	return strings.Join(candidates, ", ")
+}
+
+// getPeerPods returns the running pods which are the peers of the tap target
+// (given by pod names and service endpoints), except the pods in targets.
+func getPeerPods(kubeClient kubeClient, namespace string, peerPods []string, service string, targets []v1.Pod) ([]v1.Pod, error) {
+	podList := []v1.Pod{}
+	for _, name := range peerPods {
+		pod, err := kubeClient.GetPod(namespace, name)
+		if err != nil {
+			return nil, err
+		}
+		podList = append(podList, *pod)
+	}
+	if service != "" {
+		servicePods, err := getServicePods(kubeClient, namespace, service)
+		if err != nil {
+			return nil, err
+		}
+		if len(servicePods) == 0 {
+			return nil, fmt.Errorf("no endpoint pod for service %q in namespace %q", service, namespace)
+		}
+		podList = append(podList, servicePods...)
+	}
+
+	found := map[string]bool{}
+	for _, pod := range targets {
+		found[pod.Name] = true
+	}
+	pods := []v1.Pod{}
+	for _, pod := range runningPods(podList) {
+		if !found[pod.Name] {
+			found[pod.Name] = true
+			pods = append(pods, pod)
+		}
+	}
+	return pods, nil
+}
+
+// hostNetworkFilters returns the filters (protocol:ip:port) of the container
+// ports of hostNetwork pod, to mirror only the pod's traffic on the node
+// interface.
+func hostNetworkFilters(pod *v1.Pod) ([]string, error) {
+	if pod.Status.PodIP == "" {
+		return nil, fmt.Errorf("no IP address of hostNetwork pod %q", pod.Name)
+	}
+	filters := []string{}
+	for _, container := range pod.Spec.Containers {
+		for _, port := range container.Ports {
+			protocol := port.Protocol
+			if protocol == "" {
+				protocol = v1.ProtocolTCP
+			}
+			filters = append(filters, fmt.Sprintf("%s:%s:%d",
+				strings.ToLower(string(protocol)), pod.Status.PodIP, port.ContainerPort))
+		}
+	}
+	if len(filters) == 0 {
+		return nil, fmt.Errorf("hostNetwork pod %q has no container port to filter its traffic, please tap the node by node and node-ifname",
+			pod.Name)
+	}
+	return filters, nil
+}
+
+// getContainerID returns the container ID (with runtime prefix) of the pod
+// to find its network namespace. The container is given by name, or it is
+// the only container of the pod if name is empty. The container does not
+// need to be ready (e.g. crash-looping), because the sender uses the network
+// namespace of the pod sandbox.
+func getContainerID(pod *v1.Pod, container string) (string, error) {
+	statuses := pod.Status.ContainerStatuses
+	if len(statuses) == 0 {
+		return "", fmt.Errorf("no container status in pod: %q", pod.Name)
+	}
+	if container == "" {
+		if len(statuses) > 1 {
+			return "", fmt.Errorf("pod %q has %d containers, please set container: %s",
+				pod.Name, len(statuses), containerCandidates(pod))
+		}
+		container = statuses[0].Name
+	}
+
+	for _, status := range statuses {
+		if status.Name != container {
+			continue
+		}
+		if status.ContainerID == "" {
+			return "", fmt.Errorf("container %q in pod %q is not created yet: %s",
+				container, pod.Name, containerCandidates(pod))
+		}
+		return status.ContainerID, nil
+	}
+	return "", fmt.Errorf("no container %q in pod %q: %s",
+		container, pod.Name, containerCandidates(pod))
+}
+
+// getAnyContainerID returns the container ID of the first created container
+// of the pod. Any container is in the network namespace of the pod sandbox.
+func getAnyContainerID(pod *v1.Pod) (string, error) {
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.ContainerID != "" {
+			return status.ContainerID, nil
+		}
+	}
+	return "", fmt.Errorf("no container is created yet in pod: %q", pod.Name)
+}
+
+// targetContainerID returns the container ID of the tap target pod, which is
+// any container of the pod in node/namespace-wide capture if container is
+// not given.
+func (podargs *kokotapPodArgs) targetContainerID(pod *v1.Pod, container string) (string, error) {
+	if container == "" && podargs.AnyContainer {
+		return getAnyContainerID(pod)
+	}
+	return getContainerID(pod, container)
+}
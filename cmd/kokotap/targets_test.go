@@ -0,0 +1,283 @@
+// Copyright 2018 Red Hat
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// fakeKubeClient is kubeClient of the objects in the maps. The methods which
+// are not overridden panic.
+type fakeKubeClient struct {
+	kubeClient
+	pods      map[string]*v1.Pod       // by namespace/name
+	endpoints map[string]*v1.Endpoints // by namespace/name
+	raw       map[string]string        // by path?labelSelector
+	nodes     map[string]*v1.Node      // by name
+}
+
+func (f *fakeKubeClient) GetPod(namespace, name string) (*v1.Pod, error) {
+	if pod, ok := f.pods[namespace+"/"+name]; ok {
+		return pod, nil
+	}
+	return nil, apierrors.NewNotFound(schema.GroupResource{Resource: "pods"}, name)
+}
+
+func (f *fakeKubeClient) GetEndpoints(namespace, name string) (*v1.Endpoints, error) {
+	if endpoints, ok := f.endpoints[namespace+"/"+name]; ok {
+		return endpoints, nil
+	}
+	return nil, apierrors.NewNotFound(schema.GroupResource{Resource: "endpoints"}, name)
+}
+
+func (f *fakeKubeClient) GetNode(name string) (*v1.Node, error) {
+	if node, ok := f.nodes[name]; ok {
+		return node, nil
+	}
+	return nil, apierrors.NewNotFound(schema.GroupResource{Resource: "nodes"}, name)
+}
+
+func (f *fakeKubeClient) GetRawWithPath(path string) ([]byte, error) {
+	return f.ListRawWithPath(path, "")
+}
+
+func (f *fakeKubeClient) ListRawWithPath(path, labelSelector string) ([]byte, error) {
+	if raw, ok := f.raw[path+"?"+labelSelector]; ok {
+		return []byte(raw), nil
+	}
+	return nil, apierrors.NewNotFound(schema.GroupResource{}, path)
+}
+
+// newFakeNode returns the node of the name, which has the hostname address
+// (other than the name), the internal IP and the external IP (if not "").
+func newFakeNode(name, internalIP, externalIP string) *v1.Node {
+	node := &v1.Node{}
+	node.Name = name
+	node.Status.Addresses = []v1.NodeAddress{
+		{Type: v1.NodeHostName, Address: name + ".localdomain"},
+		{Type: v1.NodeInternalIP, Address: internalIP},
+	}
+	if externalIP != "" {
+		node.Status.Addresses = append(node.Status.Addresses,
+			v1.NodeAddress{Type: v1.NodeExternalIP, Address: externalIP})
+	}
+	return node
+}
+
+// newFakePod returns the pod of namespace/name.
+func newFakePod(namespace, name string) *v1.Pod {
+	pod := &v1.Pod{}
+	pod.Namespace, pod.Name = namespace, name
+	return pod
+}
+
+func TestGetTargetWorkload(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    kokotapArgs
+		kind    string
+		target  string
+		wantErr bool
+	}{
+		{name: "pod", args: kokotapArgs{Pod: "web-0"}, kind: workloadPod, target: "web-0"},
+		{name: "pod kind", args: kokotapArgs{Pod: "po/web-0"}, kind: workloadPod, target: "web-0"},
+		{name: "deployment kind", args: kokotapArgs{Pod: "Deploy/web"}, kind: workloadDeployment, target: "web"},
+		{name: "statefulset kind", args: kokotapArgs{Pod: "sts/db"}, kind: workloadStatefulSet, target: "db"},
+		{name: "service kind", args: kokotapArgs{Pod: "svc/web"}, kind: workloadService, target: "web"},
+		{name: "vmi kind", args: kokotapArgs{Pod: "vmi/vm1"}, kind: workloadVMI, target: "vm1"},
+		{name: "unsupported kind", args: kokotapArgs{Pod: "job/batch"}, wantErr: true},
+		{name: "no name", args: kokotapArgs{Pod: "deploy/"}, wantErr: true},
+		{name: "deployment", args: kokotapArgs{Deployment: "web"}, kind: workloadDeployment, target: "web"},
+		{name: "daemonset", args: kokotapArgs{DaemonSet: "agent"}, kind: workloadDaemonSet, target: "agent"},
+		{name: "selector", args: kokotapArgs{Selector: "app=web"}, kind: "", target: ""},
+		{name: "service", args: kokotapArgs{Service: "web"}, kind: workloadService, target: "web"},
+		{name: "service as peer", args: kokotapArgs{Pod: "client", Service: "web"}, kind: workloadPod, target: "client"},
+		{name: "all pods on node", args: kokotapArgs{AllPodsOnNode: "kube-node-1"}, kind: workloadNode, target: "kube-node-1"},
+		{name: "namespace wide", args: kokotapArgs{NamespaceWide: true, Namespace: "prod"}, kind: workloadNamespace, target: "prod"},
+		{name: "node", args: kokotapArgs{Node: "kube-node-1"}, kind: workloadHost, target: "kube-node-1"},
+		{name: "two targets", args: kokotapArgs{Pod: "web-0", Selector: "app=web"}, wantErr: true},
+		{name: "no target", args: kokotapArgs{}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		kind, target, err := getTargetWorkload(&tt.args)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if err == nil && (kind != tt.kind || target != tt.target) {
+			t.Errorf("%s: workload = %q/%q, want %q/%q", tt.name, kind, target, tt.kind, tt.target)
+		}
+	}
+}
+
+func TestTargetContainerID(t *testing.T) {
+	pod := func(statuses ...v1.ContainerStatus) *v1.Pod {
+		p := &v1.Pod{}
+		p.Name = "web-0"
+		p.Status.ContainerStatuses = statuses
+		return p
+	}
+	web := v1.ContainerStatus{Name: "web", ContainerID: "containerd://1111"}
+	sidecar := v1.ContainerStatus{Name: "sidecar", ContainerID: "containerd://2222"}
+	waiting := v1.ContainerStatus{Name: "init"}
+	crashing := v1.ContainerStatus{Name: "web", ContainerID: "containerd://3333", RestartCount: 5,
+		State: v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}}}
+
+	tests := []struct {
+		name         string
+		pod          *v1.Pod
+		container    string
+		anyContainer bool
+		want         string
+		wantErr      bool
+	}{
+		{name: "only container", pod: pod(web), want: "containerd://1111"},
+		{name: "container by name", pod: pod(web, sidecar), container: "sidecar", want: "containerd://2222"},
+		{name: "several containers", pod: pod(web, sidecar), wantErr: true},
+		{name: "no such container", pod: pod(web, sidecar), container: "db", wantErr: true},
+		{name: "not created", pod: pod(waiting), wantErr: true},
+		{name: "crash-looping container", pod: pod(crashing), want: "containerd://3333"},
+		{name: "crash-looping container by name", pod: pod(crashing, sidecar), container: "web", want: "containerd://3333"},
+		{name: "no status", pod: pod(), wantErr: true},
+		{name: "any container", pod: pod(web, sidecar), anyContainer: true, want: "containerd://1111"},
+		{name: "any created container", pod: pod(waiting, sidecar), anyContainer: true, want: "containerd://2222"},
+		{name: "any container by name", pod: pod(web, sidecar), container: "sidecar", anyContainer: true,
+			want: "containerd://2222"},
+		{name: "any container not created", pod: pod(waiting), anyContainer: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		podargs := &kokotapPodArgs{Container: tt.container, AnyContainer: tt.anyContainer}
+		id, err := podargs.targetContainerID(tt.pod, tt.container)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if err == nil && id != tt.want {
+			t.Errorf("%s: container ID = %q, want %q", tt.name, id, tt.want)
+		}
+	}
+}
+
+func TestGetServicePods(t *testing.T) {
+	pods := map[string]*v1.Pod{}
+	for _, name := range []string{"web-0", "web-1", "web-2"} {
+		pods["default/"+name] = newFakePod("default", name)
+	}
+	endpointRef := func(name string) v1.EndpointAddress {
+		return v1.EndpointAddress{TargetRef: &v1.ObjectReference{Kind: "Pod", Name: name}}
+	}
+	endpoints := map[string]*v1.Endpoints{
+		"default/web": {Subsets: []v1.EndpointSubset{{
+			Addresses:         []v1.EndpointAddress{endpointRef("web-0"), {IP: "10.0.0.1"}},
+			NotReadyAddresses: []v1.EndpointAddress{endpointRef("web-1")},
+		}}},
+	}
+	slicePath := func(version string) string {
+		return fmt.Sprintf("/apis/discovery.k8s.io/%s/namespaces/default/endpointslices?%s=web",
+			version, serviceNameLabel)
+	}
+	slices := `{"items":[
+		{"endpoints":[{"targetRef":{"kind":"Pod","name":"web-1"}},{"targetRef":{"kind":"Pod","name":"web-2"}}]},
+		{"endpoints":[{"targetRef":{"kind":"Pod","name":"web-2"}},{"addresses":["10.0.0.1"]}]}]}`
+
+	tests := []struct {
+		name    string
+		raw     map[string]string
+		want    []string
+		wantErr bool
+	}{
+		{name: "endpointslice v1", raw: map[string]string{slicePath("v1"): slices}, want: []string{"web-1", "web-2"}},
+		{name: "endpointslice v1beta1", raw: map[string]string{slicePath("v1beta1"): slices}, want: []string{"web-1", "web-2"}},
+		{name: "no endpointslice api", want: []string{"web-0", "web-1"}},
+		{name: "no endpointslice", raw: map[string]string{slicePath("v1"): `{"items":[]}`}, want: []string{"web-0", "web-1"}},
+		{name: "broken endpointslice", raw: map[string]string{slicePath("v1"): `{"items":`}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		client := &fakeKubeClient{pods: pods, endpoints: endpoints, raw: tt.raw}
+		result, err := getServicePods(client, "default", "web")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		names := []string{}
+		for _, pod := range result {
+			names = append(names, pod.Name)
+		}
+		sort.Strings(names)
+		if fmt.Sprint(names) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: pods = %v, want %v", tt.name, names, tt.want)
+		}
+	}
+}
+
+func TestParseKokoTapArgsContainer(t *testing.T) {
+	pod := newFakePod("default", "web-0")
+	pod.Spec.NodeName = "kube-node-1"
+	pod.Status.Phase = v1.PodRunning
+	pod.Status.HostIP = "10.0.0.2"
+	pod.Status.ContainerStatuses = []v1.ContainerStatus{
+		{Name: "web", ContainerID: "containerd://1111", Ready: true},
+		{Name: "sidecar", ContainerID: "containerd://2222"},
+	}
+	client := &fakeKubeClient{pods: map[string]*v1.Pod{"default/web-0": pod}}
+	clients := &tapClients{target: client, dest: client, destNamespace: "default"}
+
+	tests := []struct {
+		name      string
+		container string
+		want      string
+		wantErr   string
+	}{
+		{name: "app container", container: "web", want: "containerd://1111"},
+		{name: "not ready container", container: "sidecar", want: "containerd://2222"},
+		{name: "no container", wantErr: "web (ready), sidecar (not ready)"},
+		{name: "no such container", container: "db", wantErr: "web (ready), sidecar (not ready)"},
+	}
+
+	for _, tt := range tests {
+		args := &kokotapArgs{
+			Pod: "web-0", Container: tt.container, Namespace: "default", IFName: "mirror",
+			DestIP: net.ParseIP("10.0.0.1"), MirrorType: "both", Encap: "vxlan", VxlanID: 100, VxlanIDSet: true,
+			Encrypt: "none",
+		}
+		podargs := &kokotapPodArgs{}
+		err := podargs.ParseKokoTapArgs(clients, args)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: error = %v, want candidates %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if len(podargs.Senders) != 1 || podargs.Senders[0].ContainerID != tt.want {
+			t.Errorf("%s: senders = %+v, want container %q", tt.name, podargs.Senders, tt.want)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2018 Red Hat
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+/*
+ * kokotap_pod: CRI (Container Runtime Interface) client
+ *
+ * This client calls ContainerStatus/PodSandboxStatus (verbose) of CRI
+ * RuntimeService through gRPC over unix socket to get container's pid, hence
+ * it works with any CRI runtime (containerd, cri-o and so on).
+ */
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+	"net"
+	"strings"
+	"time"
+)
+
+// criServices are CRI RuntimeService names, tried in order. The messages used
+// by kokotap are the same in v1 and v1alpha2.
+var criServices = []string{
+	"runtime.v1.RuntimeService",
+	"runtime.v1alpha2.RuntimeService",
+}
+
+// criTimeout is the timeout to connect to CRI runtime and to call a method
+const criTimeout = 10 * time.Second
+
+type criClient struct {
+	conn *grpc.ClientConn
+}
+
+func newCRIClient(socket string) (*criClient, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), criTimeout)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, socket, grpc.WithInsecure(), grpc.WithBlock(),
+		grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("unix", addr, timeout)
+		}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to cri runtime %s: %v", socket, err)
+	}
+	return &criClient{conn: conn}, nil
+}
+
+func (c *criClient) Close() error {
+	return c.conn.Close()
+}
+
+// invoke calls the method of the first RuntimeService which the runtime
+// implements.
+func (c *criClient) invoke(method string, req, resp interface{}) error {
+	var err error
+	for _, service := range criServices {
+		ctx, cancel := context.WithTimeout(context.Background(), criTimeout)
+		err = c.conn.Invoke(ctx, "/"+service+"/"+method, req, resp)
+		cancel()
+		if status.Code(err) != codes.Unimplemented {
+			break
+		}
+	}
+	return err
+}
+
+// ContainerStatus returns verbose info of the container.
+func (c *criClient) ContainerStatus(containerID string) (map[string]string, error) {
+	resp := &runtimeapi.ContainerStatusResponse{}
+	err := c.invoke("ContainerStatus", &runtimeapi.ContainerStatusRequest{
+		ContainerId: containerID,
+		Verbose:     true,
+	}, resp)
+	return resp.Info, err
+}
+
+// PodSandboxStatus returns verbose info of the pod sandbox.
+func (c *criClient) PodSandboxStatus(sandboxID string) (map[string]string, error) {
+	resp := &runtimeapi.PodSandboxStatusResponse{}
+	err := c.invoke("PodSandboxStatus", &runtimeapi.PodSandboxStatusRequest{
+		PodSandboxId: sandboxID,
+		Verbose:      true,
+	}, resp)
+	return resp.Info, err
+}
+
+// criInfo is the fields of verbose 'info' used by kokotap
+type criInfo struct {
+	SandboxID   string `json:"sandboxID"`
+	Pid         int    `json:"pid"`
+	RuntimeSpec struct {
+		Linux struct {
+			Namespaces []struct {
+				Type string `json:"type"`
+				Path string `json:"path"`
+			} `json:"namespaces"`
+		} `json:"linux"`
+	} `json:"runtimeSpec"`
+}
+
+// netNS returns the network namespace path of the info, under procPrefix.
+func (info *criInfo) netNS(procPrefix string) string {
+	if info.Pid != 0 {
+		return fmt.Sprintf("%s//proc/%d/ns/net", procPrefix, info.Pid)
+	}
+	for _, ns := range info.RuntimeSpec.Linux.Namespaces {
+		if ns.Type == "network" && strings.HasPrefix(ns.Path, "/proc/") {
+			return fmt.Sprintf("%s/%s", procPrefix, ns.Path)
+		}
+	}
+	return ""
+}
+
+func parseCRIInfo(info map[string]string) (*criInfo, error) {
+	result := &criInfo{}
+	if info["info"] == "" {
+		return result, nil
+	}
+	if err := json.Unmarshal([]byte(info["info"]), result); err != nil {
+		return nil, fmt.Errorf("failed to parse cri info: %v", err)
+	}
+	return result, nil
+}
+
+// GetCRISandboxNS retrieves the network namespace of container's pod sandbox
+// through CRI runtime at socketPath. The sandbox's namespace outlives the
+// container, so it is available while the container is crash-looping or
+// restarted. If the sandbox is not found, the namespace of the container is
+// returned.
+func GetCRISandboxNS(procPrefix, containerID, socketPath string) (string, error) {
+	client, err := newCRIClient(socketPath)
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+	status, err := client.ContainerStatus(containerID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get container status: %v", err)
+	}
+	info, err := parseCRIInfo(status)
+	if err != nil {
+		return "", err
+	}
+
+	if info.SandboxID != "" {
+		status, err = client.PodSandboxStatus(info.SandboxID)
+		if err != nil {
+			return "", fmt.Errorf("failed to get pod sandbox status: %v", err)
+		}
+		sandboxInfo, err := parseCRIInfo(status)
+		if err != nil {
+			return "", err
+		}
+		if ns := sandboxInfo.netNS(procPrefix); ns != "" {
+			return ns, nil
+		}
+	}
+
+	if ns := info.netNS(procPrefix); ns != "" {
+		return ns, nil
+	}
+	return "", fmt.Errorf("no pid in container/pod sandbox status: %q", containerID)
+}
@@ -0,0 +1,191 @@
+// Copyright 2018 Red Hat
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
+	runtimeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseCRIInfo(t *testing.T) {
+	tests := []struct {
+		name      string
+		info      map[string]string
+		sandboxID string
+		netns     string
+		wantErr   bool
+	}{
+		{
+			name:  "no info",
+			info:  map[string]string{},
+			netns: "",
+		},
+		{
+			name:      "containerd container",
+			info:      map[string]string{"info": `{"sandboxID":"abc","pid":1234}`},
+			sandboxID: "abc",
+			netns:     "/host//proc/1234/ns/net",
+		},
+		{
+			name: "cri-o sandbox without pid",
+			info: map[string]string{"info": `{"runtimeSpec":{"linux":{"namespaces":[` +
+				`{"type":"pid"},{"type":"network","path":"/proc/42/ns/net"}]}}}`},
+			netns: "/host//proc/42/ns/net",
+		},
+		{
+			name: "pinned network namespace",
+			info: map[string]string{"info": `{"runtimeSpec":{"linux":{"namespaces":[` +
+				`{"type":"network","path":"/var/run/netns/cni-1234"}]}}}`},
+			netns: "",
+		},
+		{
+			name:    "broken json",
+			info:    map[string]string{"info": `{"pid":`},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		info, err := parseCRIInfo(tt.info)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if info.SandboxID != tt.sandboxID {
+			t.Errorf("%s: sandboxID = %q, want %q", tt.name, info.SandboxID, tt.sandboxID)
+		}
+		if netns := info.netNS("/host"); netns != tt.netns {
+			t.Errorf("%s: netNS = %q, want %q", tt.name, netns, tt.netns)
+		}
+	}
+}
+
+// fakeCRIRuntime returns the verbose info of the containers and the pod
+// sandboxes (by ID).
+type fakeCRIRuntime struct {
+	containers map[string]string
+	sandboxes  map[string]string
+}
+
+func (f *fakeCRIRuntime) info(infos map[string]string, id string) (map[string]string, error) {
+	info, ok := infos[id]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "%q is not found", id)
+	}
+	return map[string]string{"info": info}, nil
+}
+
+// serviceDesc returns the RuntimeService of the name, which has the methods
+// used by criClient.
+func (f *fakeCRIRuntime) serviceDesc(name string) *grpc.ServiceDesc {
+	return &grpc.ServiceDesc{
+		ServiceName: name,
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{
+			{
+				MethodName: "ContainerStatus",
+				Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+					req := &runtimeapi.ContainerStatusRequest{}
+					if err := dec(req); err != nil {
+						return nil, err
+					}
+					info, err := f.info(f.containers, req.ContainerId)
+					return &runtimeapi.ContainerStatusResponse{Info: info}, err
+				},
+			},
+			{
+				MethodName: "PodSandboxStatus",
+				Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+					req := &runtimeapi.PodSandboxStatusRequest{}
+					if err := dec(req); err != nil {
+						return nil, err
+					}
+					info, err := f.info(f.sandboxes, req.PodSandboxId)
+					return &runtimeapi.PodSandboxStatusResponse{Info: info}, err
+				},
+			},
+		},
+	}
+}
+
+func TestGetCRISandboxNS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kokotap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	runtime := &fakeCRIRuntime{
+		containers: map[string]string{
+			"app":          `{"sandboxID":"pod","pid":200}`,
+			"crashing":     `{"sandboxID":"pod"}`,
+			"no-sandbox":   `{"pid":300}`,
+			"gone-sandbox": `{"sandboxID":"gone","pid":400}`,
+			"cri-o":        `{"sandboxID":"cri-o-pod"}`,
+		},
+		sandboxes: map[string]string{
+			"pod": `{"pid":100}`,
+			"cri-o-pod": `{"runtimeSpec":{"linux":{"namespaces":[` +
+				`{"type":"network","path":"/proc/500/ns/net"}]}}}`,
+		},
+	}
+	tests := []struct {
+		name      string
+		service   string
+		container string
+		netns     string
+		wantErr   bool
+	}{
+		{name: "sandbox of container", service: "runtime.v1.RuntimeService", container: "app", netns: "/host//proc/100/ns/net"},
+		{name: "sandbox of crashing container", service: "runtime.v1.RuntimeService", container: "crashing", netns: "/host//proc/100/ns/net"},
+		{name: "no sandbox", service: "runtime.v1.RuntimeService", container: "no-sandbox", netns: "/host//proc/300/ns/net"},
+		{name: "sandbox is gone", service: "runtime.v1.RuntimeService", container: "gone-sandbox", wantErr: true},
+		{name: "sandbox by runtime spec", service: "runtime.v1.RuntimeService", container: "cri-o", netns: "/host//proc/500/ns/net"},
+		{name: "v1alpha2 runtime", service: "runtime.v1alpha2.RuntimeService", container: "app", netns: "/host//proc/100/ns/net"},
+		{name: "no container", service: "runtime.v1.RuntimeService", container: "db", wantErr: true},
+	}
+
+	for i, tt := range tests {
+		socket := filepath.Join(dir, fmt.Sprintf("cri%d.sock", i))
+		listener, err := net.Listen("unix", socket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := grpc.NewServer()
+		server.RegisterService(runtime.serviceDesc(tt.service), runtime)
+		go server.Serve(listener)
+
+		netns, err := GetCRISandboxNS("/host", tt.container, socket)
+		server.Stop()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if err == nil && netns != tt.netns {
+			t.Errorf("%s: netns = %q, want %q", tt.name, netns, tt.netns)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2018 Red Hat
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+/*
+ * kokotap_pod: find pod sandbox of docker container
+ */
+import (
+	"context"
+	"fmt"
+	docker "github.com/docker/docker/client"
+)
+
+// GetDockerSandboxNS retrieves the network namespace of docker container's
+// pod sandbox (i.e. pause container, which the container joins by
+// 'container:<id>' network mode). If the container does not join other
+// container's network, the namespace of the container is returned.
+func GetDockerSandboxNS(procPrefix, containerID string) (string, error) {
+	ctx := context.Background()
+	cli, err := docker.NewClientWithOpts(docker.FromEnv)
+	if err != nil {
+		return "", err
+	}
+	cli.NegotiateAPIVersion(ctx)
+
+	info, err := cli.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get container info: %v", err)
+	}
+	if info.HostConfig != nil && info.HostConfig.NetworkMode.IsContainer() {
+		sandboxID := info.HostConfig.NetworkMode.ConnectedContainer()
+		info, err = cli.ContainerInspect(ctx, sandboxID)
+		if err != nil {
+			return "", fmt.Errorf("failed to get pod sandbox info: %v", err)
+		}
+	}
+	if info.State == nil || info.State.Pid == 0 {
+		return "", fmt.Errorf("container is not running: %q", info.ID)
+	}
+	return fmt.Sprintf("%s//proc/%d/ns/net", procPrefix, info.State.Pid), nil
+}
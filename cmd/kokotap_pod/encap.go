@@ -0,0 +1,282 @@
+// Copyright 2018 Red Hat
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+/*
+ * kokotap_pod: tunnel interface to encap mirrored packets
+ *
+ * VxLAN interface is made by koko.MakeVxLan. GRETAP and ERSPAN (type II/III)
+ * interfaces are made in the same way: created in the current namespace
+ * (the underlay stays there), then moved into the namespace and mirrored by
+ * koko.VEth.SetVethLink. Vendored netlink does not know ERSPAN, hence its
+ * netlink message is built here.
+ *
+ * VLAN and macvlan interfaces (RSPAN style, to the physical network) are
+ * added on the parent NIC by koko and moved by SetVethLink as well:
+ * koko.MakeVLan/MakeMacVLan set the mirror again after the move, in the
+ * namespace which does not have the interface any more.
+ *
+ * veth delivers the mirrored packets on the same node, without encap: the
+ * peer is in the host namespace (or the analysis pod) by koko.MakeVeth.
+ */
+import (
+	"encoding/binary"
+	"fmt"
+	koko "github.com/redhat-nfvpe/koko/api"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"net"
+	"syscall"
+)
+
+// encapsulations of tunnel interface
+const (
+	encapVxlan   = "vxlan"
+	encapGretap  = "gretap"
+	encapErspan  = "erspan"
+	encapGeneve  = "geneve" // by kokotap_pod, see geneve.go
+	encapVlan    = "vlan"
+	encapMacvlan = "macvlan"
+	encapVeth    = "veth"
+)
+
+// vlanMaxID is the max VLAN ID (0 and 4095 are reserved)
+const vlanMaxID = 4094
+
+// IFLA_GRE_* attributes for ERSPAN, which are not in vendored netlink
+const (
+	iflaGreErspanIndex = 21
+	iflaGreErspanVer   = 22
+	iflaGreErspanDir   = 23
+)
+
+// erspanMaxSessionID is the max ERSPAN session ID (10 bits)
+const erspanMaxSessionID = 0x3ff
+
+// tunnel is the interface to encap mirrored packets to the neighbor (IPAddr)
+// by Encap. ID is VxLAN ID, GRE key, ERSPAN session ID or VLAN ID. VLAN and
+// macvlan have no neighbor, the packets go to the network of ParentIF. veth
+// has Peer instead.
+type tunnel struct {
+	koko.VxLan
+	Encap         string
+	Peer          koko.VEth // other end of veth
+	LocalIP       net.IP    // local address of GRE (default: by route to IPAddr)
+	ErspanVersion int       // 1 (type II) or 2 (type III)
+	ErspanDir     string    // ingress or egress (type III)
+}
+
+// newTunnel returns the tunnel to the neighbor ip. The ERSPAN direction is
+// by mirrorType unless it is given.
+func newTunnel(encap, parentIF, localIP string, ip net.IP, id, port, erspanVersion int, erspanDir, mirrorType string) (tunnel, error) {
+	t := tunnel{Encap: encap}
+	t.ParentIF = parentIF
+	t.IPAddr = ip
+	t.ID = id
+	t.UDPPort = port
+	if localIP != "" {
+		if t.LocalIP = net.ParseIP(localIP); t.LocalIP == nil {
+			return t, fmt.Errorf("invalid egress ip %q", localIP)
+		}
+	}
+
+	switch encap {
+	case encapVeth:
+		return t, nil
+	case encapVlan, encapMacvlan:
+		if parentIF == "" {
+			return t, fmt.Errorf("parent interface is required for %s", encap)
+		}
+		if encap == encapVlan && (id < 1 || id > vlanMaxID) {
+			return t, fmt.Errorf("VLAN ID %d is out of range (1-%d)", id, vlanMaxID)
+		}
+		return t, nil
+	}
+	if ip == nil {
+		return t, fmt.Errorf("neighbor ip (vxlan-ip) is required for %s", encap)
+	}
+
+	switch encap {
+	case encapVxlan, encapGretap:
+	case encapErspan:
+		if id < 0 || id > erspanMaxSessionID {
+			return t, fmt.Errorf("ERSPAN session ID %d is out of range (0-%d)", id, erspanMaxSessionID)
+		}
+		if erspanVersion != 1 && erspanVersion != 2 {
+			return t, fmt.Errorf("invalid ERSPAN version %d (1: type II, 2: type III)", erspanVersion)
+		}
+		t.ErspanVersion = erspanVersion
+		t.ErspanDir = erspanDir
+		if t.ErspanDir == "" {
+			t.ErspanDir = "ingress"
+			if mirrorType == "egress" {
+				t.ErspanDir = "egress"
+			}
+		}
+	default:
+		return t, fmt.Errorf("unknown encap %q", encap)
+	}
+	return t, nil
+}
+
+// localIP returns the local address of GRE, the source address of the route
+// to the neighbor if it is not given.
+func (t *tunnel) localIP() (net.IP, error) {
+	if t.LocalIP != nil {
+		return t.LocalIP, nil
+	}
+	routes, err := netlink.RouteGet(t.IPAddr)
+	if err != nil || len(routes) == 0 || routes[0].Src == nil {
+		return nil, fmt.Errorf("no route to %s: %v", t.IPAddr, err)
+	}
+	return routes[0].Src, nil
+}
+
+// ipBytes returns the address as GRE attribute (4 bytes for IPv4).
+func ipBytes(ip net.IP) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip.To16()
+}
+
+// addErspanLink adds ERSPAN interface (ip6erspan for IPv6). ERSPAN needs
+// GRE key (session ID) and sequence number.
+func (t *tunnel) addErspanLink(name string, local net.IP, parentIndex int) error {
+	kind := "erspan"
+	if local.To4() == nil {
+		kind = "ip6erspan"
+	}
+	key := make([]byte, 4)
+	binary.BigEndian.PutUint32(key, uint32(t.ID))
+	flags := make([]byte, 2)
+	binary.BigEndian.PutUint16(flags, nl.GRE_KEY|nl.GRE_SEQ)
+
+	req := nl.NewNetlinkRequest(syscall.RTM_NEWLINK,
+		syscall.NLM_F_CREATE|syscall.NLM_F_EXCL|syscall.NLM_F_ACK)
+	req.AddData(nl.NewIfInfomsg(syscall.AF_UNSPEC))
+	req.AddData(nl.NewRtAttr(syscall.IFLA_IFNAME, nl.ZeroTerminated(name)))
+	req.AddData(nl.NewRtAttr(syscall.IFLA_TXQLEN, nl.Uint32Attr(1000)))
+
+	linkInfo := nl.NewRtAttr(syscall.IFLA_LINKINFO, nil)
+	nl.NewRtAttrChild(linkInfo, nl.IFLA_INFO_KIND, nl.NonZeroTerminated(kind))
+	data := nl.NewRtAttrChild(linkInfo, nl.IFLA_INFO_DATA, nil)
+	if parentIndex != 0 {
+		nl.NewRtAttrChild(data, nl.IFLA_GRE_LINK, nl.Uint32Attr(uint32(parentIndex)))
+	}
+	nl.NewRtAttrChild(data, nl.IFLA_GRE_LOCAL, ipBytes(local))
+	nl.NewRtAttrChild(data, nl.IFLA_GRE_REMOTE, ipBytes(t.IPAddr))
+	nl.NewRtAttrChild(data, nl.IFLA_GRE_IKEY, key)
+	nl.NewRtAttrChild(data, nl.IFLA_GRE_OKEY, key)
+	nl.NewRtAttrChild(data, nl.IFLA_GRE_IFLAGS, flags)
+	nl.NewRtAttrChild(data, nl.IFLA_GRE_OFLAGS, flags)
+	nl.NewRtAttrChild(data, nl.IFLA_GRE_PMTUDISC, nl.Uint8Attr(0))
+	nl.NewRtAttrChild(data, iflaGreErspanVer, nl.Uint8Attr(uint8(t.ErspanVersion)))
+	if t.ErspanVersion == 1 {
+		nl.NewRtAttrChild(data, iflaGreErspanIndex, nl.Uint32Attr(0))
+	} else {
+		dir := uint8(0)
+		if t.ErspanDir == "egress" {
+			dir = 1
+		}
+		nl.NewRtAttrChild(data, iflaGreErspanDir, nl.Uint8Attr(dir))
+	}
+	req.AddData(linkInfo)
+
+	_, err := req.Execute(syscall.NETLINK_ROUTE, 0)
+	return err
+}
+
+// addGRELink adds GRETAP or ERSPAN interface, named name, in current
+// namespace.
+func (t *tunnel) addGRELink(name string) (netlink.Link, error) {
+	local, err := t.localIP()
+	if err != nil {
+		return nil, err
+	}
+	if (local.To4() == nil) != (t.IPAddr.To4() == nil) {
+		return nil, fmt.Errorf("address family mismatch: %s and %s", local, t.IPAddr)
+	}
+	parentIndex := 0
+	if t.ParentIF != "" {
+		parent, err := netlink.LinkByName(t.ParentIF)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get %s: %v", t.ParentIF, err)
+		}
+		parentIndex = parent.Attrs().Index
+	}
+
+	if t.Encap == encapErspan {
+		err = t.addErspanLink(name, local, parentIndex)
+	} else {
+		err = netlink.LinkAdd(&netlink.Gretap{
+			LinkAttrs: netlink.LinkAttrs{
+				Name:   name,
+				TxQLen: 1000,
+			},
+			IKey:   uint32(t.ID),
+			OKey:   uint32(t.ID),
+			Local:  local,
+			Remote: t.IPAddr,
+			Link:   uint32(parentIndex),
+		})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to add %s %s: %v", t.Encap, name, err)
+	}
+	return netlink.LinkByName(name)
+}
+
+// addVLANLink adds VLAN or macvlan interface, named name, on the parent
+// interface in current namespace. macvlan is private mode, so that the
+// mirrored packets always go out of the parent interface.
+func (t *tunnel) addVLANLink(name string) (netlink.Link, error) {
+	var err error
+	if t.Encap == encapVlan {
+		err = koko.AddVLanInterface(koko.VLan{ParentIF: t.ParentIF, ID: t.ID}, name)
+	} else {
+		err = koko.AddMacVLanInterface(koko.MacVLan{
+			ParentIF: t.ParentIF,
+			Mode:     netlink.MACVLAN_MODE_PRIVATE,
+		}, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return netlink.LinkByName(name)
+}
+
+// makeTunnel makes the tunnel interface of veth and puts it into the
+// namespace of veth, with the mirror of veth.
+func makeTunnel(veth koko.VEth, t tunnel) error {
+	var link netlink.Link
+	var err error
+	switch t.Encap {
+	case "", encapVxlan:
+		return koko.MakeVxLan(veth, t.VxLan)
+	case encapVeth:
+		return koko.MakeVeth(veth, t.Peer)
+	case encapVlan, encapMacvlan:
+		link, err = t.addVLANLink(veth.LinkName)
+	default:
+		link, err = t.addGRELink(veth.LinkName)
+	}
+	if err != nil {
+		return fmt.Errorf("%s add failed: %v", t.Encap, err)
+	}
+	if err = veth.SetVethLink(link); err != nil {
+		return fmt.Errorf("failed to move %s into namespace: %v", veth.LinkName, err)
+	}
+	return nil
+}
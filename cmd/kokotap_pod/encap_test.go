@@ -0,0 +1,146 @@
+// Copyright 2018 Red Hat
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	koko "github.com/redhat-nfvpe/koko/api"
+	"net"
+	"testing"
+)
+
+func TestNewTunnel(t *testing.T) {
+	neighbor := net.ParseIP("10.0.0.1")
+	tests := []struct {
+		name       string
+		encap      string
+		parentIF   string
+		localIP    string
+		ip         net.IP
+		id         int
+		version    int
+		dir        string
+		mirrorType string
+		wantDir    string
+		wantErr    bool
+	}{
+		{name: "vxlan", encap: encapVxlan, ip: neighbor, id: 100},
+		{name: "gretap", encap: encapGretap, ip: neighbor, id: 100, localIP: "10.0.0.2"},
+		{name: "gretap without neighbor", encap: encapGretap, id: 100, wantErr: true},
+		{name: "invalid local IP", encap: encapGretap, ip: neighbor, localIP: "10.0.0", wantErr: true},
+		{name: "erspan type II", encap: encapErspan, ip: neighbor, id: 100, version: 1, mirrorType: "both", wantDir: "ingress"},
+		{name: "erspan egress", encap: encapErspan, ip: neighbor, id: 100, version: 2, mirrorType: "egress", wantDir: "egress"},
+		{name: "erspan given direction", encap: encapErspan, ip: neighbor, id: 100, version: 2, dir: "egress", mirrorType: "ingress", wantDir: "egress"},
+		{name: "erspan max session ID", encap: encapErspan, ip: neighbor, id: erspanMaxSessionID, version: 1, wantDir: "ingress"},
+		{name: "erspan session ID out of range", encap: encapErspan, ip: neighbor, id: erspanMaxSessionID + 1, version: 1, wantErr: true},
+		{name: "erspan unknown version", encap: encapErspan, ip: neighbor, id: 100, version: 3, wantErr: true},
+		{name: "vlan", encap: encapVlan, parentIF: "eth1", id: 10},
+		{name: "vlan without parent", encap: encapVlan, id: 10, wantErr: true},
+		{name: "vlan ID out of range", encap: encapVlan, parentIF: "eth1", id: vlanMaxID + 1, wantErr: true},
+		{name: "veth", encap: encapVeth},
+		{name: "unknown encap", encap: "ipip", ip: neighbor, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		tun, err := newTunnel(tt.encap, tt.parentIF, tt.localIP, tt.ip, tt.id, 4789, tt.version, tt.dir, tt.mirrorType)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if tun.Encap != tt.encap || tun.ID != tt.id || !tun.IPAddr.Equal(tt.ip) {
+			t.Errorf("%s: tunnel is %s %d to %s", tt.name, tun.Encap, tun.ID, tun.IPAddr)
+		}
+		if tun.ErspanDir != tt.wantDir {
+			t.Errorf("%s: ERSPAN direction = %q, want %q", tt.name, tun.ErspanDir, tt.wantDir)
+		}
+		if tt.localIP != "" && !tun.LocalIP.Equal(net.ParseIP(tt.localIP)) {
+			t.Errorf("%s: local IP = %s, want %s", tt.name, tun.LocalIP, tt.localIP)
+		}
+	}
+}
+
+func TestTunnelLocalIP(t *testing.T) {
+	given := &tunnel{LocalIP: net.ParseIP("10.0.0.2")}
+	if ip, err := given.localIP(); err != nil || !ip.Equal(given.LocalIP) {
+		t.Errorf("given: local IP = %s (%v), want %s", ip, err, given.LocalIP)
+	}
+
+	// by the source of the route to the neighbor
+	routed := &tunnel{}
+	routed.IPAddr = net.ParseIP("127.0.0.1")
+	if ip, err := routed.localIP(); err != nil || !ip.IsLoopback() {
+		t.Errorf("route: local IP = %s (%v), want loopback", ip, err)
+	}
+}
+
+func TestVethTunnel(t *testing.T) {
+	targetNS, cleanupTarget := newTestNS(t, "eth0")
+	defer cleanupTarget()
+	destNS, cleanupDest := newTestNS(t)
+	defer cleanupDest()
+
+	veth := koko.VEth{NsName: targetNS, LinkName: "mirror"}
+	args := &senderArgs{IfName: "mirror", DestIfName: "mirror0"}
+	if _, err := parseVethPeer("", args, &veth); err != nil {
+		t.Fatalf("peer in host: %v", err)
+	}
+	args.DestIfName = "lo"
+	if _, err := parseVethPeer("", args, &veth); err == nil {
+		t.Errorf("no error for existing peer")
+	}
+	args.DestIfName = ""
+	same := koko.VEth{LinkName: "mirror"}
+	if _, err := parseVethPeer("", args, &same); err == nil {
+		t.Errorf("no error for peer of the same name in the same namespace")
+	}
+
+	// the peer is in dest namespace, of the name of veth by default
+	peer := koko.VEth{NsName: destNS, LinkName: "mirror"}
+	tun := tunnel{Encap: encapVeth, Peer: peer}
+	if err := makeTunnel(veth, tun); err != nil {
+		t.Skipf("veth is not supported: %v", err)
+	}
+	for _, v := range []koko.VEth{veth, peer} {
+		if exists, err := linkExists(v.NsName, v.LinkName); err != nil || !exists {
+			t.Errorf("%s is not in %s: %v", v.LinkName, v.NsName, err)
+		}
+	}
+	if exists, _ := linkExists("", veth.LinkName); exists {
+		t.Errorf("%s is left in current namespace", veth.LinkName)
+	}
+
+	m := mirror{VEth: mirrorVEth(veth, "ingress", "eth0")}
+	if err := m.set(); err != nil {
+		t.Skipf("tc ingress mirror is not supported: %v", err)
+	}
+	infos, err := listInterfaces(targetNS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range infos {
+		if info.Name != "eth0" {
+			continue
+		}
+		if len(info.Mirrors) != 1 {
+			t.Errorf("eth0: mirrors are %+v, want ingress", info.Mirrors)
+		}
+		for _, mirror := range info.Mirrors {
+			if mirror.Dest != "mirror" || !mirror.Kokotap {
+				t.Errorf("eth0: mirror is %+v, want kokotap mirror to mirror", mirror)
+			}
+		}
+	}
+}
@@ -0,0 +1,306 @@
+// Copyright 2018 Red Hat
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+/*
+ * kokotap_pod: mirror for node interfaces and hostNetwork pods
+ *
+ * hostNetwork pod shares the interfaces with the node, hence only the
+ * packets of the pod's IP/port are mirrored by u32 filters (IPv4 without IP
+ * options). The filters (and the qdiscs added by kokotap) are removed at exit
+ * without touching other qdiscs/filters of the node interface, which may be
+ * used by CNI plugins.
+ */
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/vishvananda/netlink"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// mirrorFilterPriority is the tc filter priority of kokotap filters
+const mirrorFilterPriority = 0xc0c0
+
+// tunnelFilterPriority is the tc filter priority of the filter which passes
+// the packets of the sender tunnel, before the mirror filters
+const tunnelFilterPriority = mirrorFilterPriority - 1
+
+// mirrorProtocols are IP protocol numbers of filter protocol names
+var mirrorProtocols = map[string]uint32{
+	"tcp":  syscall.IPPROTO_TCP,
+	"udp":  syscall.IPPROTO_UDP,
+	"sctp": 132,
+}
+
+// mirrorFilter matches the packets of the protocol, to/from IP and port.
+type mirrorFilter struct {
+	Protocol uint32
+	IP       net.IP
+	Port     uint32
+}
+
+// parseMirrorFilter parses filter, given as 'protocol:ip:port'.
+func parseMirrorFilter(filter string) (mirrorFilter, error) {
+	f := mirrorFilter{}
+	fields := strings.Split(filter, ":")
+	if len(fields) != 3 {
+		return f, fmt.Errorf("invalid filter %q (protocol:ip:port)", filter)
+	}
+
+	protocol, ok := mirrorProtocols[strings.ToLower(fields[0])]
+	if !ok {
+		return f, fmt.Errorf("unsupported protocol in filter %q", filter)
+	}
+	ip := net.ParseIP(fields[1]).To4()
+	if ip == nil {
+		return f, fmt.Errorf("invalid IPv4 address in filter %q", filter)
+	}
+	port, err := strconv.ParseUint(fields[2], 10, 16)
+	if err != nil {
+		return f, fmt.Errorf("invalid port in filter %q: %v", filter, err)
+	}
+	return mirrorFilter{Protocol: protocol, IP: ip, Port: uint32(port)}, nil
+}
+
+// u32Keys returns u32 keys which match the packets to the IP (dst) or from
+// the IP (!dst), and which have the port as source or destination port.
+func (f *mirrorFilter) u32Keys(dst bool) [][]netlink.TcU32Key {
+	ipOff := int32(12)
+	if dst {
+		ipOff = 16
+	}
+	keys := []netlink.TcU32Key{
+		{Mask: 0x00ff0000, Val: f.Protocol << 16, Off: 8},
+		{Mask: 0xffffffff, Val: binary.BigEndian.Uint32(f.IP), Off: ipOff},
+	}
+	// source port (upper 16bit) and destination port (lower 16bit)
+	srcPort := append([]netlink.TcU32Key{{Mask: 0xffff0000, Val: f.Port << 16, Off: 20}}, keys...)
+	dstPort := append([]netlink.TcU32Key{{Mask: 0x0000ffff, Val: f.Port, Off: 20}}, keys...)
+	return [][]netlink.TcU32Key{srcPort, dstPort}
+}
+
+// match returns true if the Ethernet frame matches with the keys of u32Keys
+// (the IP header may have options).
+func (f *mirrorFilter) match(frame []byte, dst bool) bool {
+	if len(frame) < 14+20 || binary.BigEndian.Uint16(frame[12:]) != syscall.ETH_P_IP {
+		return false
+	}
+	ip := frame[14:]
+	ihl := int(ip[0]&0x0f) * 4
+	if uint32(ip[9]) != f.Protocol || len(ip) < ihl+4 {
+		return false
+	}
+	addr := net.IP(ip[12:16])
+	if dst {
+		addr = net.IP(ip[16:20])
+	}
+	if !addr.Equal(f.IP) {
+		return false
+	}
+	srcPort := uint32(binary.BigEndian.Uint16(ip[ihl:]))
+	dstPort := uint32(binary.BigEndian.Uint16(ip[ihl+2:]))
+	return srcPort == f.Port || dstPort == f.Port
+}
+
+// tunnelU32Keys returns u32 keys which match the packets of the tunnel to the
+// neighbor (IPv4 without IP options), or ESP packets to the neighbor if the
+// tunnel is encrypted. It returns nil if it is not an IPv4 tunnel.
+func tunnelU32Keys(t *tunnel, esp bool) [][]netlink.TcU32Key {
+	ip := t.IPAddr.To4()
+	if ip == nil {
+		return nil
+	}
+	ipKey := netlink.TcU32Key{Mask: 0xffffffff, Val: binary.BigEndian.Uint32(ip), Off: 16}
+	var keys []netlink.TcU32Key
+	switch t.Encap {
+	case encapVxlan:
+		port := uint32(t.UDPPort)
+		if port == 0 {
+			port = 4789
+		}
+		keys = []netlink.TcU32Key{
+			{Mask: 0x00ff0000, Val: syscall.IPPROTO_UDP << 16, Off: 8},
+			ipKey,
+			{Mask: 0x0000ffff, Val: port, Off: 20},
+		}
+	case encapGretap, encapErspan:
+		keys = []netlink.TcU32Key{
+			{Mask: 0x00ff0000, Val: syscall.IPPROTO_GRE << 16, Off: 8},
+			ipKey,
+		}
+	default:
+		return nil
+	}
+	if esp {
+		return [][]netlink.TcU32Key{keys, {
+			{Mask: 0x00ff0000, Val: syscall.IPPROTO_ESP << 16, Off: 8},
+			ipKey,
+		}}
+	}
+	return [][]netlink.TcU32Key{keys}
+}
+
+// addQdisc adds the qdisc if it does not exist.
+func (m *mirror) addQdisc(qdisc netlink.Qdisc) error {
+	err := netlink.QdiscAdd(qdisc)
+	if err == nil {
+		m.qdiscs = append(m.qdiscs, qdisc)
+		return nil
+	}
+	if os.IsExist(err) {
+		return nil
+	}
+	return err
+}
+
+// addFilters adds the filters which mirror the packets of link to dest (all
+// packets if no Filters), except the egress packets of Tunnel.
+func (m *mirror) addFilters(link, dest netlink.Link, parent uint32, dst bool) error {
+	protocol := uint16(syscall.ETH_P_ALL)
+	keySets := [][]netlink.TcU32Key{{{Mask: 0, Val: 0}}}
+	if len(m.Filters) > 0 {
+		protocol = syscall.ETH_P_IP
+		keySets = [][]netlink.TcU32Key{}
+		for _, f := range m.Filters {
+			keySets = append(keySets, f.u32Keys(dst)...)
+		}
+	}
+
+	// the tunnel may go through the node interface: do not mirror own packets
+	if m.Tunnel != nil && !dst {
+		for _, keys := range tunnelU32Keys(m.Tunnel, m.Encrypted) {
+			filter := &netlink.U32{
+				FilterAttrs: netlink.FilterAttrs{
+					LinkIndex: link.Attrs().Index,
+					Parent:    parent,
+					Priority:  tunnelFilterPriority,
+					Protocol:  syscall.ETH_P_IP,
+				},
+				Sel: &netlink.TcU32Sel{
+					Keys:  keys,
+					Flags: netlink.TC_U32_TERMINAL,
+				},
+				Actions: []netlink.Action{
+					&netlink.GenericAction{
+						ActionAttrs: netlink.ActionAttrs{
+							Action: netlink.TC_ACT_OK,
+						},
+					},
+				},
+			}
+			if err := netlink.FilterAdd(filter); err != nil {
+				return err
+			}
+			m.filters = append(m.filters, filter)
+		}
+	}
+
+	for _, keys := range keySets {
+		filter := &netlink.U32{
+			FilterAttrs: netlink.FilterAttrs{
+				LinkIndex: link.Attrs().Index,
+				Parent:    parent,
+				Priority:  mirrorFilterPriority,
+				Protocol:  protocol,
+			},
+			Sel: &netlink.TcU32Sel{
+				Keys:  keys,
+				Flags: netlink.TC_U32_TERMINAL,
+			},
+			Actions: []netlink.Action{
+				&netlink.MirredAction{
+					ActionAttrs: netlink.ActionAttrs{
+						Action: netlink.TC_ACT_PIPE,
+					},
+					MirredAction: netlink.TCA_EGRESS_MIRROR,
+					Ifindex:      dest.Attrs().Index,
+				},
+			},
+		}
+		if err := netlink.FilterAdd(filter); err != nil {
+			return err
+		}
+		m.filters = append(m.filters, filter)
+	}
+	return nil
+}
+
+// setFilters mirrors the packets matched with the filters (all packets if no
+// Filters): ingress packets to the IP and egress packets from the IP.
+func (m *mirror) setFilters() error {
+	dest, err := netlink.LinkByName(m.LinkName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", m.LinkName, err)
+	}
+
+	if m.MirrorIngress != "" {
+		link, err := netlink.LinkByName(m.MirrorIngress)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", m.MirrorIngress, err)
+		}
+		qdisc := &netlink.Ingress{
+			QdiscAttrs: netlink.QdiscAttrs{
+				LinkIndex: link.Attrs().Index,
+				Handle:    netlink.MakeHandle(0xffff, 0),
+				Parent:    netlink.HANDLE_INGRESS,
+			},
+		}
+		if err := m.addQdisc(qdisc); err != nil {
+			return fmt.Errorf("failed to add ingress qdisc: %v", err)
+		}
+		if err := m.addFilters(link, dest, netlink.MakeHandle(0xffff, 0), true); err != nil {
+			return fmt.Errorf("failed to set tc ingress mirror: %v", err)
+		}
+	}
+
+	if m.MirrorEgress != "" {
+		link, err := netlink.LinkByName(m.MirrorEgress)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", m.MirrorEgress, err)
+		}
+		qdisc := netlink.NewPrio(netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(1, 0),
+			Parent:    netlink.HANDLE_ROOT,
+		})
+		if err := m.addQdisc(qdisc); err != nil {
+			return fmt.Errorf("failed to add egress qdisc: %v", err)
+		}
+		if err := m.addFilters(link, dest, netlink.MakeHandle(1, 0), false); err != nil {
+			return fmt.Errorf("failed to set tc egress mirror: %v", err)
+		}
+	}
+	return nil
+}
+
+// unsetFilters removes the filters, and the qdiscs added by setFilters.
+func (m *mirror) unsetFilters() error {
+	var lastErr error
+	for _, filter := range m.filters {
+		// the filters of same priority may be removed together
+		if err := netlink.FilterDel(filter); err != nil && err != syscall.ENOENT {
+			lastErr = err
+		}
+	}
+	for _, qdisc := range m.qdiscs {
+		if err := netlink.QdiscDel(qdisc); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
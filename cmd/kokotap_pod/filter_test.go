@@ -0,0 +1,169 @@
+// Copyright 2018 Red Hat
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/binary"
+	"github.com/vishvananda/netlink"
+	"net"
+	"testing"
+)
+
+func TestParseMirrorFilter(t *testing.T) {
+	tests := []struct {
+		filter  string
+		want    mirrorFilter
+		wantErr bool
+	}{
+		{
+			filter: "tcp:10.0.0.1:80",
+			want:   mirrorFilter{Protocol: 6, IP: net.ParseIP("10.0.0.1").To4(), Port: 80},
+		},
+		{
+			filter: "UDP:192.168.1.10:53",
+			want:   mirrorFilter{Protocol: 17, IP: net.ParseIP("192.168.1.10").To4(), Port: 53},
+		},
+		{
+			filter: "sctp:10.0.0.1:38412",
+			want:   mirrorFilter{Protocol: 132, IP: net.ParseIP("10.0.0.1").To4(), Port: 38412},
+		},
+		{filter: "tcp:10.0.0.1", wantErr: true},
+		{filter: "icmp:10.0.0.1:0", wantErr: true},
+		{filter: "tcp:fd00::1:80", wantErr: true},
+		{filter: "tcp:10.0.0.1:http", wantErr: true},
+		{filter: "tcp:10.0.0.1:65536", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		f, err := parseMirrorFilter(tt.filter)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: unexpected error: %v", tt.filter, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if f.Protocol != tt.want.Protocol || !f.IP.Equal(tt.want.IP) || f.Port != tt.want.Port {
+			t.Errorf("%s: filter = %+v, want %+v", tt.filter, f, tt.want)
+		}
+	}
+}
+
+// ipFrame returns Ethernet frame of IPv4 packet (with ihl in 4 bytes) of the
+// protocol and the ports.
+func ipFrame(protocol byte, src, dst string, ihl int, srcPort, dstPort uint16) []byte {
+	frame := make([]byte, 14+ihl*4+4)
+	binary.BigEndian.PutUint16(frame[12:], 0x0800)
+	ip := frame[14:]
+	ip[0] = 0x40 | byte(ihl)
+	ip[9] = protocol
+	copy(ip[12:], net.ParseIP(src).To4())
+	copy(ip[16:], net.ParseIP(dst).To4())
+	binary.BigEndian.PutUint16(ip[ihl*4:], srcPort)
+	binary.BigEndian.PutUint16(ip[ihl*4+2:], dstPort)
+	return frame
+}
+
+// u32Match returns true if the IP header matches with any of the key sets,
+// as u32 filters of u32Keys do.
+func u32Match(keySets [][]netlink.TcU32Key, ip []byte) bool {
+	for _, keys := range keySets {
+		matched := true
+		for _, key := range keys {
+			if binary.BigEndian.Uint32(ip[key.Off:])&key.Mask != key.Val {
+				matched = false
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMirrorFilterMatch(t *testing.T) {
+	f, err := parseMirrorFilter("tcp:10.0.0.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		frame []byte
+		dst   bool
+		want  bool
+	}{
+		{name: "to port", frame: ipFrame(6, "10.0.0.2", "10.0.0.1", 5, 34567, 80), dst: true, want: true},
+		{name: "from port", frame: ipFrame(6, "10.0.0.1", "10.0.0.2", 5, 80, 34567), want: true},
+		{name: "to address of source", frame: ipFrame(6, "10.0.0.2", "10.0.0.1", 5, 34567, 80)},
+		{name: "other port", frame: ipFrame(6, "10.0.0.2", "10.0.0.1", 5, 34567, 443), dst: true},
+		{name: "other protocol", frame: ipFrame(17, "10.0.0.2", "10.0.0.1", 5, 34567, 80), dst: true},
+		{name: "other address", frame: ipFrame(6, "10.0.0.2", "10.0.0.3", 5, 34567, 80), dst: true},
+		{name: "ip options", frame: ipFrame(6, "10.0.0.2", "10.0.0.1", 6, 34567, 80), dst: true, want: true},
+		{name: "short frame", frame: make([]byte, 20), dst: true},
+	}
+
+	for _, tt := range tests {
+		if got := f.match(tt.frame, tt.dst); got != tt.want {
+			t.Errorf("%s: match = %v, want %v", tt.name, got, tt.want)
+		}
+		// u32 filters do not support IP options
+		if len(tt.frame) != 14+20+4 {
+			continue
+		}
+		if got := u32Match(f.u32Keys(tt.dst), tt.frame[14:]); got != tt.want {
+			t.Errorf("%s: u32 keys match = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTunnelU32Keys(t *testing.T) {
+	vxlan, _ := newTunnel(encapVxlan, "eth0", "", net.ParseIP("10.0.0.1"), 100, 14789, 0, "", "both")
+	vxlanDefault, _ := newTunnel(encapVxlan, "eth0", "", net.ParseIP("10.0.0.1"), 100, 0, 0, "", "both")
+	gretap, _ := newTunnel(encapGretap, "eth0", "", net.ParseIP("10.0.0.1"), 100, 0, 0, "", "both")
+	vlan, _ := newTunnel(encapVlan, "eth0", "", nil, 100, 0, 0, "", "both")
+
+	tests := []struct {
+		name   string
+		tunnel tunnel
+		esp    bool
+		frame  []byte
+		want   bool
+	}{
+		{name: "vxlan", tunnel: vxlan, frame: ipFrame(17, "10.0.0.2", "10.0.0.1", 5, 34567, 14789), want: true},
+		{name: "vxlan default port", tunnel: vxlanDefault, frame: ipFrame(17, "10.0.0.2", "10.0.0.1", 5, 34567, 4789), want: true},
+		{name: "vxlan other port", tunnel: vxlan, frame: ipFrame(17, "10.0.0.2", "10.0.0.1", 5, 34567, 4789)},
+		{name: "vxlan from neighbor", tunnel: vxlan, frame: ipFrame(17, "10.0.0.1", "10.0.0.2", 5, 34567, 14789)},
+		{name: "vxlan other address", tunnel: vxlan, frame: ipFrame(17, "10.0.0.2", "10.0.0.3", 5, 34567, 14789)},
+		{name: "vxlan tcp", tunnel: vxlan, frame: ipFrame(6, "10.0.0.2", "10.0.0.1", 5, 34567, 14789)},
+		{name: "gretap", tunnel: gretap, frame: ipFrame(47, "10.0.0.2", "10.0.0.1", 5, 0, 0), want: true},
+		{name: "gretap udp", tunnel: gretap, frame: ipFrame(17, "10.0.0.2", "10.0.0.1", 5, 34567, 4789)},
+		{name: "vxlan esp", tunnel: vxlan, esp: true, frame: ipFrame(50, "10.0.0.2", "10.0.0.1", 5, 0, 0), want: true},
+		{name: "vxlan esp not encrypted", tunnel: vxlan, frame: ipFrame(50, "10.0.0.2", "10.0.0.1", 5, 0, 0)},
+		{name: "vxlan esp other address", tunnel: vxlan, esp: true, frame: ipFrame(50, "10.0.0.2", "10.0.0.3", 5, 0, 0)},
+		{name: "vlan", tunnel: vlan, frame: ipFrame(17, "10.0.0.2", "10.0.0.1", 5, 34567, 4789)},
+	}
+
+	for _, tt := range tests {
+		keySets := tunnelU32Keys(&tt.tunnel, tt.esp)
+		if keySets == nil {
+			if tt.want {
+				t.Errorf("%s: no u32 keys", tt.name)
+			}
+			continue
+		}
+		if got := u32Match(keySets, tt.frame[14:]); got != tt.want {
+			t.Errorf("%s: u32 keys match = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
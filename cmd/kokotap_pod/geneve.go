@@ -0,0 +1,446 @@
+// Copyright 2018 Red Hat
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+/*
+ * kokotap_pod: Geneve encapsulation with target metadata in options
+ *
+ * The kernel cannot add Geneve options to the packets mirrored by tc (it
+ * needs flow based device and tunnel_key action per flow), hence Geneve is
+ * done in kokotap_pod. Sender captures the mirror interfaces by AF_PACKET
+ * socket in the namespace (as tcpdump does, so nothing is added to the
+ * namespace) and sends the frames over UDP with option TLVs of the target,
+ * the interface and the direction. Receiver decapsulates them to a dummy
+ * interface for each sender (captured as VxLAN receiver interface), and
+ * writes them to pcapng with the options as labels (see pcapng.go).
+ */
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// Geneve option class of kokotap (in experimental range) and option types
+const (
+	geneveOptClass     = 0xffc0
+	geneveOptTarget    = 1 // target pod (namespace/name) or node name
+	geneveOptInterface = 2 // mirrored interface name
+	geneveOptDirection = 3 // geneveIngress or geneveEgress
+)
+
+// values of geneveOptDirection
+const (
+	geneveIngress = 0
+	geneveEgress  = 1
+)
+
+// geneveEthernet is Geneve protocol type of Ethernet frames
+const geneveEthernet = 0x6558
+
+// geneveMaxPayload is max UDP payload, longer frames are truncated
+const geneveMaxPayload = 65507
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// geneveOption returns the option TLV of kokotap. The value is padded to 4
+// bytes and truncated to 124 bytes (max option length).
+func geneveOption(optType byte, value []byte) []byte {
+	if len(value) > 124 {
+		value = value[0:124]
+	}
+	length := (len(value) + 3) / 4
+	opt := make([]byte, 4+length*4)
+	binary.BigEndian.PutUint16(opt[0:], geneveOptClass)
+	opt[2] = optType
+	opt[3] = byte(length)
+	copy(opt[4:], value)
+	return opt
+}
+
+// geneveHeader returns Geneve header, for Ethernet frame, with the options.
+func geneveHeader(vni int, opts ...[]byte) []byte {
+	hdr := make([]byte, 8)
+	for _, opt := range opts {
+		hdr = append(hdr, opt...)
+	}
+	hdr[0] = byte((len(hdr) - 8) / 4) // version 0
+	binary.BigEndian.PutUint16(hdr[2:], geneveEthernet)
+	binary.BigEndian.PutUint32(hdr[4:], uint32(vni)<<8)
+	return hdr
+}
+
+// geneveMetadata is the kokotap options of Geneve packet.
+type geneveMetadata struct {
+	Target    string
+	Interface string
+	Egress    bool
+}
+
+// parseGeneve returns VNI, kokotap options and the inner frame of Geneve
+// packet.
+func parseGeneve(pkt []byte) (int, *geneveMetadata, []byte, error) {
+	if len(pkt) < 8 {
+		return 0, nil, nil, fmt.Errorf("short geneve packet")
+	}
+	if pkt[0]>>6 != 0 || binary.BigEndian.Uint16(pkt[2:]) != geneveEthernet {
+		return 0, nil, nil, fmt.Errorf("unsupported geneve packet")
+	}
+	optLen := int(pkt[0]&0x3f) * 4
+	if len(pkt) < 8+optLen {
+		return 0, nil, nil, fmt.Errorf("short geneve options")
+	}
+	vni := int(binary.BigEndian.Uint32(pkt[4:]) >> 8)
+
+	meta := &geneveMetadata{}
+	opts := pkt[8 : 8+optLen]
+	for len(opts) >= 4 {
+		length := 4 + int(opts[3]&0x1f)*4
+		if len(opts) < length {
+			return 0, nil, nil, fmt.Errorf("invalid geneve option")
+		}
+		value := opts[4:length]
+		if binary.BigEndian.Uint16(opts[0:]) == geneveOptClass {
+			switch opts[2] {
+			case geneveOptTarget:
+				meta.Target = strings.TrimRight(string(value), "\x00")
+			case geneveOptInterface:
+				meta.Interface = strings.TrimRight(string(value), "\x00")
+			case geneveOptDirection:
+				meta.Egress = len(value) > 0 && value[0] == geneveEgress
+			}
+		}
+		opts = opts[length:]
+	}
+	return vni, meta, pkt[8+optLen:], nil
+}
+
+// openPacketSocket returns AF_PACKET socket bound to the interface in the
+// namespace (the socket stays in the namespace).
+func openPacketSocket(nsName, ifName string) (int, error) {
+	netns, err := getNS(nsName)
+	if err != nil {
+		return -1, err
+	}
+	defer netns.Close()
+
+	fd := -1
+	err = netns.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+		}
+		if fd, err = syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(syscall.ETH_P_ALL))); err != nil {
+			return err
+		}
+		err = syscall.Bind(fd, &syscall.SockaddrLinklayer{
+			Protocol: htons(syscall.ETH_P_ALL),
+			Ifindex:  link.Attrs().Index,
+		})
+		if err != nil {
+			syscall.Close(fd)
+			return fmt.Errorf("failed to bind %q: %v", ifName, err)
+		}
+		return nil
+	})
+	return fd, err
+}
+
+// isUDPTo returns true if the frame is UDP packet to the address.
+func isUDPTo(frame []byte, addr *net.UDPAddr) bool {
+	if len(frame) < 14 {
+		return false
+	}
+	var dst net.IP
+	var udp []byte
+	switch ip := frame[14:]; binary.BigEndian.Uint16(frame[12:]) {
+	case syscall.ETH_P_IP:
+		if len(ip) < 20 || ip[9] != syscall.IPPROTO_UDP {
+			return false
+		}
+		dst, udp = net.IP(ip[16:20]), ip[int(ip[0]&0x0f)*4:]
+	case syscall.ETH_P_IPV6:
+		if len(ip) < 40 || ip[6] != syscall.IPPROTO_UDP {
+			return false
+		}
+		dst, udp = net.IP(ip[24:40]), ip[40:]
+	default:
+		return false
+	}
+	return len(udp) >= 4 && int(binary.BigEndian.Uint16(udp[2:])) == addr.Port && dst.Equal(addr.IP)
+}
+
+// geneveSender sends the frames of the mirror interfaces to the receiver.
+type geneveSender struct {
+	conn       *net.UDPConn
+	dest       *net.UDPAddr
+	vni        int
+	target     string
+	mirrorType string
+	filters    []mirrorFilter
+	host       bool // capture node interfaces (skip own Geneve packets)
+}
+
+// mirrored returns true if the frame of the direction is mirrored.
+func (s *geneveSender) mirrored(frame []byte, egress bool) bool {
+	if (s.mirrorType == "ingress" && egress) || (s.mirrorType == "egress" && !egress) {
+		return false
+	}
+	if s.host && egress && isUDPTo(frame, s.dest) {
+		return false
+	}
+	if len(s.filters) == 0 {
+		return true
+	}
+	for _, f := range s.filters {
+		// ingress packets to the IP and egress packets from the IP
+		if f.match(frame, !egress) {
+			return true
+		}
+	}
+	return false
+}
+
+// capture sends the frames of the interface (socket fd) until the socket is
+// closed.
+func (s *geneveSender) capture(fd int, ifName string) error {
+	target := geneveOption(geneveOptTarget, []byte(s.target))
+	iface := geneveOption(geneveOptInterface, []byte(ifName))
+	headers := map[bool][]byte{
+		false: geneveHeader(s.vni, target, iface, geneveOption(geneveOptDirection, []byte{geneveIngress})),
+		true:  geneveHeader(s.vni, target, iface, geneveOption(geneveOptDirection, []byte{geneveEgress})),
+	}
+
+	buf := make([]byte, geneveMaxPayload)
+	pkt := make([]byte, 0, geneveMaxPayload)
+	for {
+		n, from, err := syscall.Recvfrom(fd, buf, 0)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to capture %q: %v", ifName, err)
+		}
+		ll, ok := from.(*syscall.SockaddrLinklayer)
+		egress := ok && ll.Pkttype == syscall.PACKET_OUTGOING
+		if !s.mirrored(buf[0:n], egress) {
+			continue
+		}
+
+		pkt = append(append(pkt[0:0], headers[egress]...), buf[0:n]...)
+		if len(pkt) > geneveMaxPayload {
+			pkt = pkt[0:geneveMaxPayload]
+		}
+		if _, err := s.conn.Write(pkt); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to send: %v\n", err)
+		}
+	}
+}
+
+// dialGeneve returns UDP socket to the receiver, which may fragment the
+// packets (mirrored frames may be as large as path MTU).
+func dialGeneve(egressIP string, dest *net.UDPAddr) (*net.UDPConn, error) {
+	var local *net.UDPAddr
+	if egressIP != "" {
+		local = &net.UDPAddr{IP: net.ParseIP(egressIP)}
+	}
+	conn, err := net.DialUDP("udp", local, dest)
+	if err != nil {
+		return nil, err
+	}
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	rawConn.Control(func(fd uintptr) {
+		if dest.IP.To4() != nil {
+			syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DONT)
+		} else {
+			syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IP_PMTUDISC_DONT)
+		}
+	})
+	return conn, nil
+}
+
+// geneveTunnel returns the tunnel of Geneve to the neighbor ip (for IPsec).
+func geneveTunnel(localIP string, ip net.IP, port int) tunnel {
+	t := tunnel{Encap: encapGeneve, LocalIP: net.ParseIP(localIP)}
+	t.IPAddr = ip
+	t.UDPPort = port
+	return t
+}
+
+// runGeneveSender sends the mirror interfaces of args in Geneve until
+// SIGINT/SIGTERM. Nothing but IPsec SA (if any) is added to the namespace.
+func runGeneveSender(procPrefix string, args *senderArgs) error {
+	if args.VxlanIP == nil {
+		return fmt.Errorf("neighbor ip (vxlan-ip) is required for %s", encapGeneve)
+	}
+	nsName, mirrorIfNames, filters, err := parseMirrors(procPrefix, args)
+	if err != nil {
+		return err
+	}
+	t := geneveTunnel(args.VxlanEgressIP, args.VxlanIP, args.VxlanPort)
+	sas, err := newIPsecSAs(args.IPsecKey, []int{args.IPsecSPI}, []tunnel{t}, netlink.XFRM_DIR_OUT)
+	if err != nil {
+		return err
+	}
+	if err := addIPsecSAs(sas); err != nil {
+		return err
+	}
+	defer deleteIPsecSAs(sas)
+
+	dest := &net.UDPAddr{IP: args.VxlanIP, Port: args.VxlanPort}
+	conn, err := dialGeneve(args.VxlanEgressIP, dest)
+	if err != nil {
+		return fmt.Errorf("failed to open udp socket to %s: %v", dest, err)
+	}
+	defer conn.Close()
+
+	sender := &geneveSender{
+		conn:       conn,
+		dest:       dest,
+		vni:        args.VxlanID,
+		target:     args.Target,
+		mirrorType: args.MirrorType,
+		filters:    filters,
+		host:       args.NetnsDiscovery == "host",
+	}
+	errCh := make(chan error, len(mirrorIfNames))
+	for _, ifName := range mirrorIfNames {
+		fd, err := openPacketSocket(nsName, ifName)
+		if err != nil {
+			return err
+		}
+		defer syscall.Close(fd)
+		go func(fd int, ifName string) {
+			errCh <- sender.capture(fd, ifName)
+		}(fd, ifName)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	fmt.Println("Waiting for signal at main ...")
+	select {
+	case <-sig:
+		fmt.Printf("\nCatch signal!\n")
+	case err = <-errCh:
+	}
+	fmt.Println("Exit from main")
+	return err
+}
+
+// runGeneveReceiver receives Geneve packets from the senders (by VxlanIPs
+// and VxlanIDs) and puts the frames to the dummy interface of each sender
+// (and pcapng file) until SIGINT/SIGTERM.
+func runGeneveReceiver(args *receiverArgs) error {
+	if len(args.IfNames) != len(args.VxlanIDs) || len(args.IfNames) != len(args.VxlanIPs) {
+		return fmt.Errorf("number of ifname, vxlan-id and vxlan-ip mismatch")
+	}
+	tunnels := []tunnel{}
+	for _, ip := range args.VxlanIPs {
+		tunnels = append(tunnels, geneveTunnel(args.VxlanEgressIP, ip, args.VxlanPort))
+	}
+	sas, err := newIPsecSAs(args.IPsecKey, args.IPsecSPIs, tunnels, netlink.XFRM_DIR_IN)
+	if err != nil {
+		return err
+	}
+	if err := addIPsecSAs(sas); err != nil {
+		return err
+	}
+	defer deleteIPsecSAs(sas)
+
+	local := &net.UDPAddr{Port: args.VxlanPort}
+	if args.VxlanEgressIP != "" {
+		local.IP = net.ParseIP(args.VxlanEgressIP)
+	}
+	conn, err := net.ListenUDP("udp", local)
+	if err != nil {
+		return fmt.Errorf("failed to listen %s: %v", local, err)
+	}
+	defer conn.Close()
+
+	var pcap *pcapngWriter
+	if args.Pcap != "" {
+		if pcap, err = newPcapngWriter(args.Pcap); err != nil {
+			return err
+		}
+		defer pcap.Close()
+	}
+
+	// packet socket of the interface by sender IP and VNI
+	sockets := map[string]int{}
+	for i, ifName := range args.IfNames {
+		link := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: ifName, MTU: 65535}}
+		if err := netlink.LinkAdd(link); err != nil {
+			return fmt.Errorf("failed to add %q: %v", ifName, err)
+		}
+		defer netlink.LinkDel(link)
+		if err := netlink.LinkSetUp(link); err != nil {
+			return fmt.Errorf("failed to set %q up: %v", ifName, err)
+		}
+		fd, err := openPacketSocket("", ifName)
+		if err != nil {
+			return err
+		}
+		defer syscall.Close(fd)
+		sockets[fmt.Sprintf("%s/%d", args.VxlanIPs[i], args.VxlanIDs[i])] = fd
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			vni, meta, frame, err := parseGeneve(buf[0:n])
+			if err != nil {
+				continue
+			}
+			fd, ok := sockets[fmt.Sprintf("%s/%d", addr.IP, vni)]
+			if !ok {
+				continue
+			}
+			// transmit on the dummy interface, which is seen by capture
+			syscall.Write(fd, frame)
+			if pcap != nil {
+				if err := pcap.WritePacket(addr.IP, vni, meta, frame); err != nil {
+					fmt.Fprintf(os.Stderr, "failed to write pcapng: %v\n", err)
+				}
+			}
+		}
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	fmt.Println("Waiting for signal at main ...")
+	select {
+	case <-sig:
+		fmt.Printf("\nCatch signal!\n")
+	case err = <-errCh:
+	}
+	fmt.Println("Exit from main")
+	return err
+}
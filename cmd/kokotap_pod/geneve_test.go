@@ -0,0 +1,173 @@
+// Copyright 2018 Red Hat
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestGeneveOption(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  string
+		length int // option length in 4 bytes
+	}{
+		{name: "empty", value: "", length: 0},
+		{name: "aligned", value: "eth0", length: 1},
+		{name: "padded", value: "net1x", length: 2},
+		{name: "truncated", value: strings.Repeat("a", 200), length: 31},
+	}
+
+	for _, tt := range tests {
+		opt := geneveOption(geneveOptInterface, []byte(tt.value))
+		if len(opt) != 4+tt.length*4 {
+			t.Errorf("%s: option length = %d, want %d", tt.name, len(opt), 4+tt.length*4)
+			continue
+		}
+		if class := binary.BigEndian.Uint16(opt[0:]); class != geneveOptClass {
+			t.Errorf("%s: option class = %#x", tt.name, class)
+		}
+		if opt[2] != geneveOptInterface || int(opt[3]) != tt.length {
+			t.Errorf("%s: option type/length = %d/%d", tt.name, opt[2], opt[3])
+		}
+	}
+}
+
+func TestParseGeneve(t *testing.T) {
+	frame := []byte{0x01, 0x02, 0x03, 0x04}
+	tests := []struct {
+		name string
+		vni  int
+		opts [][]byte
+		meta geneveMetadata
+	}{
+		{
+			name: "no option",
+			vni:  100,
+		},
+		{
+			name: "ingress",
+			vni:  0xffffff,
+			opts: [][]byte{
+				geneveOption(geneveOptTarget, []byte("default/web-0")),
+				geneveOption(geneveOptInterface, []byte("eth0")),
+				geneveOption(geneveOptDirection, []byte{geneveIngress}),
+			},
+			meta: geneveMetadata{Target: "default/web-0", Interface: "eth0"},
+		},
+		{
+			name: "egress with unknown option class",
+			vni:  1,
+			opts: [][]byte{
+				{0x01, 0x02, 0x01, 0x01, 'x', 'x', 'x', 'x'},
+				geneveOption(geneveOptTarget, []byte("kube-node-1")),
+				geneveOption(geneveOptDirection, []byte{geneveEgress}),
+			},
+			meta: geneveMetadata{Target: "kube-node-1", Egress: true},
+		},
+	}
+
+	for _, tt := range tests {
+		pkt := append(geneveHeader(tt.vni, tt.opts...), frame...)
+		vni, meta, inner, err := parseGeneve(pkt)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if vni != tt.vni {
+			t.Errorf("%s: vni = %d, want %d", tt.name, vni, tt.vni)
+		}
+		if *meta != tt.meta {
+			t.Errorf("%s: metadata = %+v, want %+v", tt.name, *meta, tt.meta)
+		}
+		if !bytes.Equal(inner, frame) {
+			t.Errorf("%s: frame = %x, want %x", tt.name, inner, frame)
+		}
+	}
+}
+
+func TestParseGeneveError(t *testing.T) {
+	valid := geneveHeader(100, geneveOption(geneveOptTarget, []byte("web-0")))
+	version1 := append([]byte{}, valid...)
+	version1[0] |= 0x40
+	notEthernet := append([]byte{}, valid...)
+	binary.BigEndian.PutUint16(notEthernet[2:], 0x0800)
+	badOption := append([]byte{}, valid...)
+	badOption[8+3] = 0x1f
+
+	tests := []struct {
+		name string
+		pkt  []byte
+	}{
+		{name: "short header", pkt: valid[:7]},
+		{name: "version 1", pkt: version1},
+		{name: "not ethernet", pkt: notEthernet},
+		{name: "short options", pkt: valid[:10]},
+		{name: "option over options length", pkt: badOption},
+	}
+
+	for _, tt := range tests {
+		if _, _, _, err := parseGeneve(tt.pkt); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
+
+// udpFrame returns Ethernet frame of UDP packet to dst:port.
+func udpFrame(dst net.IP, port int) []byte {
+	frame := make([]byte, 14)
+	if ip := dst.To4(); ip != nil {
+		binary.BigEndian.PutUint16(frame[12:], 0x0800)
+		hdr := make([]byte, 20)
+		hdr[0], hdr[9] = 0x45, 17
+		copy(hdr[16:], ip)
+		frame = append(frame, hdr...)
+	} else {
+		binary.BigEndian.PutUint16(frame[12:], 0x86dd)
+		hdr := make([]byte, 40)
+		hdr[6] = 17
+		copy(hdr[24:], dst.To16())
+		frame = append(frame, hdr...)
+	}
+	udp := make([]byte, 8)
+	binary.BigEndian.PutUint16(udp[2:], uint16(port))
+	return append(frame, udp...)
+}
+
+func TestIsUDPTo(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 6081}
+	addr6 := &net.UDPAddr{IP: net.ParseIP("fd00::1"), Port: 6081}
+	tests := []struct {
+		name  string
+		frame []byte
+		addr  *net.UDPAddr
+		want  bool
+	}{
+		{name: "ipv4", frame: udpFrame(addr.IP, 6081), addr: addr, want: true},
+		{name: "ipv4 other port", frame: udpFrame(addr.IP, 4789), addr: addr},
+		{name: "ipv4 other address", frame: udpFrame(net.ParseIP("10.0.0.2"), 6081), addr: addr},
+		{name: "ipv6", frame: udpFrame(addr6.IP, 6081), addr: addr6, want: true},
+		{name: "short frame", frame: make([]byte, 10), addr: addr},
+	}
+
+	for _, tt := range tests {
+		if got := isUDPTo(tt.frame, tt.addr); got != tt.want {
+			t.Errorf("%s: isUDPTo = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright 2018 Red Hat
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+/*
+ * kokotap_pod: list interfaces in container's network namespace
+ *
+ * The interfaces are printed as JSON to stdout, which is read by kokotap
+ * from the pod logs (see 'kokotap interfaces').
+ */
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+	"os"
+)
+
+// linkStats is the counters of the interface.
+type linkStats struct {
+	RxPackets uint64 `json:"rxPackets"`
+	RxBytes   uint64 `json:"rxBytes"`
+	RxDropped uint64 `json:"rxDropped"`
+	TxPackets uint64 `json:"txPackets"`
+	TxBytes   uint64 `json:"txBytes"`
+	TxDropped uint64 `json:"txDropped"`
+}
+
+// qdiscInfo is the qdisc of the interface.
+type qdiscInfo struct {
+	Type   string `json:"type"`
+	Handle string `json:"handle"`
+	Parent string `json:"parent"`
+}
+
+// mirrorInfo is tc mirred filter of the interface. Mirrors by kokotap are
+// the ones to the tunnel interfaces (koko does not mark its filters) or the
+// ones of kokotap filter priority.
+type mirrorInfo struct {
+	Direction string `json:"direction"`
+	Dest      string `json:"dest"`
+	Kokotap   bool   `json:"kokotap"`
+}
+
+// interfaceInfo is the interface in the network namespace.
+type interfaceInfo struct {
+	Name       string       `json:"name"`
+	Type       string       `json:"type"`
+	MAC        string       `json:"mac,omitempty"`
+	MTU        int          `json:"mtu"`
+	State      string       `json:"state"`
+	Addresses  []string     `json:"addresses"`
+	Qdiscs     []qdiscInfo  `json:"qdiscs"`
+	Statistics *linkStats   `json:"statistics,omitempty"`
+	Mirrors    []mirrorInfo `json:"mirrors,omitempty"`
+}
+
+// tunnelLinkTypes are the link types of the tunnel interfaces by makeTunnel
+var tunnelLinkTypes = map[string]bool{
+	"vxlan":     true,
+	"gretap":    true,
+	"ip6gretap": true,
+	"erspan":    true,
+	"ip6erspan": true,
+	"vlan":      true,
+	"macvlan":   true,
+	"veth":      true,
+}
+
+// linkMirrors returns the mirrors of the link, from the filters of its
+// ingress and root qdiscs.
+func linkMirrors(link netlink.Link, qdiscs []netlink.Qdisc, links map[int]netlink.Link) ([]mirrorInfo, error) {
+	mirrors := []mirrorInfo{}
+	for _, qdisc := range qdiscs {
+		direction := ""
+		switch qdisc.Attrs().Parent {
+		case netlink.HANDLE_INGRESS:
+			direction = "ingress"
+		case netlink.HANDLE_ROOT:
+			direction = "egress"
+		default:
+			continue
+		}
+
+		filters, err := netlink.FilterList(link, qdisc.Attrs().Handle)
+		if err != nil {
+			return nil, err
+		}
+		for _, filter := range filters {
+			u32, ok := filter.(*netlink.U32)
+			if !ok {
+				continue
+			}
+			for _, action := range u32.Actions {
+				mirred, ok := action.(*netlink.MirredAction)
+				if !ok {
+					continue
+				}
+				info := mirrorInfo{
+					Direction: direction,
+					Dest:      fmt.Sprintf("ifindex %d", mirred.Ifindex),
+					Kokotap:   u32.Priority == mirrorFilterPriority,
+				}
+				if dest, ok := links[mirred.Ifindex]; ok {
+					info.Dest = dest.Attrs().Name
+					info.Kokotap = info.Kokotap || tunnelLinkTypes[dest.Type()]
+				}
+				mirrors = append(mirrors, info)
+			}
+		}
+	}
+	return mirrors, nil
+}
+
+// getInterfaceInfo returns the info of the link.
+func getInterfaceInfo(link netlink.Link, links map[int]netlink.Link) (interfaceInfo, error) {
+	attrs := link.Attrs()
+	info := interfaceInfo{
+		Name:      attrs.Name,
+		Type:      link.Type(),
+		MAC:       attrs.HardwareAddr.String(),
+		MTU:       attrs.MTU,
+		State:     attrs.OperState.String(),
+		Addresses: []string{},
+		Qdiscs:    []qdiscInfo{},
+	}
+	if stats := attrs.Statistics; stats != nil {
+		info.Statistics = &linkStats{
+			RxPackets: stats.RxPackets,
+			RxBytes:   stats.RxBytes,
+			RxDropped: stats.RxDropped,
+			TxPackets: stats.TxPackets,
+			TxBytes:   stats.TxBytes,
+			TxDropped: stats.TxDropped,
+		}
+	}
+
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return info, fmt.Errorf("failed to list addresses of %q: %v", attrs.Name, err)
+	}
+	for _, addr := range addrs {
+		info.Addresses = append(info.Addresses, addr.IPNet.String())
+	}
+
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return info, fmt.Errorf("failed to list qdiscs of %q: %v", attrs.Name, err)
+	}
+	for _, qdisc := range qdiscs {
+		info.Qdiscs = append(info.Qdiscs, qdiscInfo{
+			Type:   qdisc.Type(),
+			Handle: netlink.HandleStr(qdisc.Attrs().Handle),
+			Parent: netlink.HandleStr(qdisc.Attrs().Parent),
+		})
+	}
+
+	if info.Mirrors, err = linkMirrors(link, qdiscs, links); err != nil {
+		return info, fmt.Errorf("failed to list filters of %q: %v", attrs.Name, err)
+	}
+	return info, nil
+}
+
+// listInterfaces returns the interfaces in the namespace.
+func listInterfaces(nsName string) ([]interfaceInfo, error) {
+	netns, err := getNS(nsName)
+	if err != nil {
+		return nil, err
+	}
+	defer netns.Close()
+
+	infos := []interfaceInfo{}
+	err = netns.Do(func(_ ns.NetNS) error {
+		linkList, err := netlink.LinkList()
+		if err != nil {
+			return err
+		}
+		links := map[int]netlink.Link{}
+		for _, link := range linkList {
+			links[link.Attrs().Index] = link
+		}
+		for _, link := range linkList {
+			info, err := getInterfaceInfo(link, links)
+			if err != nil {
+				return err
+			}
+			infos = append(infos, info)
+		}
+		return nil
+	})
+	return infos, err
+}
+
+// printInterfaces prints the interfaces in the network namespace of the
+// container as JSON.
+func printInterfaces(procPrefix string, args *senderArgs) error {
+	nsName, err := getContainerNS(procPrefix, args)
+	if err != nil {
+		return err
+	}
+	infos, err := listInterfaces(nsName)
+	if err != nil {
+		return fmt.Errorf("failed to list interfaces in %s: %v", nsName, err)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(infos)
+}
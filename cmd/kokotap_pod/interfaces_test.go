@@ -0,0 +1,100 @@
+// Copyright 2018 Red Hat
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	koko "github.com/redhat-nfvpe/koko/api"
+	"syscall"
+	"testing"
+)
+
+func TestListInterfaces(t *testing.T) {
+	nsName, cleanup := newTestNS(t, "eth0", "net1", "mirror0")
+	defer cleanup()
+
+	// the mirror of eth0 is by koko, which is not known as kokotap's as
+	// mirror0 is not a tunnel, and the one of net1 is by the kokotap filter
+	veth := koko.VEth{NsName: nsName, LinkName: "mirror0"}
+	mirrors := []mirror{
+		{VEth: mirrorVEth(veth, "ingress", "eth0")},
+		{
+			VEth:    mirrorVEth(veth, "ingress", "net1"),
+			Filters: []mirrorFilter{{Protocol: syscall.IPPROTO_TCP, IP: []byte{10, 0, 0, 1}, Port: 80}},
+		},
+	}
+	for i := range mirrors {
+		if err := mirrors[i].set(); err != nil {
+			t.Skipf("tc ingress mirror is not supported: %v", err)
+		}
+	}
+
+	infos, err := listInterfaces(nsName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := map[string]interfaceInfo{}
+	for _, info := range infos {
+		byName[info.Name] = info
+	}
+
+	wantTypes := map[string]string{"lo": "device", "eth0": "bridge", "net1": "bridge", "mirror0": "bridge"}
+	for name, typ := range wantTypes {
+		info, ok := byName[name]
+		if !ok {
+			t.Errorf("%s is not listed", name)
+			continue
+		}
+		if info.Type != typ {
+			t.Errorf("%s: type is %q, want %q", name, info.Type, typ)
+		}
+	}
+
+	for name, kokotap := range map[string]bool{"eth0": false, "net1": true} {
+		info := byName[name]
+		want := mirrorInfo{Direction: "ingress", Dest: "mirror0", Kokotap: kokotap}
+		// a filter is the rules of its source and destination port
+		if len(info.Mirrors) == 0 {
+			t.Errorf("%s: no mirror", name)
+		}
+		for _, m := range info.Mirrors {
+			if m != want {
+				t.Errorf("%s: mirror is %+v, want %+v", name, m, want)
+			}
+		}
+		ingress := false
+		for _, qdisc := range info.Qdiscs {
+			ingress = ingress || qdisc.Type == "ingress"
+		}
+		if !ingress {
+			t.Errorf("%s: no ingress qdisc in %v", name, info.Qdiscs)
+		}
+	}
+	if mirrors := byName["mirror0"].Mirrors; len(mirrors) != 0 {
+		t.Errorf("mirror0: mirrors are %v, want none", mirrors)
+	}
+
+	for i := range mirrors {
+		if err := mirrors[i].unset(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if infos, err = listInterfaces(nsName); err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range infos {
+		if len(info.Mirrors) != 0 {
+			t.Errorf("%s: mirrors remain after unset: %v", info.Name, info.Mirrors)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+// Copyright 2018 Red Hat
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+/*
+ * kokotap_pod: IPsec (ESP transport mode) for tap tunnel
+ *
+ * The tunnel packets (UDP to the port for VxLAN/Geneve, or GRE with the key)
+ * between the sender and the receiver are encrypted by xfrm state and policy,
+ * which are added in the host namespace (sender/receiver pods are
+ * hostNetwork). For GRE, the selector ports are the GRE key (upper and lower
+ * 16 bits), so that the policy does not match other GRE tunnels.
+ *
+ * kokotap gives the master key of the tap (in a Secret) and SPI for each
+ * sender. The key of each SA is derived from the master key and SPI, so that
+ * the SAs never share AES-GCM key (and nonce). Senders on the same node to the
+ * same receiver have the same selector, hence each policy has own priority
+ * (SPI) and is deleted by its index, and the state is picked by reqid (SPI).
+ */
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"github.com/vishvananda/netlink"
+	"io/ioutil"
+	"net"
+	"os"
+	"syscall"
+)
+
+// ipsecAlgo is AES-GCM with 256 bits key, 32 bits salt and 128 bits ICV
+const (
+	ipsecAlgo       = "rfc4106(gcm(aes))"
+	ipsecKeyLen     = 32 + 4
+	ipsecICVLen     = 128
+	ipsecMinKeyLen  = 16 // of master key
+	ipsecMinSPI     = 0x100
+	ipsecReplayWind = 32
+)
+
+// ipsecSA is ESP SA (and policy) of the tunnel from Src to Dst, for the
+// packets of Proto (UDP to DstPort, or GRE with the key).
+type ipsecSA struct {
+	Src     net.IP
+	Dst     net.IP
+	Proto   int
+	SrcPort int // upper 16 bits of GRE key (0 for UDP)
+	DstPort int // UDP destination port, or lower 16 bits of GRE key
+	SPI     int
+	Dir     netlink.Dir // XFRM_DIR_OUT (sender) or XFRM_DIR_IN (receiver)
+	Key     []byte      // derived from the master key
+	index   int         // policy index, set by add
+}
+
+// readIPsecKey reads the master key of the tap.
+func readIPsecKey(path string) ([]byte, error) {
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ipsec key: %v", err)
+	}
+	if len(key) < ipsecMinKeyLen {
+		return nil, fmt.Errorf("ipsec key %s is too short (%d bytes)", path, len(key))
+	}
+	return key, nil
+}
+
+// deriveIPsecKey returns the key (with salt) of the SA of spi.
+func deriveIPsecKey(masterKey []byte, spi int) []byte {
+	mac := hmac.New(sha512.New, masterKey)
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(spi))
+	mac.Write([]byte("kokotap ipsec"))
+	mac.Write(b)
+	return mac.Sum(nil)[:ipsecKeyLen]
+}
+
+// newIPsecSA returns the SA of the tunnel t with the master key. The SA of
+// sender (dir out) is from the local address to the neighbor, and the one
+// of receiver (dir in) is from the neighbor.
+func newIPsecSA(masterKey []byte, spi int, t *tunnel, dir netlink.Dir) (*ipsecSA, error) {
+	if spi < ipsecMinSPI {
+		return nil, fmt.Errorf("invalid ipsec SPI %d", spi)
+	}
+	local, err := t.localIP()
+	if err != nil {
+		return nil, err
+	}
+	sa := &ipsecSA{
+		Src:     local,
+		Dst:     t.IPAddr,
+		Proto:   syscall.IPPROTO_UDP,
+		DstPort: t.UDPPort,
+		SPI:     spi,
+		Dir:     dir,
+		Key:     deriveIPsecKey(masterKey, spi),
+	}
+	if dir == netlink.XFRM_DIR_IN {
+		sa.Src, sa.Dst = t.IPAddr, local
+	}
+	switch t.Encap {
+	case encapGretap:
+		if t.ID == 0 {
+			return nil, fmt.Errorf("ipsec needs GRE key")
+		}
+		sa.Proto, sa.SrcPort, sa.DstPort = syscall.IPPROTO_GRE, t.ID>>16, t.ID&0xffff
+	case "", encapVxlan, encapGeneve:
+	default:
+		return nil, fmt.Errorf("ipsec is not supported by %s", t.Encap)
+	}
+	return sa, nil
+}
+
+// newIPsecSAs returns the SAs of the tunnels (with spis, by index), or nil if
+// keyFile is not given. The tunnel of SPI 0 is not encrypted.
+func newIPsecSAs(keyFile string, spis []int, tunnels []tunnel, dir netlink.Dir) ([]*ipsecSA, error) {
+	if keyFile == "" {
+		return nil, nil
+	}
+	if len(spis) != len(tunnels) {
+		return nil, fmt.Errorf("number of ipsec-spi mismatch")
+	}
+	key, err := readIPsecKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	sas := []*ipsecSA{}
+	for i := range tunnels {
+		if spis[i] == 0 {
+			// the sender on the node of the receiver
+			continue
+		}
+		sa, err := newIPsecSA(key, spis[i], &tunnels[i], dir)
+		if err != nil {
+			return nil, err
+		}
+		sas = append(sas, sa)
+	}
+	return sas, nil
+}
+
+// hostNet returns the IPNet of the address only.
+func hostNet(ip net.IP) *net.IPNet {
+	bits := 32
+	if ip.To4() == nil {
+		bits = 128
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+}
+
+func (sa *ipsecSA) state() *netlink.XfrmState {
+	return &netlink.XfrmState{
+		Src:          sa.Src,
+		Dst:          sa.Dst,
+		Proto:        netlink.XFRM_PROTO_ESP,
+		Mode:         netlink.XFRM_MODE_TRANSPORT,
+		Spi:          sa.SPI,
+		Reqid:        sa.SPI,
+		ReplayWindow: ipsecReplayWind,
+		Aead: &netlink.XfrmStateAlgo{
+			Name:   ipsecAlgo,
+			Key:    sa.Key,
+			ICVLen: ipsecICVLen,
+		},
+	}
+}
+
+// policy returns the policy of the SA. Inbound template has no reqid, so
+// that it accepts the SA of any sender on the same node.
+func (sa *ipsecSA) policy() *netlink.XfrmPolicy {
+	tmpl := netlink.XfrmPolicyTmpl{
+		Proto: netlink.XFRM_PROTO_ESP,
+		Mode:  netlink.XFRM_MODE_TRANSPORT,
+	}
+	if sa.Dir == netlink.XFRM_DIR_OUT {
+		tmpl.Src, tmpl.Dst, tmpl.Reqid = sa.Src, sa.Dst, sa.SPI
+	}
+	return &netlink.XfrmPolicy{
+		Src:      hostNet(sa.Src),
+		Dst:      hostNet(sa.Dst),
+		Proto:    netlink.Proto(sa.Proto),
+		SrcPort:  sa.SrcPort,
+		DstPort:  sa.DstPort,
+		Dir:      sa.Dir,
+		Priority: sa.SPI,
+		Index:    sa.index,
+		Tmpls:    []netlink.XfrmPolicyTmpl{tmpl},
+	}
+}
+
+// policyIndex returns the index of the policy of the SA (by its priority).
+func (sa *ipsecSA) policyIndex() (int, error) {
+	policies, err := netlink.XfrmPolicyList(netlink.FAMILY_ALL)
+	if err != nil {
+		return 0, err
+	}
+	for _, p := range policies {
+		if p.Dir == sa.Dir && p.Priority == sa.SPI && p.Dst != nil && p.Dst.IP.Equal(sa.Dst) &&
+			p.Src != nil && p.Src.IP.Equal(sa.Src) && int(p.Proto) == sa.Proto && p.SrcPort == sa.SrcPort && p.DstPort == sa.DstPort {
+			return p.Index, nil
+		}
+	}
+	return 0, fmt.Errorf("policy of SPI %#x is not found", sa.SPI)
+}
+
+// add adds the state, then the policy, so that no packet of the tunnel goes
+// without encryption.
+func (sa *ipsecSA) add() error {
+	if err := netlink.XfrmStateAdd(sa.state()); err != nil {
+		return fmt.Errorf("failed to add ipsec state %s->%s SPI %#x: %v", sa.Src, sa.Dst, sa.SPI, err)
+	}
+	if err := netlink.XfrmPolicyAdd(sa.policy()); err != nil {
+		netlink.XfrmStateDel(sa.state())
+		return fmt.Errorf("failed to add ipsec policy %s->%s: %v", sa.Src, sa.Dst, err)
+	}
+	index, err := sa.policyIndex()
+	if err != nil {
+		sa.del()
+		return err
+	}
+	sa.index = index
+	return nil
+}
+
+// del deletes the policy and the state.
+func (sa *ipsecSA) del() error {
+	var perr error
+	if sa.index != 0 {
+		perr = netlink.XfrmPolicyDel(sa.policy())
+	}
+	if err := netlink.XfrmStateDel(sa.state()); err != nil {
+		return fmt.Errorf("failed to delete ipsec state SPI %#x: %v", sa.SPI, err)
+	}
+	if perr != nil {
+		return fmt.Errorf("failed to delete ipsec policy SPI %#x: %v", sa.SPI, perr)
+	}
+	return nil
+}
+
+// addIPsecSAs adds the SAs. If one fails, the added ones are deleted.
+func addIPsecSAs(sas []*ipsecSA) error {
+	for i, sa := range sas {
+		if err := sa.add(); err != nil {
+			deleteIPsecSAs(sas[:i])
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteIPsecSAs deletes the SAs, and prints the errors.
+func deleteIPsecSAs(sas []*ipsecSA) {
+	for _, sa := range sas {
+		if err := sa.del(); err != nil {
+			fmt.Fprintf(os.Stderr, "XXX:%v\n", err)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2018 Red Hat
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"github.com/vishvananda/netlink"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestDeriveIPsecKey(t *testing.T) {
+	master := []byte("0123456789abcdef0123456789abcdef")
+	key := deriveIPsecKey(master, 0x100)
+	if len(key) != ipsecKeyLen {
+		t.Fatalf("key length = %d, want %d", len(key), ipsecKeyLen)
+	}
+	tests := []struct {
+		name   string
+		master []byte
+		spi    int
+		same   bool
+	}{
+		{name: "same spi", master: master, spi: 0x100, same: true},
+		{name: "other spi", master: master, spi: 0x101},
+		{name: "other master key", master: []byte("fedcba9876543210fedcba9876543210"), spi: 0x100},
+	}
+
+	for _, tt := range tests {
+		if same := bytes.Equal(deriveIPsecKey(tt.master, tt.spi), key); same != tt.same {
+			t.Errorf("%s: same key = %v, want %v", tt.name, same, tt.same)
+		}
+	}
+}
+
+func TestNewIPsecSA(t *testing.T) {
+	local := net.ParseIP("10.0.0.1")
+	remote := net.ParseIP("10.0.0.2")
+	tunnelOf := func(encap string, id, port int) *tunnel {
+		tun := &tunnel{Encap: encap, LocalIP: local}
+		tun.IPAddr = remote
+		tun.ID = id
+		tun.UDPPort = port
+		return tun
+	}
+
+	tests := []struct {
+		name    string
+		tunnel  *tunnel
+		dir     netlink.Dir
+		spi     int
+		want    ipsecSA
+		wantErr bool
+	}{
+		{
+			name:   "vxlan sender",
+			tunnel: tunnelOf(encapVxlan, 100, 14789),
+			dir:    netlink.XFRM_DIR_OUT,
+			spi:    0x1000,
+			want:   ipsecSA{Src: local, Dst: remote, Proto: syscall.IPPROTO_UDP, DstPort: 14789},
+		},
+		{
+			name:   "geneve receiver",
+			tunnel: tunnelOf(encapGeneve, 100, 14789),
+			dir:    netlink.XFRM_DIR_IN,
+			spi:    0x1000,
+			want:   ipsecSA{Src: remote, Dst: local, Proto: syscall.IPPROTO_UDP, DstPort: 14789},
+		},
+		{
+			name:   "gretap key",
+			tunnel: tunnelOf(encapGretap, 0x12345, 0),
+			dir:    netlink.XFRM_DIR_OUT,
+			spi:    0x1000,
+			want:   ipsecSA{Src: local, Dst: remote, Proto: syscall.IPPROTO_GRE, SrcPort: 0x1, DstPort: 0x2345},
+		},
+		{name: "gretap without key", tunnel: tunnelOf(encapGretap, 0, 0), dir: netlink.XFRM_DIR_OUT, spi: 0x1000, wantErr: true},
+		{name: "erspan", tunnel: tunnelOf(encapErspan, 100, 0), dir: netlink.XFRM_DIR_OUT, spi: 0x1000, wantErr: true},
+		{name: "reserved spi", tunnel: tunnelOf(encapVxlan, 100, 14789), dir: netlink.XFRM_DIR_OUT, spi: 0xff, wantErr: true},
+	}
+
+	master := []byte("0123456789abcdef0123456789abcdef")
+	for _, tt := range tests {
+		sa, err := newIPsecSA(master, tt.spi, tt.tunnel, tt.dir)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if !sa.Src.Equal(tt.want.Src) || !sa.Dst.Equal(tt.want.Dst) || sa.Proto != tt.want.Proto ||
+			sa.SrcPort != tt.want.SrcPort || sa.DstPort != tt.want.DstPort {
+			t.Errorf("%s: sa = %+v, want %+v", tt.name, *sa, tt.want)
+		}
+		policy := sa.policy()
+		if policy.SrcPort != sa.SrcPort || policy.DstPort != sa.DstPort || int(policy.Proto) != sa.Proto ||
+			policy.Priority != tt.spi {
+			t.Errorf("%s: policy = %v", tt.name, policy)
+		}
+	}
+}
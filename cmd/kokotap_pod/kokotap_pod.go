@@ -20,6 +20,7 @@ package main
 import (
 	"fmt"
 	koko "github.com/redhat-nfvpe/koko/api"
+	"github.com/vishvananda/netlink"
 	"gopkg.in/alecthomas/kingpin.v2"
 	"net"
 	"os"
@@ -34,24 +35,53 @@ var commit = "unknown commit"
 var date = "unknown date"
 
 type senderArgs struct {
-	ContainerID   string
-	MirrorType    string
-	MirrorIfName  string
-	IfName        string
-	VxlanEgressIf string
-	VxlanEgressIP string
-	VxlanID       int
-	VxlanIP       net.IP
-	VxlanPort     int //UDP Port
+	ContainerID     string
+	PodUID          string
+	NetnsDiscovery  string   // runtime, proc or host
+	Filters         []string // protocol:ip:port to mirror (for hostNetwork pod)
+	RuntimeSocket   string
+	MirrorType      string
+	MirrorIfName    string
+	IfName          string
+	VxlanEgressIf   string
+	VxlanEgressIP   string
+	VxlanID         int
+	VxlanIP         net.IP
+	VxlanPort       int    //UDP Port
+	Encap           string // vxlan, gretap, erspan, geneve, vlan, macvlan or veth
+	ParentIf        string // parent (physical) interface of vlan/macvlan
+	DestContainerID string // analysis container for veth (optional, default: host)
+	DestPodUID      string // analysis pod UID for veth (used by proc netns discovery)
+	DestIfName      string // interface name of veth peer (default: IfName)
+	ErspanVersion   int    // 1 (type II) or 2 (type III)
+	ErspanDir       string // ingress or egress (default: by MirrorType)
+	Target          string // target label in Geneve options (e.g. namespace/pod)
+	IPsecKey        string // master key file of IPsec (optional)
+	IPsecSPI        int    // SPI of IPsec SA to the receiver
+}
+
+// runtimeSockets are default runtime sockets for container ID prefixes
+var runtimeSockets = map[string]string{
+	"docker":     "/var/run/docker.sock",
+	"cri-o":      "/var/run/crio/crio.sock",
+	"containerd": "/run/containerd/containerd.sock",
 }
 
+// receiverArgs has one or more tunnel interfaces (IfNames, VxlanIDs and
+// VxlanIPs are matched by index).
 type receiverArgs struct {
-	IfName        string
+	IfNames       []string
 	VxlanEgressIf string
 	VxlanEgressIP string
-	VxlanID       int
-	VxlanIP       net.IP
-	VxlanPort     int //UDP Port
+	VxlanIDs      []int
+	VxlanIPs      []net.IP
+	VxlanPort     int    //UDP Port
+	Encap         string // vxlan, gretap, erspan, geneve or vlan
+	ParentIf      string // parent (physical) interface of vlan
+	ErspanVersion int    // 1 (type II) or 2 (type III)
+	Pcap          string // pcapng file with labels of Geneve options (optional)
+	IPsecKey      string // master key file of IPsec (optional)
+	IPsecSPIs     []int  // SPI of IPsec SA from each sender
 }
 
 func getInterfaceByAddr(addr string) (*net.Interface, error) {
@@ -76,58 +106,192 @@ func getInterfaceByAddr(addr string) (*net.Interface, error) {
 	return nil, err
 }
 
-func parseSenderArgs(procPrefix string, args *senderArgs) (*koko.VEth, *koko.VxLan, error) {
+// getContainerNS returns the network namespace of the container (i.e. its pod
+// sandbox), or "" for host namespace, by netns discovery of args.
+func getContainerNS(procPrefix string, args *senderArgs) (string, error) {
+	var containerType, containerID string
+	if i := strings.Index(args.ContainerID, "://"); i >= 0 {
+		containerType, containerID = args.ContainerID[0:i], args.ContainerID[i+3:]
+	}
+	socket := args.RuntimeSocket
+	if socket == "" {
+		socket = runtimeSockets[containerType]
+	}
+	switch {
+	case args.NetnsDiscovery == "host":
+		// host namespace, i.e. current namespace of sender (hostNetwork) pod
+		return "", nil
+	case args.NetnsDiscovery == "proc":
+		return GetProcContainerNS(procPrefix, args.PodUID, containerID)
+	case containerID == "":
+		return "", fmt.Errorf("invalid container id: %q", args.ContainerID)
+	case containerType == "docker":
+		if socket != "" {
+			os.Setenv("DOCKER_HOST", "unix://"+socket)
+		}
+		return GetDockerSandboxNS(procPrefix, containerID)
+	case socket == "":
+		return "", fmt.Errorf("no runtime socket for %q", containerType)
+	}
+	return GetCRISandboxNS(procPrefix, containerID, socket)
+}
+
+// parseMirrors returns the namespace of the container, the mirror interfaces
+// in it and the filters of args.
+func parseMirrors(procPrefix string, args *senderArgs) (string, []string, []mirrorFilter, error) {
+	nsName, err := getContainerNS(procPrefix, args)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	mirrorIfNames, err := parseMirrorIfNames(nsName, args.MirrorIfName, args.IfName)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if len(mirrorIfNames) == 0 {
+		return "", nil, nil, fmt.Errorf("no mirror interface in %s", nsName)
+	}
+	for _, mirrorIfName := range mirrorIfNames {
+		// IsExistLinkInNS returns error if the link is not found
+		if _, err := koko.IsExistLinkInNS(nsName, mirrorIfName); err != nil {
+			return "", nil, nil, fmt.Errorf("mirror interface %q is not found in %s: %v",
+				mirrorIfName, nsName, err)
+		}
+	}
+
+	filters := []mirrorFilter{}
+	for _, filter := range args.Filters {
+		f, err := parseMirrorFilter(filter)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		filters = append(filters, f)
+	}
+	return nsName, mirrorIfNames, filters, nil
+}
+
+// parseSenderArgs returns the tunnel interface with the first mirror
+// interface (to create by makeTunnel) and the other mirrors. For host
+// namespace or filters, every mirror interface is in the mirrors.
+func parseSenderArgs(procPrefix string, args *senderArgs) (*koko.VEth, []mirror, *tunnel, error) {
 	var err error
+	var mirrorIfNames []string
+	var filters []mirrorFilter
 	veth := koko.VEth{}
 
 	if args.VxlanEgressIP != "" {
 		egressif, err := getInterfaceByAddr(args.VxlanEgressIP)
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, nil, err
 		}
 		args.VxlanEgressIf = egressif.Name
 	}
 
-	containerType := args.ContainerID[0:strings.Index(args.ContainerID, ":")]
-	containerID := args.ContainerID[strings.Index(args.ContainerID, "://")+3:]
-	switch containerType {
-	case "cri-o":
-		veth.NsName, err = koko.GetCrioContainerNS(procPrefix, containerID, "")
-	case "docker":
-		veth.NsName, err = koko.GetDockerContainerNS(procPrefix, containerID)
-	}
-	if err != nil {
-		return nil, nil, err
+	if veth.NsName, mirrorIfNames, filters, err = parseMirrors(procPrefix, args); err != nil {
+		return nil, nil, nil, err
 	}
 
 	exists, _ := koko.IsExistLinkInNS(veth.NsName, args.IfName)
 	if exists == true {
-		return nil, nil, fmt.Errorf("XXX")
+		return nil, nil, nil, fmt.Errorf("XXX")
 	}
 	veth.LinkName = args.IfName
 
-	switch args.MirrorType {
-	case "ingress":
-		veth.MirrorIngress = args.MirrorIfName
-	case "egress":
-		veth.MirrorEgress = args.MirrorIfName
-	case "both":
-		veth.MirrorIngress = args.MirrorIfName
-		veth.MirrorEgress = args.MirrorIfName
-	}
-
-	vxlan := koko.VxLan{}
-	vxlan.ParentIF = args.VxlanEgressIf
-	vxlan.IPAddr = args.VxlanIP
-	vxlan.ID = args.VxlanID
-	vxlan.UDPPort = args.VxlanPort
-	return &veth, &vxlan, nil
+	host := args.NetnsDiscovery == "host"
+	if !host && len(filters) == 0 {
+		veth = mirrorVEth(veth, args.MirrorType, mirrorIfNames[0])
+		mirrorIfNames = mirrorIfNames[1:]
+	}
+	mirrors := []mirror{}
+	for _, mirrorIfName := range mirrorIfNames {
+		mirrors = append(mirrors, mirror{
+			VEth:    mirrorVEth(veth, args.MirrorType, mirrorIfName),
+			Filters: filters,
+			Host:    host,
+		})
+	}
+
+	parentIf := args.VxlanEgressIf
+	if args.ParentIf != "" {
+		parentIf = args.ParentIf
+	}
+	tunnel, err := newTunnel(args.Encap, parentIf, args.VxlanEgressIP, args.VxlanIP,
+		args.VxlanID, args.VxlanPort, args.ErspanVersion, args.ErspanDir, args.MirrorType)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if args.Encap == encapVeth {
+		if tunnel.Peer, err = parseVethPeer(procPrefix, args, &veth); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	for i := range mirrors {
+		if !mirrors[i].Host {
+			continue
+		}
+		// vlan/macvlan frames on the parent would be mirrored again
+		if (args.Encap == encapVlan || args.Encap == encapMacvlan) &&
+			mirrors[i].MirrorEgress == parentIf {
+			return nil, nil, nil, fmt.Errorf("cannot mirror parent interface %q of %s", parentIf, args.Encap)
+		}
+		mirrors[i].Tunnel = &tunnel
+		mirrors[i].Encrypted = args.IPsecKey != ""
+	}
+	return &veth, mirrors, &tunnel, nil
 }
 
-func parseReceiverArgs(procPrefix string, args *receiverArgs) (*koko.VEth, *koko.VxLan, error) {
-	exists, _ := koko.IsExistLinkInNS("", args.IfName)
-	if exists == true {
-		return nil, nil, fmt.Errorf("XXX")
+// parseVethPeer returns the peer of veth, in the analysis container of args
+// or in the host namespace.
+func parseVethPeer(procPrefix string, args *senderArgs, veth *koko.VEth) (koko.VEth, error) {
+	peer := koko.VEth{LinkName: args.DestIfName}
+	if peer.LinkName == "" {
+		peer.LinkName = args.IfName
+	}
+	if args.DestContainerID != "" || args.DestPodUID != "" {
+		// analysis pod is on the same node, hence found as the target. For
+		// host target, no runtime socket is mounted, so found from /proc.
+		dest := senderArgs{
+			ContainerID:    args.DestContainerID,
+			PodUID:         args.DestPodUID,
+			NetnsDiscovery: "runtime",
+			RuntimeSocket:  args.RuntimeSocket,
+		}
+		if args.NetnsDiscovery != "runtime" && dest.PodUID != "" {
+			dest.NetnsDiscovery = "proc"
+		}
+		var err error
+		if peer.NsName, err = getContainerNS(procPrefix, &dest); err != nil {
+			return peer, fmt.Errorf("analysis container: %v", err)
+		}
+	}
+	if peer.NsName == veth.NsName && peer.LinkName == veth.LinkName {
+		return peer, fmt.Errorf("veth peer %q is in the same namespace, please set dest-ifname", peer.LinkName)
+	}
+	exists, err := linkExists(peer.NsName, peer.LinkName)
+	if err != nil {
+		return peer, fmt.Errorf("failed to find veth peer %q in %s: %v", peer.LinkName, peer.NsName, err)
+	}
+	if exists {
+		return peer, fmt.Errorf("veth peer %q already exists in %s", peer.LinkName, peer.NsName)
+	}
+	return peer, nil
+}
+
+func parseReceiverArgs(procPrefix string, args *receiverArgs) ([]koko.VEth, []tunnel, error) {
+	// VLAN has no neighbor, the packets come from the network of parent-if
+	vlan := args.Encap == encapVlan
+	if len(args.IfNames) != len(args.VxlanIDs) || (!vlan && len(args.IfNames) != len(args.VxlanIPs)) {
+		return nil, nil, fmt.Errorf("number of ifname, vxlan-id and vxlan-ip mismatch")
+	}
+	if args.Encap == encapMacvlan {
+		return nil, nil, fmt.Errorf("no receiver for macvlan, capture on the network of parent-if")
+	}
+
+	for _, ifName := range args.IfNames {
+		exists, _ := koko.IsExistLinkInNS("", ifName)
+		if exists == true {
+			return nil, nil, fmt.Errorf("XXX")
+		}
 	}
 
 	if args.VxlanEgressIP != "" {
@@ -138,22 +302,38 @@ func parseReceiverArgs(procPrefix string, args *receiverArgs) (*koko.VEth, *koko
 		args.VxlanEgressIf = egressif.Name
 	}
 
-	veth := koko.VEth{}
-	veth.NsName = ""
-	veth.LinkName = args.IfName
+	veths := []koko.VEth{}
+	tunnels := []tunnel{}
+	for i, ifName := range args.IfNames {
+		veth := koko.VEth{}
+		veth.NsName = ""
+		veth.LinkName = ifName
 
-	vxlan := koko.VxLan{}
-	vxlan.ParentIF = args.VxlanEgressIf
-	vxlan.IPAddr = args.VxlanIP
-	vxlan.ID = args.VxlanID
-	vxlan.UDPPort = args.VxlanPort
-	return &veth, &vxlan, nil
+		var ip net.IP
+		parentIf := args.VxlanEgressIf
+		if vlan {
+			parentIf = args.ParentIf
+		} else {
+			ip = args.VxlanIPs[i]
+		}
+		// ERSPAN direction is in the header, hence receiver does not care
+		tunnel, err := newTunnel(args.Encap, parentIf, args.VxlanEgressIP,
+			ip, args.VxlanIDs[i], args.VxlanPort, args.ErspanVersion, "", "")
+		if err != nil {
+			return nil, nil, err
+		}
+
+		veths = append(veths, veth)
+		tunnels = append(tunnels, tunnel)
+	}
+	return veths, tunnels, nil
 }
 
 func main() {
 	a := kingpin.New(filepath.Base(os.Args[0]), "kokotap")
 	a.Version(fmt.Sprintf("%s/%s/%s", version, commit, date))
 
+	var interfacesArgs senderArgs
 	var senderArgs senderArgs
 	var receiverArgs receiverArgs
 	var procPrefix string
@@ -163,13 +343,21 @@ func main() {
 	a.VersionFlag.Short('v')
 	a.Flag("procprefix", "prefix for /proc filesystem").StringVar(&procPrefix)
 	//a.Flag("mode", "Kokotap mode (sender/receiver)").StringVar(&mode)
-	k := a.Command("mode", "Kokotap mode (sender/receiver)")
+	k := a.Command("mode", "Kokotap mode (sender/receiver/interfaces)")
 	s := k.Command("sender", "sender mode")
-	s.Flag("containerid", "container id").
-		Required().StringVar(&senderArgs.ContainerID)
+	s.Flag("containerid", "container id (with runtime prefix, e.g. containerd://)").
+		StringVar(&senderArgs.ContainerID)
+	s.Flag("pod-uid", "pod UID (used by proc netns discovery)").
+		StringVar(&senderArgs.PodUID)
+	s.Flag("netns-discovery", "how to find container netns {runtime|proc|host}").
+		Default("runtime").EnumVar(&senderArgs.NetnsDiscovery, "runtime", "proc", "host")
+	s.Flag("filter", "mirror only packets of protocol:ip:port (repeatable)").
+		StringsVar(&senderArgs.Filters)
+	s.Flag("runtime-socket", "container runtime (docker or CRI) socket path").
+		StringVar(&senderArgs.RuntimeSocket)
 	s.Flag("mirrortype", "mirror type (ingress)").
 		Required().StringVar(&senderArgs.MirrorType)
-	s.Flag("mirrorif", "mirror target interface").
+	s.Flag("mirrorif", "mirror target interfaces (comma-separated, or 'all')").
 		Required().StringVar(&senderArgs.MirrorIfName)
 	s.Flag("ifname", "interface name for container").
 		Required().StringVar(&senderArgs.IfName)
@@ -179,39 +367,117 @@ func main() {
 		StringVar(&senderArgs.VxlanEgressIP)
 	s.Flag("vxlan-id", "Vxlan ID").
 		Required().IntVar(&senderArgs.VxlanID)
-	s.Flag("vxlan-ip", "Vxlan neighbor IP").
-		Required().IPVar(&senderArgs.VxlanIP)
+	s.Flag("vxlan-ip", "Vxlan neighbor IP (not used by vlan/macvlan)").
+		IPVar(&senderArgs.VxlanIP)
 	s.Flag("vxlan-port", "Vxlan UDP port").
-		Required().IntVar(&senderArgs.VxlanPort)
+		IntVar(&senderArgs.VxlanPort)
+	s.Flag("encap", "encapsulation {vxlan|gretap|erspan|geneve|vlan|macvlan|veth} (vxlan-id is GRE key, ERSPAN session ID, Geneve VNI or VLAN ID)").
+		Default(encapVxlan).EnumVar(&senderArgs.Encap, encapVxlan, encapGretap, encapErspan, encapGeneve,
+		encapVlan, encapMacvlan, encapVeth)
+	s.Flag("parent-if", "parent (physical) interface of vlan/macvlan (default: vxlan-egressif)").
+		StringVar(&senderArgs.ParentIf)
+	s.Flag("dest-containerid", "analysis container id to put veth peer (default: host namespace)").
+		StringVar(&senderArgs.DestContainerID)
+	s.Flag("dest-pod-uid", "analysis pod UID to put veth peer (used by proc netns discovery)").
+		StringVar(&senderArgs.DestPodUID)
+	s.Flag("dest-ifname", "interface name of veth peer (default: ifname)").
+		StringVar(&senderArgs.DestIfName)
+	s.Flag("erspan-version", "ERSPAN version {1|2} (1: type II, 2: type III)").
+		Default("1").IntVar(&senderArgs.ErspanVersion)
+	s.Flag("erspan-dir", "ERSPAN type III direction {ingress|egress} (default: by mirrortype)").
+		EnumVar(&senderArgs.ErspanDir, "ingress", "egress")
+	s.Flag("target", "target label sent in Geneve options (e.g. namespace/pod)").
+		StringVar(&senderArgs.Target)
+	s.Flag("ipsec-key", "IPsec master key file to encrypt tunnel (optional)").
+		StringVar(&senderArgs.IPsecKey)
+	s.Flag("ipsec-spi", "IPsec SPI").
+		IntVar(&senderArgs.IPsecSPI)
 
 	r := k.Command("receiver", "receiver mode")
-	r.Flag("ifname", "interface name").
-		Required().StringVar(&receiverArgs.IfName)
+	r.Flag("ifname", "interface name (repeatable)").
+		Required().StringsVar(&receiverArgs.IfNames)
 	r.Flag("vxlan-egressif", "Egress interface for vxlan").
 		StringVar(&receiverArgs.VxlanEgressIf)
 	r.Flag("vxlan-egressip", "Egress interface ip addressfor vxlan").
 		StringVar(&receiverArgs.VxlanEgressIP)
-	r.Flag("vxlan-id", "Vxlan ID").
-		Required().IntVar(&receiverArgs.VxlanID)
-	r.Flag("vxlan-ip", "Vxlan neighbor IP").
-		Required().IPVar(&receiverArgs.VxlanIP)
+	r.Flag("vxlan-id", "Vxlan ID (repeatable, for each ifname)").
+		Required().IntsVar(&receiverArgs.VxlanIDs)
+	r.Flag("vxlan-ip", "Vxlan neighbor IP (repeatable, for each ifname, not used by vlan)").
+		IPListVar(&receiverArgs.VxlanIPs)
 	r.Flag("vxlan-port", "Vxlan UDP port").
-		Required().IntVar(&receiverArgs.VxlanPort)
+		IntVar(&receiverArgs.VxlanPort)
+	r.Flag("encap", "encapsulation {vxlan|gretap|erspan|geneve|vlan} (vxlan-id is GRE key, ERSPAN session ID, Geneve VNI or VLAN ID)").
+		Default(encapVxlan).EnumVar(&receiverArgs.Encap, encapVxlan, encapGretap, encapErspan, encapGeneve,
+		encapVlan, encapMacvlan)
+	r.Flag("parent-if", "parent (physical) interface of vlan").
+		StringVar(&receiverArgs.ParentIf)
+	r.Flag("erspan-version", "ERSPAN version {1|2} (1: type II, 2: type III)").
+		Default("1").IntVar(&receiverArgs.ErspanVersion)
+	r.Flag("pcap", "pcapng file to write with labels of target/interface/direction (geneve)").
+		StringVar(&receiverArgs.Pcap)
+	r.Flag("ipsec-key", "IPsec master key file to decrypt tunnel (optional)").
+		StringVar(&receiverArgs.IPsecKey)
+	r.Flag("ipsec-spi", "IPsec SPI (repeatable, for each ifname)").
+		IntsVar(&receiverArgs.IPsecSPIs)
+
+	i := k.Command("interfaces", "print interfaces in container netns as JSON")
+	i.Flag("containerid", "container id (with runtime prefix, e.g. containerd://)").
+		StringVar(&interfacesArgs.ContainerID)
+	i.Flag("pod-uid", "pod UID (used by proc netns discovery)").
+		StringVar(&interfacesArgs.PodUID)
+	i.Flag("netns-discovery", "how to find container netns {runtime|proc|host}").
+		Default("runtime").EnumVar(&interfacesArgs.NetnsDiscovery, "runtime", "proc", "host")
+	i.Flag("runtime-socket", "container runtime (docker or CRI) socket path").
+		StringVar(&interfacesArgs.RuntimeSocket)
 
-	var veth *koko.VEth
-	var vxlan *koko.VxLan
+	var veths []koko.VEth
+	var tunnels []tunnel
+	var mirrors []mirror
+	var sas []*ipsecSA
 	var err error
 
 	switch kingpin.MustParse(a.Parse(os.Args[1:])) {
 	case s.FullCommand():
 		fmt.Printf("sender\n")
-		veth, vxlan, err = parseSenderArgs(procPrefix, &senderArgs)
+		if senderArgs.Encap == encapGeneve {
+			if err = runGeneveSender(procPrefix, &senderArgs); err == nil {
+				return
+			}
+			break
+		}
+		var veth *koko.VEth
+		var t *tunnel
+		veth, mirrors, t, err = parseSenderArgs(procPrefix, &senderArgs)
+		if err == nil {
+			veths = []koko.VEth{*veth}
+			tunnels = []tunnel{*t}
+			sas, err = newIPsecSAs(senderArgs.IPsecKey, []int{senderArgs.IPsecSPI}, tunnels, netlink.XFRM_DIR_OUT)
+		}
 
 	case r.FullCommand():
 		fmt.Printf("receiver\n")
-		veth, vxlan, err = parseReceiverArgs(procPrefix, &receiverArgs)
-	}
+		if receiverArgs.Encap == encapGeneve {
+			if err = runGeneveReceiver(&receiverArgs); err == nil {
+				return
+			}
+			break
+		}
+		veths, tunnels, err = parseReceiverArgs(procPrefix, &receiverArgs)
+		if err == nil {
+			sas, err = newIPsecSAs(receiverArgs.IPsecKey, receiverArgs.IPsecSPIs, tunnels, netlink.XFRM_DIR_IN)
+		}
 
+	case i.FullCommand():
+		if err = printInterfaces(procPrefix, &interfacesArgs); err == nil {
+			return
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "XXX:%v\n", err)
+		os.Exit(1)
+	}
+	// the signal is caught before the SAs are added, so that they are removed
+	// even if the pod is deleted right away
 	sig := make(chan os.Signal, 1)
 	done := make(chan bool, 1)
 
@@ -223,46 +489,69 @@ func main() {
 		done <- true
 	}()
 
+	// the tunnel is not made unless it is encrypted
+	if err = addIPsecSAs(sas); err != nil {
+		fmt.Fprintf(os.Stderr, "XXX:%v\n", err)
+		os.Exit(1)
+	}
+
 	//var egressMTU int
-	var egressTxQLen int
-	if veth.MirrorEgress != "" {
-		/*
-			egressMTU, err = koko.GetMTU(veth.MirrorEgress)
+	egressTxQLens := make([]int, len(veths))
+	for i, veth := range veths {
+		if veth.MirrorEgress != "" {
+			/*
+				egressMTU, err = koko.GetMTU(veth.MirrorEgress)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "XXX:%v\n", err)
+				}
+			*/
+			egressTxQLens[i], err = veth.GetEgressTxQLen()
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "XXX:%v\n", err)
 			}
-		*/
-		egressTxQLen, err = veth.GetEgressTxQLen()
+		}
+		err = makeTunnel(veth, tunnels[i])
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "XXX:%v\n", err)
+			//bailout?
 		}
 	}
-	err = koko.MakeVxLan(*veth, *vxlan)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "XXX:%v\n", err)
-		//bailout?
+	for i := range mirrors {
+		err = mirrors[i].set()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "XXX:%v\n", err)
+		}
 	}
 
 	fmt.Println("Waiting for signal at main ...")
 	<-done
 
 	// Cleanup
-	if veth.MirrorEgress != "" {
-		/*
-			err = koko.SetMTU(veth.MirrorEgress, egressMTU)
+	for i := range mirrors {
+		err = mirrors[i].unset()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "XXX:%v\n", err)
+		}
+	}
+	for i, veth := range veths {
+		if veth.MirrorEgress != "" {
+			/*
+				err = koko.SetMTU(veth.MirrorEgress, egressMTU)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "XXX:%v\n", err)
+				}
+			*/
+			err = veth.SetEgressTxQLen(egressTxQLens[i])
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "XXX:%v\n", err)
 			}
-		*/
-		err = veth.SetEgressTxQLen(egressTxQLen)
+		}
+		err = veth.RemoveVethLink()
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "XXX:%v\n", err)
+			//bailout?
 		}
 	}
-	err = veth.RemoveVethLink()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "XXX:%v\n", err)
-		//bailout?
-	}
+	deleteIPsecSAs(sas)
 	fmt.Println("Exit from main")
 }
@@ -0,0 +1,192 @@
+// Copyright 2018 Red Hat
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+/*
+ * kokotap_pod: mirror several interfaces to one vxlan interface
+ *
+ * koko.MakeVxLan mirrors one interface to the vxlan interface. The other
+ * interfaces are mirrored to the same vxlan interface by tc in the container
+ * namespace, and unmirrored at exit.
+ */
+import (
+	"fmt"
+	"github.com/containernetworking/plugins/pkg/ns"
+	koko "github.com/redhat-nfvpe/koko/api"
+	"github.com/vishvananda/netlink"
+	"strings"
+)
+
+// mirrorAll is the mirror interface name to mirror all interfaces.
+const mirrorAll = "all"
+
+// getNS returns the network namespace of nsName, or current namespace if
+// nsName is empty (i.e. host namespace of sender pod).
+func getNS(nsName string) (ns.NetNS, error) {
+	if nsName == "" {
+		return ns.GetCurrentNS()
+	}
+	return ns.GetNS(nsName)
+}
+
+// linkExists returns true if the link of linkName is in the namespace.
+func linkExists(nsName, linkName string) (bool, error) {
+	netns, err := getNS(nsName)
+	if err != nil {
+		return false, err
+	}
+	defer netns.Close()
+
+	exists := false
+	err = netns.Do(func(_ ns.NetNS) error {
+		_, err := netlink.LinkByName(linkName)
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		exists = err == nil
+		return err
+	})
+	return exists, err
+}
+
+// listLinkNames returns the names of the links in the namespace.
+func listLinkNames(nsName string) ([]string, error) {
+	netns, err := getNS(nsName)
+	if err != nil {
+		return nil, err
+	}
+	defer netns.Close()
+
+	names := []string{}
+	err = netns.Do(func(_ ns.NetNS) error {
+		links, err := netlink.LinkList()
+		if err != nil {
+			return err
+		}
+		for _, link := range links {
+			names = append(names, link.Attrs().Name)
+		}
+		return nil
+	})
+	return names, err
+}
+
+// parseMirrorIfNames returns the mirror interface names, given as
+// comma-separated names or 'all' (every link in the namespace, including
+// 'lo', except vxlan interface ifName).
+func parseMirrorIfNames(nsName, mirrorIfName, ifName string) ([]string, error) {
+	if mirrorIfName != mirrorAll {
+		return strings.Split(mirrorIfName, ","), nil
+	}
+
+	links, err := listLinkNames(nsName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list interfaces in %s: %v", nsName, err)
+	}
+	names := []string{}
+	for _, name := range links {
+		if name != ifName {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// mirrorVEth returns the VEth which mirrors mirrorIfName to the link of veth,
+// by mirror type.
+func mirrorVEth(veth koko.VEth, mirrorType, mirrorIfName string) koko.VEth {
+	veth.MirrorIngress = ""
+	veth.MirrorEgress = ""
+	switch mirrorType {
+	case "ingress":
+		veth.MirrorIngress = mirrorIfName
+	case "egress":
+		veth.MirrorEgress = mirrorIfName
+	case "both":
+		veth.MirrorIngress = mirrorIfName
+		veth.MirrorEgress = mirrorIfName
+	}
+	return veth
+}
+
+// mirror is the mirror from the interface (MirrorIngress/MirrorEgress) to
+// the link (created by koko.MakeVxLan) of VEth, set by tc in its namespace.
+type mirror struct {
+	koko.VEth
+	Filters   []mirrorFilter // mirror only matched packets if given
+	Host      bool           // interface of the node (keep its qdiscs)
+	Tunnel    *tunnel        // tunnel of the sender, not mirrored (Host)
+	Encrypted bool           // Tunnel is encrypted by IPsec ESP
+
+	egressTxQLen int              // original TxQLen of egress interface
+	qdiscs       []netlink.Qdisc  // qdiscs added for filters
+	filters      []netlink.Filter // filters added for Filters
+}
+
+// set sets the mirror.
+func (m *mirror) set() error {
+	netns, err := getNS(m.NsName)
+	if err != nil {
+		return err
+	}
+	defer netns.Close()
+
+	return netns.Do(func(_ ns.NetNS) error {
+		if m.Host || len(m.Filters) > 0 {
+			return m.setFilters()
+		}
+		if m.MirrorIngress != "" {
+			if err := m.SetIngressMirror(); err != nil {
+				return fmt.Errorf("failed to set tc ingress mirror: %v", err)
+			}
+		}
+		if m.MirrorEgress != "" {
+			var err error
+			if m.egressTxQLen, err = m.GetEgressTxQLen(); err != nil {
+				return err
+			}
+			if err = m.SetEgressMirror(); err != nil {
+				return fmt.Errorf("failed to set tc egress mirror: %v", err)
+			}
+		}
+		return nil
+	})
+}
+
+// unset removes the mirror and restores TxQLen of egress interface.
+func (m *mirror) unset() error {
+	netns, err := getNS(m.NsName)
+	if err != nil {
+		return err
+	}
+	defer netns.Close()
+
+	return netns.Do(func(_ ns.NetNS) error {
+		if m.Host || len(m.Filters) > 0 {
+			return m.unsetFilters()
+		}
+		if m.MirrorIngress != "" {
+			if err := m.UnsetIngressMirror(); err != nil {
+				return fmt.Errorf("failed to unset tc ingress mirror: %v", err)
+			}
+		}
+		if m.MirrorEgress != "" {
+			if err := m.UnsetEgressMirror(); err != nil {
+				return fmt.Errorf("failed to unset tc egress mirror: %v", err)
+			}
+			return m.SetEgressTxQLen(m.egressTxQLen)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,172 @@
+// Copyright 2018 Red Hat
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"github.com/containernetworking/plugins/pkg/ns"
+	koko "github.com/redhat-nfvpe/koko/api"
+	"github.com/vishvananda/netlink"
+	"os"
+	"reflect"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+// newTestNS returns the path of new network namespace with the links (bridge,
+// as dummy may not be in the kernel), which is kept by a locked thread until
+// the returned function is called. The test is skipped if new namespace is
+// not permitted.
+func newTestNS(t *testing.T, linkNames ...string) (string, func()) {
+	path := make(chan string, 1)
+	done := make(chan struct{})
+	go func() {
+		// the thread is not unlocked, so it exits with the namespace
+		runtime.LockOSThread()
+		if err := syscall.Unshare(syscall.CLONE_NEWNET); err != nil {
+			close(path)
+			return
+		}
+		path <- fmt.Sprintf("/proc/%d/task/%d/ns/net", os.Getpid(), syscall.Gettid())
+		<-done
+	}()
+	nsName, ok := <-path
+	if !ok {
+		t.Skip("network namespace is not permitted")
+	}
+
+	netns, err := ns.GetNS(nsName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer netns.Close()
+	err = netns.Do(func(_ ns.NetNS) error {
+		for _, name := range linkNames {
+			link := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: name}}
+			if err := netlink.LinkAdd(link); err != nil {
+				return err
+			}
+			if err := netlink.LinkSetUp(link); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		close(done)
+		t.Fatal(err)
+	}
+	return nsName, func() { close(done) }
+}
+
+// testFilterCount returns the number of tc filters of parent on the link in
+// the namespace.
+func testFilterCount(t *testing.T, nsName, linkName string, parent uint32) int {
+	netns, err := ns.GetNS(nsName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer netns.Close()
+	count := 0
+	err = netns.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(linkName)
+		if err != nil {
+			return err
+		}
+		filters, err := netlink.FilterList(link, parent)
+		count = len(filters)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestParseMirrorIfNames(t *testing.T) {
+	nsName, cleanup := newTestNS(t, "eth0", "net1", "mirror0")
+	defer cleanup()
+
+	tests := []struct {
+		mirrorIfName string
+		want         []string
+	}{
+		{mirrorIfName: "eth0", want: []string{"eth0"}},
+		{mirrorIfName: "net1,lo", want: []string{"net1", "lo"}},
+		{mirrorIfName: "all", want: []string{"lo", "eth0", "net1"}},
+	}
+
+	for _, tt := range tests {
+		names, err := parseMirrorIfNames(nsName, tt.mirrorIfName, "mirror0")
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.mirrorIfName, err)
+			continue
+		}
+		if !reflect.DeepEqual(names, tt.want) {
+			t.Errorf("%s: mirror interfaces = %v, want %v", tt.mirrorIfName, names, tt.want)
+		}
+	}
+}
+
+func TestMirrorSetUnset(t *testing.T) {
+	mirrorIfNames := []string{"lo", "eth0", "net1"}
+	ingress := netlink.MakeHandle(0xffff, 0)
+
+	tests := []struct {
+		name    string
+		host    bool
+		filters []mirrorFilter
+	}{
+		{name: "pod interfaces"},
+		{name: "node interfaces", host: true},
+		{name: "filters", filters: []mirrorFilter{{Protocol: syscall.IPPROTO_TCP, IP: []byte{10, 0, 0, 1}, Port: 80}}},
+	}
+
+	for _, tt := range tests {
+		nsName, cleanup := newTestNS(t, "eth0", "net1", "mirror0")
+		veth := koko.VEth{NsName: nsName, LinkName: "mirror0"}
+		mirrors := []mirror{}
+		for _, name := range mirrorIfNames {
+			mirrors = append(mirrors, mirror{
+				VEth:    mirrorVEth(veth, "ingress", name),
+				Host:    tt.host,
+				Filters: tt.filters,
+			})
+		}
+
+		for i := range mirrors {
+			if err := mirrors[i].set(); err != nil {
+				cleanup()
+				t.Skipf("%s: tc ingress mirror is not supported: %v", tt.name, err)
+			}
+		}
+		for _, name := range mirrorIfNames {
+			if n := testFilterCount(t, nsName, name, ingress); n == 0 {
+				t.Errorf("%s: no mirror filter on %s", tt.name, name)
+			}
+		}
+		for i := range mirrors {
+			if err := mirrors[i].unset(); err != nil {
+				t.Errorf("%s: failed to unset mirror of %s: %v", tt.name, mirrorIfNames[i], err)
+			}
+		}
+		for _, name := range mirrorIfNames {
+			if n := testFilterCount(t, nsName, name, ingress); n != 0 {
+				t.Errorf("%s: %d filters remain on %s", tt.name, n, name)
+			}
+		}
+		cleanup()
+	}
+}
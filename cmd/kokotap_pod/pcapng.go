@@ -0,0 +1,167 @@
+// Copyright 2018 Red Hat
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+/*
+ * kokotap_pod: pcapng writer for Geneve receiver
+ *
+ * The frames are written with the labels from Geneve options of kokotap:
+ * each target/interface (e.g. 'default/web-0:eth0') has own interface
+ * description block, and the direction is in the packet flags, so capture
+ * tools (e.g. Wireshark) show them for each packet.
+ */
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// pcapng block types and options
+const (
+	pcapngSectionHeader    = 0x0a0d0d0a
+	pcapngInterfaceDesc    = 0x00000001
+	pcapngEnhancedPacket   = 0x00000006
+	pcapngByteOrderMagic   = 0x1a2b3c4d
+	pcapngLinkTypeEthernet = 1
+	pcapngOptEnd           = 0
+	pcapngOptIfName        = 2
+	pcapngOptIfDescription = 3
+	pcapngOptEpbFlags      = 2
+	pcapngFlagInbound      = 1
+	pcapngFlagOutbound     = 2
+)
+
+// pcapngWriter writes pcapng file. The interface is added for each label.
+type pcapngWriter struct {
+	mutex      sync.Mutex
+	file       *os.File
+	w          *bufio.Writer
+	interfaces map[string]uint32 // interface ID by label
+}
+
+// pcapngOption returns the option of the block, padded to 4 bytes.
+func pcapngOption(code uint16, value []byte) []byte {
+	opt := make([]byte, 4+(len(value)+3)/4*4)
+	binary.LittleEndian.PutUint16(opt[0:], code)
+	binary.LittleEndian.PutUint16(opt[2:], uint16(len(value)))
+	copy(opt[4:], value)
+	return opt
+}
+
+// writeBlock writes the block of blockType, which has body and options.
+func (p *pcapngWriter) writeBlock(blockType uint32, body []byte, opts ...[]byte) error {
+	if len(opts) > 0 {
+		opts = append(opts, pcapngOption(pcapngOptEnd, nil))
+	}
+	length := 12 + len(body)
+	for _, opt := range opts {
+		length += len(opt)
+	}
+
+	header := make([]byte, 8)
+	binary.LittleEndian.PutUint32(header[0:], blockType)
+	binary.LittleEndian.PutUint32(header[4:], uint32(length))
+	p.w.Write(header)
+	p.w.Write(body)
+	for _, opt := range opts {
+		p.w.Write(opt)
+	}
+	_, err := p.w.Write(header[4:8])
+	return err
+}
+
+// newPcapngWriter creates pcapng file of path, with section header.
+func newPcapngWriter(path string) (*pcapngWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pcapng: %v", err)
+	}
+	p := &pcapngWriter{file: file, w: bufio.NewWriter(file), interfaces: map[string]uint32{}}
+
+	body := make([]byte, 16)
+	binary.LittleEndian.PutUint32(body[0:], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(body[4:], 1)                  // major version
+	binary.LittleEndian.PutUint16(body[6:], 0)                  // minor version
+	binary.LittleEndian.PutUint64(body[8:], 0xffffffffffffffff) // section length (unknown)
+	if err := p.writeBlock(pcapngSectionHeader, body); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return p, p.w.Flush()
+}
+
+// interfaceID returns the interface of the target/interface label, added
+// at first packet.
+func (p *pcapngWriter) interfaceID(sender net.IP, vni int, meta *geneveMetadata) (uint32, error) {
+	label := fmt.Sprintf("%s:%s", meta.Target, meta.Interface)
+	if id, ok := p.interfaces[label]; ok {
+		return id, nil
+	}
+
+	body := make([]byte, 8)
+	binary.LittleEndian.PutUint16(body[0:], pcapngLinkTypeEthernet)
+	description := fmt.Sprintf("kokotap %s (VNI %d from %s)", label, vni, sender)
+	err := p.writeBlock(pcapngInterfaceDesc, body,
+		pcapngOption(pcapngOptIfName, []byte(label)),
+		pcapngOption(pcapngOptIfDescription, []byte(description)))
+	if err != nil {
+		return 0, err
+	}
+	id := uint32(len(p.interfaces))
+	p.interfaces[label] = id
+	return id, nil
+}
+
+// WritePacket writes the frame from the sender, with the labels of meta.
+func (p *pcapngWriter) WritePacket(sender net.IP, vni int, meta *geneveMetadata, frame []byte) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	id, err := p.interfaceID(sender, vni, meta)
+	if err != nil {
+		return err
+	}
+	// timestamp in microseconds (default resolution)
+	ts := uint64(time.Now().UnixNano() / 1000)
+	body := make([]byte, 20+(len(frame)+3)/4*4)
+	binary.LittleEndian.PutUint32(body[0:], id)
+	binary.LittleEndian.PutUint32(body[4:], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(ts))
+	binary.LittleEndian.PutUint32(body[12:], uint32(len(frame)))
+	binary.LittleEndian.PutUint32(body[16:], uint32(len(frame)))
+	copy(body[20:], frame)
+
+	flags := make([]byte, 4)
+	binary.LittleEndian.PutUint32(flags, pcapngFlagInbound)
+	if meta.Egress {
+		binary.LittleEndian.PutUint32(flags, pcapngFlagOutbound)
+	}
+	if err := p.writeBlock(pcapngEnhancedPacket, body, pcapngOption(pcapngOptEpbFlags, flags)); err != nil {
+		return err
+	}
+	// flush each packet, so that the file can be followed (e.g. tail -f)
+	return p.w.Flush()
+}
+
+// Close closes the file.
+func (p *pcapngWriter) Close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.w.Flush()
+	return p.file.Close()
+}
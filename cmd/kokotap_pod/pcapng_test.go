@@ -0,0 +1,167 @@
+// Copyright 2018 Red Hat
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// pcapngBlock is the block read from pcapng file.
+type pcapngBlock struct {
+	Type uint32
+	Body []byte // body and options
+}
+
+// readPcapngBlocks returns the blocks of pcapng (little endian) data.
+func readPcapngBlocks(t *testing.T, data []byte) []pcapngBlock {
+	blocks := []pcapngBlock{}
+	for len(data) > 0 {
+		if len(data) < 12 {
+			t.Fatalf("short block: %x", data)
+		}
+		length := int(binary.LittleEndian.Uint32(data[4:]))
+		if length%4 != 0 || length > len(data) {
+			t.Fatalf("invalid block length %d", length)
+		}
+		if trailer := int(binary.LittleEndian.Uint32(data[length-4:])); trailer != length {
+			t.Fatalf("block length %d mismatch with trailer %d", length, trailer)
+		}
+		blocks = append(blocks, pcapngBlock{
+			Type: binary.LittleEndian.Uint32(data[0:]),
+			Body: data[8 : length-4],
+		})
+		data = data[length:]
+	}
+	return blocks
+}
+
+func TestPcapngOption(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  []byte
+		length int
+	}{
+		{name: "end of options", value: nil, length: 4},
+		{name: "aligned", value: []byte("eth0"), length: 8},
+		{name: "padded", value: []byte("web-0:eth0"), length: 16},
+	}
+
+	for _, tt := range tests {
+		opt := pcapngOption(pcapngOptIfName, tt.value)
+		if len(opt) != tt.length {
+			t.Errorf("%s: option length = %d, want %d", tt.name, len(opt), tt.length)
+		}
+		if n := int(binary.LittleEndian.Uint16(opt[2:])); n != len(tt.value) {
+			t.Errorf("%s: value length = %d, want %d", tt.name, n, len(tt.value))
+		}
+	}
+}
+
+func TestPcapngWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kokotap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tap.pcapng")
+
+	sender := net.ParseIP("10.0.0.2")
+	packets := []struct {
+		meta  geneveMetadata
+		frame []byte
+		id    uint32
+		flags uint32
+	}{
+		{
+			meta:  geneveMetadata{Target: "default/web-0", Interface: "eth0"},
+			frame: []byte{1, 2, 3, 4, 5, 6},
+			id:    0,
+			flags: pcapngFlagInbound,
+		},
+		{
+			meta:  geneveMetadata{Target: "default/web-1", Interface: "eth0", Egress: true},
+			frame: []byte{7, 8, 9, 10},
+			id:    1,
+			flags: pcapngFlagOutbound,
+		},
+		{
+			meta:  geneveMetadata{Target: "default/web-0", Interface: "eth0", Egress: true},
+			frame: []byte{11},
+			id:    0,
+			flags: pcapngFlagOutbound,
+		},
+	}
+
+	p, err := newPcapngWriter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range packets {
+		if err := p.WritePacket(sender, 100, &packets[i].meta, packets[i].frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := readPcapngBlocks(t, data)
+	types := []uint32{}
+	for _, block := range blocks {
+		types = append(types, block.Type)
+	}
+	wantTypes := []uint32{pcapngSectionHeader, pcapngInterfaceDesc, pcapngEnhancedPacket,
+		pcapngInterfaceDesc, pcapngEnhancedPacket, pcapngEnhancedPacket}
+	if len(types) != len(wantTypes) {
+		t.Fatalf("block types = %x, want %x", types, wantTypes)
+	}
+	for i := range types {
+		if types[i] != wantTypes[i] {
+			t.Fatalf("block types = %x, want %x", types, wantTypes)
+		}
+	}
+	if magic := binary.LittleEndian.Uint32(blocks[0].Body); magic != pcapngByteOrderMagic {
+		t.Errorf("byte order magic = %#x", magic)
+	}
+
+	packetBlocks := []pcapngBlock{blocks[2], blocks[4], blocks[5]}
+	for i, block := range packetBlocks {
+		want := packets[i]
+		body := block.Body
+		if id := binary.LittleEndian.Uint32(body[0:]); id != want.id {
+			t.Errorf("packet %d: interface ID = %d, want %d", i, id, want.id)
+		}
+		captured := int(binary.LittleEndian.Uint32(body[12:]))
+		if captured != len(want.frame) || string(body[20:20+captured]) != string(want.frame) {
+			t.Errorf("packet %d: frame = %x, want %x", i, body[20:20+captured], want.frame)
+		}
+		// flags option follows the padded frame
+		opt := body[20+(captured+3)/4*4:]
+		if code := binary.LittleEndian.Uint16(opt[0:]); code != pcapngOptEpbFlags {
+			t.Errorf("packet %d: option code = %d", i, code)
+		}
+		if flags := binary.LittleEndian.Uint32(opt[4:]); flags != want.flags {
+			t.Errorf("packet %d: flags = %d, want %d", i, flags, want.flags)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 Red Hat
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+/*
+ * kokotap_pod: find container's network namespace from /proc
+ *
+ * Kubelet puts containers in the cgroup which has pod UID (e.g.
+ * 'kubepods/besteffort/pod<uid>/<container id>' or, for systemd cgroup
+ * driver, 'kubepods-besteffort-pod<uid>.slice/cri-containerd-<id>.scope'),
+ * hence the process of the container is found from /proc/<pid>/cgroup
+ * without container runtime.
+ */
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// cgroupMatcher returns a function which returns true if the cgroup file
+// content has the pod UID and the container ID (if given).
+func cgroupMatcher(podUID, containerID string) func(cgroup string) bool {
+	podUIDs := []string{}
+	if podUID != "" {
+		podUIDs = append(podUIDs, "pod"+podUID,
+			"pod"+strings.Replace(podUID, "-", "_", -1))
+	}
+
+	return func(cgroup string) bool {
+		if containerID != "" && !strings.Contains(cgroup, containerID) {
+			return false
+		}
+		if len(podUIDs) == 0 {
+			return true
+		}
+		for _, uid := range podUIDs {
+			if strings.Contains(cgroup, uid) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// findCgroupPid returns the pid, under procPrefix, of which cgroup matches
+// with match. The pause process (i.e. pod sandbox) is preferred, then the
+// smallest pid. 0 is returned if no process is found.
+func findCgroupPid(procPrefix string, match func(cgroup string) bool) (int, error) {
+	procDir := filepath.Join(procPrefix, "/proc")
+	entries, err := ioutil.ReadDir(procDir)
+	if err != nil {
+		return 0, err
+	}
+
+	found := 0
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		// the process may exit while scanning, so ignore the error
+		cgroup, err := ioutil.ReadFile(filepath.Join(procDir, entry.Name(), "cgroup"))
+		if err != nil || !match(string(cgroup)) {
+			continue
+		}
+		comm, _ := ioutil.ReadFile(filepath.Join(procDir, entry.Name(), "comm"))
+		if strings.TrimSpace(string(comm)) == "pause" {
+			return pid, nil
+		}
+		if found == 0 || pid < found {
+			found = pid
+		}
+	}
+	return found, nil
+}
+
+// GetProcContainerNS retrieves container's network namespace by scanning
+// cgroup of the processes under procPrefix. If pod UID is given, the
+// namespace of the pod sandbox is returned, which outlives the containers of
+// the pod. Otherwise the process is found by containerID (without runtime
+// prefix).
+func GetProcContainerNS(procPrefix, podUID, containerID string) (string, error) {
+	if podUID == "" && containerID == "" {
+		return "", fmt.Errorf("no pod uid or container id")
+	}
+	if podUID != "" {
+		containerID = ""
+	}
+
+	pid, err := findCgroupPid(procPrefix, cgroupMatcher(podUID, containerID))
+	if err != nil {
+		return "", fmt.Errorf("failed to scan processes: %v", err)
+	}
+	if pid == 0 {
+		return "", fmt.Errorf("no process found for pod uid %q, container id %q",
+			podUID, containerID)
+	}
+	return fmt.Sprintf("%s//proc/%d/ns/net", procPrefix, pid), nil
+}
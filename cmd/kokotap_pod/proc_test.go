@@ -0,0 +1,53 @@
+// Copyright 2018 Red Hat
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"testing"
+)
+
+func TestCgroupMatcher(t *testing.T) {
+	const (
+		podUID      = "0b7a5f2e-1c3d-4e5f-8a9b-0c1d2e3f4a5b"
+		containerID = "3f1c2b4a5d6e7f8091a2b3c4d5e6f708192a3b4c5d6e7f8091a2b3c4d5e6f7081"
+	)
+	cgroupfs := "12:pids:/kubepods/besteffort/pod" + podUID + "/" + containerID + "\n"
+	systemd := "0::/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod" +
+		"0b7a5f2e_1c3d_4e5f_8a9b_0c1d2e3f4a5b.slice/cri-containerd-" + containerID + ".scope\n"
+	other := "0::/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod" +
+		"11111111_2222_3333_4444_555555555555.slice/crio-0123456789abcdef.scope\n"
+
+	tests := []struct {
+		name        string
+		podUID      string
+		containerID string
+		cgroup      string
+		want        bool
+	}{
+		{name: "pod uid of cgroupfs", podUID: podUID, cgroup: cgroupfs, want: true},
+		{name: "pod uid of systemd", podUID: podUID, cgroup: systemd, want: true},
+		{name: "container id", containerID: containerID, cgroup: systemd, want: true},
+		{name: "pod uid and container id", podUID: podUID, containerID: containerID, cgroup: cgroupfs, want: true},
+		{name: "other pod", podUID: podUID, cgroup: other},
+		{name: "other container", containerID: containerID, cgroup: other},
+		{name: "other container of the pod", podUID: podUID, containerID: "0123456789abcdef", cgroup: cgroupfs},
+		{name: "host process", podUID: podUID, cgroup: "0::/system.slice/kubelet.service\n"},
+	}
+
+	for _, tt := range tests {
+		if got := cgroupMatcher(tt.podUID, tt.containerID)(tt.cgroup); got != tt.want {
+			t.Errorf("%s: match = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}